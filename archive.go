@@ -0,0 +1,427 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// A charta archive is a zip file that holds a single charta, so it can be
+// moved to another server:
+//
+//	manifest.json        the format, the size of the charta and its fragment sequence
+//	charta.png           the pixels
+//	fragments.json       the fragment records
+//	fragments/{id}.png   the fragment images
+//
+// Importing an archive creates a new charta, the ids of the fragments are kept.
+
+const (
+	archiveFormat  = "chartographer-charta"
+	archiveVersion = 1
+)
+
+type ArchiveManifest struct {
+	Format   string    `json:"format"`
+	Version  int       `json:"version"`
+	Exported time.Time `json:"exported"`
+	Source   string    `json:"source"`
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+	// FragmentSequence is the last fragment id that was given out.
+	FragmentSequence uint64 `json:"fragmentSequence"`
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// archiveSnapshot is everything an archive is written from. It is opened in
+// a transaction and written after it, so a slow client doesn't hold the
+// database open.
+type archiveSnapshot struct {
+	manifest  ArchiveManifest
+	records   []FragmentRecord
+	rows      chartaRows
+	fragments map[string]*os.File
+}
+
+func (cs *ChartographerService) openArchiveSnapshot(tx *bolt.Tx, charta *Charta) (*archiveSnapshot, error) {
+	records, err := findFragments(tx, charta.Id, image.Rectangle{})
+	if err != nil {
+		return nil, err
+	}
+	var sequence uint64
+	if fragments := tx.Bucket([]byte("fragments")).Bucket([]byte(charta.Id)); fragments != nil {
+		sequence = fragments.Sequence()
+	}
+
+	snapshot := &archiveSnapshot{
+		manifest: ArchiveManifest{
+			Format:           archiveFormat,
+			Version:          archiveVersion,
+			Exported:         time.Now().UTC(),
+			Source:           charta.Id,
+			Width:            charta.Width,
+			Height:           charta.Height,
+			FragmentSequence: sequence,
+		},
+		records:   records,
+		fragments: map[string]*os.File{},
+	}
+	if snapshot.rows, err = cs.store.Rows(charta); err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		file, err := os.Open(cs.fragmentFilename(charta.Id, record.Id))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			snapshot.Close()
+			return nil, err
+		}
+		snapshot.fragments[record.Id] = file
+	}
+	return snapshot, nil
+}
+
+func (s *archiveSnapshot) Close() {
+	_ = s.rows.Close()
+	for _, file := range s.fragments {
+		_ = file.Close()
+	}
+}
+
+// writeArchive writes the archive of the charta. Images are already
+// compressed, so they are stored as they are.
+func (s *archiveSnapshot) writeArchive(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	err := writeZipJSON(zw, "manifest.json", s.manifest)
+	if err != nil {
+		return err
+	}
+
+	pw, err := zw.CreateHeader(&zip.FileHeader{Name: "charta.png", Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	if err = writePNGRows(pw, s.rows, zlib.BestSpeed); err != nil {
+		return err
+	}
+
+	if err = writeZipJSON(zw, "fragments.json", s.records); err != nil {
+		return err
+	}
+	for _, record := range s.records {
+		file := s.fragments[record.Id]
+		if file == nil {
+			continue
+		}
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: "fragments/" + record.Id + ".png", Method: zip.Store, Modified: record.CreatedAt})
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(fw, file); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func (cs *ChartographerService) getArchiveEndpoint(c *gin.Context) {
+	var snapshot *archiveSnapshot
+	err := cs.DB.View(func(tx *bolt.Tx) error {
+		charta, err := getCharta(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if charta == nil {
+			return errChartaNotFound
+		}
+		snapshot, err = cs.openArchiveSnapshot(tx, charta)
+		return err
+	})
+	if errors.Is(err, errChartaNotFound) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer snapshot.Close()
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "charta-"+snapshot.manifest.Source+".zip"))
+	c.Header("Content-Type", "application/zip")
+	c.Status(http.StatusOK)
+	if err = snapshot.writeArchive(c.Writer); err != nil {
+		abortResponse("archive", err)
+	}
+}
+
+// chartaArchive is an uploaded archive that has been checked.
+type chartaArchive struct {
+	manifest ArchiveManifest
+	records  []FragmentRecord
+	files    map[string]*zip.File
+}
+
+func readZipJSON(f *zip.File, v interface{}) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(v)
+}
+
+func checkZipPNG(f *zip.File, width, height int) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	config, err := png.DecodeConfig(r)
+	if err != nil {
+		return err
+	}
+	if config.Width != width || config.Height != height {
+		return fmt.Errorf("%dx%d instead of %dx%d", config.Width, config.Height, width, height)
+	}
+	return nil
+}
+
+// archiveModes are the blend modes a fragment may have been added with.
+var archiveModes = map[string]bool{
+	"":               true,
+	modeReplace:      true,
+	modeOver:         true,
+	modeAverage:      true,
+	modeMax:          true,
+	modeMin:          true,
+	modeKeepExisting: true,
+}
+
+// openArchive checks everything in the archive that can be checked without
+// decoding the images. Errors wrap errCorruptImage.
+func openArchive(r io.ReaderAt, size int64) (*chartaArchive, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorruptImage, err)
+	}
+
+	archive := &chartaArchive{files: map[string]*zip.File{}}
+	for _, f := range zr.File {
+		archive.files[f.Name] = f
+	}
+
+	fail := func(format string, args ...interface{}) (*chartaArchive, error) {
+		return nil, fmt.Errorf("%w: %s", errCorruptImage, fmt.Sprintf(format, args...))
+	}
+	for _, name := range []string{"manifest.json", "charta.png", "fragments.json"} {
+		if archive.files[name] == nil {
+			return fail("%s is missing", name)
+		}
+	}
+
+	m := &archive.manifest
+	if err = readZipJSON(archive.files["manifest.json"], m); err != nil {
+		return fail("manifest.json: %v", err)
+	}
+	if m.Format != archiveFormat || m.Version != archiveVersion {
+		return fail("unsupported format %s version %d", m.Format, m.Version)
+	}
+	if m.Width < 1 || m.Width > 20000 || m.Height < 1 || m.Height > 50000 {
+		return fail("invalid size %dx%d", m.Width, m.Height)
+	}
+	if err = checkZipPNG(archive.files["charta.png"], m.Width, m.Height); err != nil {
+		return fail("charta.png: %v", err)
+	}
+
+	if err = readZipJSON(archive.files["fragments.json"], &archive.records); err != nil {
+		return fail("fragments.json: %v", err)
+	}
+	// The records are replayed and indexed like the ones of the service, so
+	// they have to be as valid as those.
+	bounds := image.Rect(0, 0, m.Width, m.Height)
+	ids, zs := map[string]bool{}, map[uint64]bool{}
+	for _, record := range archive.records {
+		id, err := strconv.ParseUint(record.Id, 10, 64)
+		if err != nil || id == 0 || id > m.FragmentSequence || ids[record.Id] {
+			return fail("invalid fragment id %q", record.Id)
+		}
+		ids[record.Id] = true
+		if record.Width < 1 || record.Height < 1 || !record.Rect().In(bounds) {
+			return fail("fragment %s: invalid rectangle", record.Id)
+		}
+		if record.Z == 0 || record.Z > m.FragmentSequence || zs[record.Z] {
+			return fail("fragment %s: invalid z %d", record.Id, record.Z)
+		}
+		zs[record.Z] = true
+		if !archiveModes[record.Mode] || record.Feather < 0 || record.Feather > 500 {
+			return fail("fragment %s: invalid blending", record.Id)
+		}
+		if f := archive.files["fragments/"+record.Id+".png"]; f != nil {
+			if err = checkZipPNG(f, record.Width, record.Height); err != nil {
+				return fail("fragment %s: %v", record.Id, err)
+			}
+		}
+	}
+	return archive, nil
+}
+
+func extractZipFile(f *zip.File, filename string) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return replaceFile(filename, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// storeArchive creates a new charta of the project from the archive. The
+// fragments keep their creators. The images are extracted before the
+// transaction, which only moves them into place.
+func (cs *ChartographerService) storeArchive(archive *chartaArchive, project, creator string) (*Charta, error) {
+	pixels, err := os.CreateTemp(cs.pathName, "archive-*.png")
+	if err != nil {
+		return nil, err
+	}
+	_ = pixels.Close()
+	defer os.Remove(pixels.Name())
+	if err = extractZipFile(archive.files["charta.png"], pixels.Name()); err != nil {
+		return nil, fmt.Errorf("%w: charta.png: %v", errCorruptImage, err)
+	}
+
+	fragmentsDir, err := os.MkdirTemp(cs.pathName, "archive-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(fragmentsDir)
+	if err = os.Chmod(fragmentsDir, 0755); err != nil {
+		return nil, err
+	}
+	for _, record := range archive.records {
+		if f := archive.files["fragments/"+record.Id+".png"]; f != nil {
+			if err = extractZipFile(f, fmt.Sprintf("%s/%s.png", fragmentsDir, record.Id)); err != nil {
+				return nil, fmt.Errorf("%w: fragment %s: %v", errCorruptImage, record.Id, err)
+			}
+		}
+	}
+
+	charta := Charta{Width: archive.manifest.Width, Height: archive.manifest.Height, Project: project, Creator: creator}
+	err = cs.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("chartas"))
+		err := cs.checkQuota(tx, project, 1, int64(charta.Width)*int64(charta.Height))
+		if err != nil {
+			return err
+		}
+
+		id, _ := b.NextSequence()
+		charta.Id = strconv.Itoa(int(id))
+
+		// The id is given out again if the transaction fails, so nothing
+		// may be left behind.
+		err = cs.storeArchiveCharta(tx, archive, &charta, pixels.Name(), fragmentsDir)
+		if err != nil {
+			_ = cs.store.Delete(&charta)
+			_ = os.RemoveAll(fmt.Sprintf("%s/fragments/%s", cs.pathName, charta.Id))
+			return err
+		}
+
+		buf, err := json.Marshal(charta)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(charta.Id), buf)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &charta, nil
+}
+
+func (cs *ChartographerService) storeArchiveCharta(tx *bolt.Tx, archive *chartaArchive, charta *Charta, pixels, fragmentsDir string) error {
+	if err := cs.store.Import(charta, pixels); err != nil {
+		return fmt.Errorf("%w: charta.png: %v", errCorruptImage, err)
+	}
+
+	fragments, err := tx.Bucket([]byte("fragments")).CreateBucketIfNotExists([]byte(charta.Id))
+	if err != nil {
+		return err
+	}
+	if err = fragments.SetSequence(archive.manifest.FragmentSequence); err != nil {
+		return err
+	}
+	for i := range archive.records {
+		record := archive.records[i]
+		record.ChartaId = charta.Id
+		if err = putFragmentRecord(tx, &record); err != nil {
+			return err
+		}
+	}
+	if err = os.MkdirAll(cs.pathName+"/fragments", 0755); err != nil {
+		return err
+	}
+	if err = os.Rename(fragmentsDir, fmt.Sprintf("%s/fragments/%s", cs.pathName, charta.Id)); err != nil {
+		return err
+	}
+	return cs.accountCharta(tx, charta, 0)
+}
+
+func (cs *ChartographerService) importArchiveEndpoint(c *gin.Context) {
+	spool, err := os.CreateTemp(cs.pathName, "import-*.tmp")
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, status := spoolBody(c, c.Request.Body, spool, maxImportSize)
+	if status != 0 {
+		c.AbortWithStatus(status)
+		return
+	}
+
+	archive, err := openArchive(spool, size)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	charta, err := cs.storeArchive(archive, requestProject(c), requestCreator(c))
+	if errors.Is(err, errCorruptImage) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		c.AbortWithStatus(quotaStatus(err))
+		return
+	}
+
+	c.String(http.StatusCreated, charta.Id)
+}
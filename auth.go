@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With Auth enabled every request needs an API key, in the X-API-Key header
+// or as a bearer token. Keys are random, so a plain SHA-256 is enough to
+// store them: the "apikeys" bucket maps the hash of a key to its APIKey.
+// Requests made with a key act for the project of the key, only admin keys
+// may choose the project with X-Project and use the /admin endpoints. The
+// name of the key is recorded as the creator of chartas and fragments. Other
+// keys only see the chartas and jobs of their own project; those of other
+// projects are answered with 404, as if they didn't exist.
+
+const (
+	apiKeyHeader  = "X-API-Key"
+	apiKeyContext = "apiKey"
+)
+
+var errAPIKeyExists = errors.New("api key name is taken")
+
+type APIKey struct {
+	Id      string    `json:"id"`
+	Name    string    `json:"name"`
+	Project string    `json:"project,omitempty"`
+	Admin   bool      `json:"admin,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type APIKeyQuery struct {
+	Name    string `form:"name" binding:"required,max=64"`
+	Project string `form:"project" binding:"max=64"`
+	Admin   bool   `form:"admin"`
+}
+
+// NewAPIKey is returned once, when the key is created.
+type NewAPIKey struct {
+	Key string `json:"key"`
+	APIKey
+}
+
+func hashAPIKey(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+func listAPIKeys(tx *bolt.Tx) ([]APIKey, error) {
+	keys := []APIKey{}
+	err := tx.Bucket([]byte("apikeys")).ForEach(func(_, v []byte) error {
+		var key APIKey
+		if err := json.Unmarshal(v, &key); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
+}
+
+func createAPIKey(tx *bolt.Tx, query *APIKeyQuery) (*NewAPIKey, error) {
+	keys, err := listAPIKeys(tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.Name == query.Name {
+			return nil, errAPIKeyExists
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	b := tx.Bucket([]byte("apikeys"))
+	id, _ := b.NextSequence()
+	key := &NewAPIKey{
+		Key: hex.EncodeToString(secret),
+		APIKey: APIKey{
+			Id:      strconv.Itoa(int(id)),
+			Name:    query.Name,
+			Project: query.Project,
+			Admin:   query.Admin,
+			Created: time.Now().UTC(),
+		},
+	}
+	buf, err := json.Marshal(key.APIKey)
+	if err != nil {
+		return nil, err
+	}
+	return key, b.Put(hashAPIKey(key.Key), buf)
+}
+
+// revokeAPIKey deletes the key with the given id or name. It reports whether
+// there was one.
+func revokeAPIKey(tx *bolt.Tx, idOrName string) (bool, error) {
+	c := tx.Bucket([]byte("apikeys")).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		var key APIKey
+		if err := json.Unmarshal(v, &key); err != nil {
+			return false, err
+		}
+		if key.Id == idOrName || key.Name == idOrName {
+			return true, c.Delete()
+		}
+	}
+	return false, nil
+}
+
+// authenticate is the middleware that checks API keys.
+func (cs *ChartographerService) authenticate(c *gin.Context) {
+	secret := c.GetHeader(apiKeyHeader)
+	if auth := c.GetHeader("Authorization"); secret == "" && strings.HasPrefix(auth, "Bearer ") {
+		secret = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if secret == "" {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	var key *APIKey
+	err := cs.DB.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("apikeys")).Get(hashAPIKey(secret))
+		if v == nil {
+			return nil
+		}
+		key = &APIKey{}
+		return json.Unmarshal(v, key)
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if key == nil {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.Set(apiKeyContext, key)
+	c.Next()
+}
+
+// requireAdmin is the middleware of the /admin endpoints that only lets admin
+// keys through.
+func requireAdmin(c *gin.Context) {
+	if key := requestAPIKey(c); key != nil && !key.Admin {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	c.Next()
+}
+
+// requestAPIKey returns the key the request was made with, nil without
+// authentication.
+func requestAPIKey(c *gin.Context) *APIKey {
+	key, _ := c.Get(apiKeyContext)
+	apiKey, _ := key.(*APIKey)
+	return apiKey
+}
+
+// requestScope returns the project the request is limited to, empty if it may
+// see every project.
+func requestScope(c *gin.Context) string {
+	if key := requestAPIKey(c); key != nil && !key.Admin {
+		return requestProject(c)
+	}
+	return ""
+}
+
+// inScope reports whether the request may see what belongs to the project.
+func inScope(c *gin.Context, project string) bool {
+	scope := requestScope(c)
+	return scope == "" || scope == project
+}
+
+// authorizeCharta is the middleware of the /chartas/:id endpoints that hides
+// the chartas of other projects, in the trash too, from keys limited to their
+// own project.
+func (cs *ChartographerService) authorizeCharta(c *gin.Context) {
+	if requestScope(c) == "" {
+		c.Next()
+		return
+	}
+
+	var charta *Charta
+	err := cs.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		charta, err = getCharta(tx, c.Param("id"))
+		if err != nil || charta != nil {
+			return err
+		}
+		entry, err := getTrashEntry(tx, c.Param("id"))
+		if entry != nil {
+			charta = &entry.Charta
+		}
+		return err
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if charta != nil && !inScope(c, chartaProject(charta)) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.Next()
+}
+
+// requestCreator returns the identity recorded as the creator of what the
+// request creates, empty without authentication.
+func requestCreator(c *gin.Context) string {
+	if key := requestAPIKey(c); key != nil {
+		return key.Name
+	}
+	return ""
+}
+
+func (cs *ChartographerService) getAPIKeysEndpoint(c *gin.Context) {
+	var keys []APIKey
+	err := cs.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		keys, err = listAPIKeys(tx)
+		return err
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+func (cs *ChartographerService) createAPIKeyEndpoint(c *gin.Context) {
+	var query APIKeyQuery
+	if err := c.BindQuery(&query); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	var key *NewAPIKey
+	err := cs.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+		key, err = createAPIKey(tx, &query)
+		return err
+	})
+	if errors.Is(err, errAPIKeyExists) {
+		c.AbortWithStatus(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusCreated, key)
+}
+
+func (cs *ChartographerService) revokeAPIKeyEndpoint(c *gin.Context) {
+	found := false
+	err := cs.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+		found, err = revokeAPIKey(tx, c.Param("id"))
+		return err
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// apiKeyCommand runs "chartographer apikey create|revoke|list ..." and returns
+// the exit code. Like fsck it needs the service to be stopped; the first
+// admin key has to be created this way.
+func apiKeyCommand(cs *ChartographerService, args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("apikey", flag.ContinueOnError)
+	project := flags.String("project", "", "project of the chartas created with the key")
+	admin := flags.Bool("admin", false, "allow the /admin endpoints and choosing the project")
+	usage := func() int {
+		fmt.Fprintln(flags.Output(), "usage: chartographer apikey create [-project project] [-admin] path name")
+		fmt.Fprintln(flags.Output(), "       chartographer apikey revoke path (id | name)")
+		fmt.Fprintln(flags.Output(), "       chartographer apikey list path")
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+	command := args[0]
+	if err := flags.Parse(args[1:]); err != nil {
+		return usage()
+	}
+
+	var run func(tx *bolt.Tx) (interface{}, error)
+	switch {
+	case command == "create" && flags.NArg() == 2:
+		query := &APIKeyQuery{Name: flags.Arg(1), Project: *project, Admin: *admin}
+		run = func(tx *bolt.Tx) (interface{}, error) {
+			return createAPIKey(tx, query)
+		}
+	case command == "revoke" && flags.NArg() == 2 && flags.NFlag() == 0:
+		run = func(tx *bolt.Tx) (interface{}, error) {
+			found, err := revokeAPIKey(tx, flags.Arg(1))
+			if err == nil && !found {
+				err = fmt.Errorf("no api key %s", flags.Arg(1))
+			}
+			return nil, err
+		}
+	case command == "list" && flags.NArg() == 1 && flags.NFlag() == 0:
+		run = func(tx *bolt.Tx) (interface{}, error) {
+			return listAPIKeys(tx)
+		}
+	default:
+		return usage()
+	}
+
+	if err := cs.initializeStopped(flags.Arg(0), "chartas.db"); err != nil {
+		fmt.Fprintln(flags.Output(), "apikey:", err)
+		return 1
+	}
+	defer cs.DB.Close()
+
+	var result interface{}
+	err := cs.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+		result, err = run(tx)
+		return err
+	})
+	if err != nil {
+		fmt.Fprintln(flags.Output(), "apikey:", err)
+		return 1
+	}
+
+	if result != nil {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(result)
+	}
+	return 0
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A backup is a tar archive with a manifest, snapshots of the databases and
+// the image files of chartas, fragments and tiles. Job results are not
+// included.
+
+const (
+	backupVersion  = 1
+	backupManifest = "backup.json"
+)
+
+var (
+	errBackupUnsupported = errors.New("backup is not supported for s3 storage")
+	errSnapshotTaken     = errors.New("snapshot taken")
+)
+
+type BackupManifest struct {
+	Version  int       `json:"version"`
+	Created  time.Time `json:"created"`
+	Storage  string    `json:"storage"`
+	Database string    `json:"database"`
+}
+
+// backupSnapshot holds read transactions on the databases and links to the
+// files that match them.
+type backupSnapshot struct {
+	dir   string
+	txs   []*bolt.Tx
+	files []string
+}
+
+func (s *backupSnapshot) Close() error {
+	for _, tx := range s.txs {
+		_ = tx.Rollback()
+	}
+	return os.RemoveAll(s.dir)
+}
+
+// snapshot takes a consistent snapshot of the storage. Images are only
+// written inside update transactions, so while the write lock is held they
+// match the last committed state, which read transactions started then see.
+// Files are hard linked, since they are replaced rather than modified, except
+// the raw files of mmapStore, which have to be copied.
+func (cs *ChartographerService) snapshot() (*backupSnapshot, error) {
+	if _, ok := cs.store.(*s3Store); ok {
+		return nil, errBackupUnsupported
+	}
+
+	base := filepath.Join(cs.pathName, "snapshots")
+	err := os.MkdirAll(base, 0755)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(base, "snapshot")
+	if err != nil {
+		return nil, err
+	}
+	snap := &backupSnapshot{dir: dir}
+
+	err = cs.DB.Update(func(*bolt.Tx) error {
+		// The update is rolled back, so it never remaps the database and
+		// can't wait for the read transaction.
+		tx, err := cs.DB.Begin(false)
+		if err != nil {
+			return err
+		}
+		snap.txs = append(snap.txs, tx)
+		if ts, ok := cs.store.(*tileStore); ok {
+			tx, err = ts.db.Begin(false)
+			if err != nil {
+				return err
+			}
+			snap.txs = append(snap.txs, tx)
+		}
+
+		for _, sub := range []string{"chartas", "fragments", "tiles"} {
+			err = filepath.WalkDir(filepath.Join(cs.pathName, sub), func(file string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() || strings.HasSuffix(file, ".tmp") {
+					return nil
+				}
+
+				rel, err := filepath.Rel(cs.pathName, file)
+				if err != nil {
+					return err
+				}
+				dst := filepath.Join(dir, rel)
+				if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+					return err
+				}
+				if strings.HasSuffix(file, ".raw") {
+					err = copyFile(file, dst)
+				} else {
+					err = linkFile(file, dst)
+				}
+				if os.IsNotExist(err) {
+					// Removed by the tile garbage collector.
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				snap.files = append(snap.files, rel)
+				return nil
+			})
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return errSnapshotTaken
+	})
+	if !errors.Is(err, errSnapshotTaken) {
+		_ = snap.Close()
+		return nil, err
+	}
+	return snap, nil
+}
+
+func (cs *ChartographerService) writeBackup(w io.Writer, snap *backupSnapshot) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	manifest, err := json.Marshal(BackupManifest{
+		Version:  backupVersion,
+		Created:  now.UTC(),
+		Storage:  cs.Storage,
+		Database: filepath.Base(cs.DB.Path()),
+	})
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: backupManifest, Mode: 0644, Size: int64(len(manifest)), ModTime: now})
+	if err != nil {
+		return err
+	}
+	if _, err = tw.Write(manifest); err != nil {
+		return err
+	}
+
+	for _, tx := range snap.txs {
+		err = tw.WriteHeader(&tar.Header{Name: filepath.Base(tx.DB().Path()), Mode: 0600, Size: tx.Size(), ModTime: now})
+		if err != nil {
+			return err
+		}
+		if _, err = tx.WriteTo(tw); err != nil {
+			return err
+		}
+	}
+
+	for _, rel := range snap.files {
+		if err = writeTarFile(tw, filepath.Join(snap.dir, rel), filepath.ToSlash(rel)); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, filename, name string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// restoreBackup unpacks a backup into an empty directory and checks the
+// databases. Nothing is left in the directory if it fails.
+func restoreBackup(r io.Reader, dir string) (manifest *BackupManifest, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		return nil, fmt.Errorf("%s is not empty", dir)
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = clearDirectory(dir)
+		}
+	}()
+
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	if hdr.Name != backupManifest {
+		return nil, errors.New("not a backup: no manifest")
+	}
+	manifest = &BackupManifest{}
+	if err = json.NewDecoder(tr).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	if manifest.Version != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+
+	var databases []string
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%s: unexpected entry type", hdr.Name)
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("%s: path outside of the backup", hdr.Name)
+		}
+		if !strings.Contains(name, "/") {
+			databases = append(databases, name)
+		}
+
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return nil, err
+		}
+		err = replaceFile(filename, func(w io.Writer) error {
+			_, err := io.Copy(w, tr)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = os.Chtimes(filename, hdr.ModTime, hdr.ModTime); err != nil {
+			return nil, err
+		}
+	}
+
+	found := false
+	for _, name := range databases {
+		found = found || name == manifest.Database
+		if err = checkDatabase(filepath.Join(dir, name)); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("database %s is missing", manifest.Database)
+	}
+	return manifest, nil
+}
+
+func checkDatabase(filename string) error {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		var first error
+		for err := range tx.Check() {
+			if first == nil {
+				first = err
+			}
+		}
+		return first
+	})
+}
+
+// clearDirectory removes the contents of dir.
+func clearDirectory(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupEndpoint streams a backup of the running service.
+func (cs *ChartographerService) backupEndpoint(c *gin.Context) {
+	snap, err := cs.snapshot()
+	if errors.Is(err, errBackupUnsupported) {
+		c.AbortWithStatus(http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer snap.Close()
+
+	name := fmt.Sprintf("chartographer-%s.tar", time.Now().UTC().Format("20060102T150405"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	c.Header("Content-Type", "application/x-tar")
+	c.Status(http.StatusOK)
+	if err = cs.writeBackup(c.Writer, snap); err != nil {
+		abortResponse("backup", err)
+	}
+}
+
+// backupCommand runs "chartographer backup source archive". The source is
+// either the address of a running service or the data directory of a stopped
+// one. The archive "-" is the standard output. A service with authentication
+// needs an admin key, given with -key or in CHARTOGRAPHER_API_KEY.
+func backupCommand(cs *ChartographerService, args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	key := flags.String("key", "", "API key for a running service (default $CHARTOGRAPHER_API_KEY)")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: chartographer backup [-key key] (http://host:port | path) archive")
+		return 2
+	}
+	source, archive := flags.Arg(0), flags.Arg(1)
+	if *key == "" {
+		*key = os.Getenv("CHARTOGRAPHER_API_KEY")
+	}
+
+	write := func(w io.Writer) error {
+		if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+			req, err := http.NewRequest("GET", strings.TrimSuffix(source, "/")+"/admin/backup", nil)
+			if err != nil {
+				return err
+			}
+			if *key != "" {
+				req.Header.Set("Authorization", "Bearer "+*key)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("%s: %s", source, resp.Status)
+			}
+			_, err = io.Copy(w, resp.Body)
+			return err
+		}
+
+		if err := cs.initializeStopped(source, "chartas.db"); err != nil {
+			return err
+		}
+		defer cs.DB.Close()
+		snap, err := cs.snapshot()
+		if err != nil {
+			return err
+		}
+		defer snap.Close()
+		return cs.writeBackup(w, snap)
+	}
+
+	var err error
+	if archive == "-" {
+		err = write(out)
+	} else {
+		err = replaceFile(archive, write)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "backup:", err)
+		return 1
+	}
+	return 0
+}
+
+// restoreCommand runs "chartographer restore archive path". Besides the
+// checks of restoreBackup, the restored chartas are checked with fsck where
+// the storage supports it.
+func restoreCommand(cs *ChartographerService, args []string, in io.Reader) int {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: chartographer restore archive path")
+		return 2
+	}
+	archive, dir := args[0], args[1]
+
+	err := func() error {
+		r := in
+		if archive != "-" {
+			file, err := os.Open(archive)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			r = file
+		}
+
+		manifest, err := restoreBackup(r, dir)
+		if err != nil {
+			return err
+		}
+
+		cs.Storage = manifest.Storage
+		cs.CompactInterval = -1
+		cs.SweepInterval = -1
+		cs.Initialize(dir, manifest.Database)
+		defer cs.DB.Close()
+		if _, ok := cs.store.(checkedStore); !ok {
+			return nil
+		}
+		result, err := cs.fsck(context.Background(), FsckReport, func(float64) {})
+		if err == nil && len(result.Problems) > 0 {
+			err = fmt.Errorf("%d problems found, first: %s %s", len(result.Problems), result.Problems[0].Id, result.Problems[0].Problem)
+		}
+		if err != nil {
+			_ = cs.DB.Close()
+			_ = clearDirectory(dir)
+		}
+		return err
+	}()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "restore:", err)
+		return 1
+	}
+	return 0
+}
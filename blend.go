@@ -0,0 +1,119 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+const (
+	modeReplace      = "replace"
+	modeOver         = "over"
+	modeAverage      = "average"
+	modeMax          = "max"
+	modeMin          = "min"
+	modeKeepExisting = "keep-existing"
+)
+
+// blendFragment works like draw.Draw, but combines src with the pixels already
+// restored in dst according to mode. A pixel of dst with zero alpha has not been
+// restored yet, so every mode simply fills it with the new fragment.
+func blendFragment(dst *image.NRGBA, r image.Rectangle, src *image.NRGBA, sp image.Point, mode string) {
+	blendFragmentWeighted(dst, r, src, sp, mode, nil)
+}
+
+// blendFragmentWeighted is blendFragment where the blended pixel is mixed
+// with the restored one with the given weight of the blended pixel.
+func blendFragmentWeighted(dst *image.NRGBA, r image.Rectangle, src *image.NRGBA, sp image.Point, mode string, weight func(x, y int) float64) {
+	r, sp = clipPlacement(dst, r, src, sp)
+	if r.Empty() {
+		return
+	}
+
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			s := src.NRGBAAt(sp.X+x-r.Min.X, sp.Y+y-r.Min.Y)
+			if s.A == 0 {
+				continue
+			}
+
+			d := dst.NRGBAAt(x, y)
+			if d.A == 0 {
+				dst.SetNRGBA(x, y, s)
+				continue
+			}
+
+			p := blendPixel(d, s, mode)
+			if weight != nil {
+				p = mixPixel(d, p, weight(x, y))
+			}
+			dst.SetNRGBA(x, y, p)
+		}
+	}
+}
+
+func blendPixel(d, s color.NRGBA, mode string) color.NRGBA {
+	switch mode {
+	case modeOver:
+		return overPixel(d, s)
+	case modeAverage:
+		return color.NRGBA{
+			R: uint8((int(d.R) + int(s.R)) / 2),
+			G: uint8((int(d.G) + int(s.G)) / 2),
+			B: uint8((int(d.B) + int(s.B)) / 2),
+			A: maxUint8(d.A, s.A),
+		}
+	case modeMax:
+		return color.NRGBA{R: maxUint8(d.R, s.R), G: maxUint8(d.G, s.G), B: maxUint8(d.B, s.B), A: maxUint8(d.A, s.A)}
+	case modeMin:
+		return color.NRGBA{R: minUint8(d.R, s.R), G: minUint8(d.G, s.G), B: minUint8(d.B, s.B), A: maxUint8(d.A, s.A)}
+	case modeKeepExisting:
+		return d
+	default:
+		if s.A < 255 {
+			return overPixel(d, s)
+		}
+		return s
+	}
+}
+
+// clipPlacement clips r to the bounds of dst and src the same way draw.Draw
+// does and moves sp accordingly.
+func clipPlacement(dst *image.NRGBA, r image.Rectangle, src *image.NRGBA, sp image.Point) (image.Rectangle, image.Point) {
+	origin := r.Min
+	r = r.Intersect(dst.Bounds())
+	r = r.Intersect(src.Bounds().Add(origin.Sub(sp)))
+	return r, sp.Add(r.Min.Sub(origin))
+}
+
+func overPixel(d, s color.NRGBA) color.NRGBA {
+	sa, da := int(s.A), int(d.A)
+	oa := sa*255 + da*(255-sa)
+	if oa == 0 {
+		return color.NRGBA{}
+	}
+
+	channel := func(sc, dc uint8) uint8 {
+		return uint8((int(sc)*sa*255 + int(dc)*da*(255-sa)) / oa)
+	}
+
+	return color.NRGBA{
+		R: channel(s.R, d.R),
+		G: channel(s.G, d.G),
+		B: channel(s.B, d.B),
+		A: uint8(oa / 255),
+	}
+}
+
+func maxUint8(a, b uint8) uint8 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minUint8(a, b uint8) uint8 {
+	if a < b {
+		return a
+	}
+	return b
+}
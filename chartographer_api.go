@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/disintegration/imaging"
 	"github.com/gin-gonic/gin"
@@ -9,30 +10,59 @@ import (
 	"golang.org/x/image/bmp"
 	"image"
 	"image/draw"
-	"image/png"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 )
 
 type ChartographerService struct {
-	Router   *gin.Engine
-	DB       *bolt.DB
-	pathName string
+	Router          *gin.Engine
+	DB              *bolt.DB
+	JobWorkers      int
+	JobRetention    time.Duration
+	CompactInterval time.Duration
+	SweepInterval   time.Duration
+	CompactIdle     time.Duration
+	CompactLevel    int
+	Storage         string
+	S3              S3Config
+	TileSize        int
+	TrashRetention  time.Duration
+	Quota           Quota
+	Auth            bool
+	pathName        string
+	store           chartaStore
+	jobs            *jobQueue
 }
 
 type Charta struct {
-	Width  int `form:"width" binding:"required,gte=1,lte=20000"`
-	Height int `form:"height" binding:"required,gte=1,lte=50000"`
-	Id     string
+	Width   int `form:"width" binding:"required,gte=1,lte=20000"`
+	Height  int `form:"height" binding:"required,gte=1,lte=50000"`
+	Id      string
+	Expires *time.Time `form:"-" json:",omitempty"`
+	Project string     `form:"-" json:",omitempty"`
+	Creator string     `form:"-" json:",omitempty"`
+	// Generation is the version of the stored pixels for the stores that
+	// resize a charta next to its old version.
+	Generation int `form:"-" json:",omitempty"`
 }
 
 type Fragment struct {
-	Width  int  `form:"width" binding:"required,gte=1,lte=5000"`
-	Height int  `form:"height" binding:"required,gte=1,lte=5000"`
-	X      *int `form:"x" binding:"required"`
-	Y      *int `form:"y" binding:"required"`
+	Width    int     `form:"width" binding:"required,gte=1,lte=5000"`
+	Height   int     `form:"height" binding:"required,gte=1,lte=5000"`
+	X        *int    `form:"x" binding:"required"`
+	Y        *int    `form:"y" binding:"required"`
+	Mode     string  `form:"mode" binding:"omitempty,oneof=replace over average max min keep-existing"`
+	Report   bool    `form:"report"`
+	Strict   bool    `form:"strict"`
+	Angle    float64 `form:"angle"`
+	Scale    float64 `form:"scale" binding:"omitempty,gt=0,lte=10"`
+	Matrix   string  `form:"matrix"`
+	Filter   string  `form:"filter" binding:"omitempty,oneof=bilinear bicubic"`
+	Feather  int     `form:"feather" binding:"omitempty,gte=0,lte=500"`
+	Exposure bool    `form:"exposure"`
 }
 
 func (cs *ChartographerService) Run(addr string) {
@@ -42,17 +72,23 @@ func (cs *ChartographerService) Run(addr string) {
 func (cs *ChartographerService) Initialize(path, dbName string) {
 	var err error
 	cs.pathName = path
-	db := fmt.Sprintf("%s/%s", path, dbName)
-	cs.DB, err = bolt.Open(db, 0600, nil)
-	if err != nil {
-		log.Fatal(err)
+	if cs.DB == nil {
+		cs.DB, err = bolt.Open(fmt.Sprintf("%s/%s", path, dbName), 0600, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 	_ = os.Mkdir(cs.pathName+"/chartas", 0644)
+	_ = os.Mkdir(cs.pathName+"/jobs", 0755)
+	// Snapshots are only left behind by backups that were interrupted.
+	_ = os.RemoveAll(cs.pathName + "/snapshots")
 
 	err = cs.DB.Update(func(tx *bolt.Tx) error {
-		_, err = tx.CreateBucketIfNotExists([]byte("chartas"))
-		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
+		for _, name := range []string{"chartas", "fragments", "fragment-index", "jobs", "compaction", "trash", "quotas", "apikeys"} {
+			_, err = tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return fmt.Errorf("create bucket: %s", err)
+			}
 		}
 		return nil
 	})
@@ -60,47 +96,138 @@ func (cs *ChartographerService) Initialize(path, dbName string) {
 		panic(err)
 	}
 
-	cs.Router = gin.Default()
+	cs.store, err = cs.openStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = cs.countUsage()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = cs.startJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cs.startCompactor()
+	cs.startSweeper()
+
+	cs.Router = gin.New()
+	cs.Router.Use(gin.Logger(), gin.CustomRecovery(recoverRequest))
+	if cs.Auth {
+		cs.Router.Use(cs.authenticate)
+	}
 	cs.initEndpoints()
 }
 
+// stoppedTimeout is how long the commands that need the service to be
+// stopped wait for the lock of its database.
+const stoppedTimeout = time.Second
+
+// initializeStopped initializes the service for a command that needs it to be
+// stopped. bbolt waits for the lock of the database forever, so the command
+// fails instead if the running service doesn't release it shortly.
+func (cs *ChartographerService) initializeStopped(path, dbName string) error {
+	db, err := bolt.Open(fmt.Sprintf("%s/%s", path, dbName), 0600, &bolt.Options{Timeout: stoppedTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return fmt.Errorf("%s is in use, the service must be stopped", dbName)
+	}
+	if err != nil {
+		return err
+	}
+
+	cs.DB = db
+	cs.CompactInterval = -1
+	cs.SweepInterval = -1
+	cs.Initialize(path, dbName)
+	return nil
+}
+
 func (cs *ChartographerService) initEndpoints() {
 	cs.Router.POST("/chartas/", cs.createChartaEndpoint)
-	cs.Router.POST("/chartas/:id/", cs.addFragmentEndpoint)
-	cs.Router.GET("/chartas/:id/", cs.getFragmentEndpoint)
-	cs.Router.DELETE("/chartas/:id/", cs.deleteChartaEndpoint)
+	cs.Router.POST("/chartas/import", cs.importArchiveEndpoint)
+	charta := cs.Router.Group("/chartas/:id", cs.authorizeCharta)
+	charta.POST("/", cs.addFragmentEndpoint)
+	charta.GET("/", cs.getFragmentEndpoint)
+	charta.PATCH("/", cs.resizeChartaEndpoint)
+	charta.DELETE("/", cs.deleteChartaEndpoint)
+	charta.POST("/register", cs.registerFragmentEndpoint)
+	charta.POST("/restore", cs.restoreChartaEndpoint)
+	charta.POST("/clone", cs.cloneChartaEndpoint)
+	charta.POST("/merge", cs.mergeChartaEndpoint)
+	charta.GET("/meta", cs.getChartaMetaEndpoint)
+	charta.GET("/fragments", cs.getFragmentsEndpoint)
+	charta.PATCH("/fragments/:fid", cs.reorderFragmentEndpoint)
+	charta.DELETE("/fragments/:fid", cs.deleteFragmentEndpoint)
+	charta.GET("/provenance", cs.getProvenanceEndpoint)
+	charta.GET("/export", cs.exportChartaEndpoint)
+	charta.POST("/export", cs.exportChartaJobEndpoint)
+	charta.GET("/archive", cs.getArchiveEndpoint)
+	cs.Router.GET("/trash", cs.getTrashEndpoint)
+	cs.Router.GET("/usage", cs.usageEndpoint)
+	cs.Router.GET("/jobs/:id", cs.getJobEndpoint)
+	cs.Router.DELETE("/jobs/:id", cs.deleteJobEndpoint)
+	cs.Router.GET("/jobs/:id/result", cs.getJobResultEndpoint)
+	admin := cs.Router.Group("/admin", requireAdmin)
+	admin.GET("/storage", cs.getStorageStatsEndpoint)
+	admin.POST("/compact", cs.compactEndpoint)
+	admin.POST("/gc", cs.gcEndpoint)
+	admin.POST("/fsck", cs.fsckEndpoint)
+	admin.GET("/backup", cs.backupEndpoint)
+	admin.POST("/purge", cs.purgeEndpoint)
+	admin.GET("/quotas/:project", cs.getQuotaEndpoint)
+	admin.PUT("/quotas/:project", cs.putQuotaEndpoint)
+	admin.DELETE("/quotas/:project", cs.deleteQuotaEndpoint)
+	admin.GET("/apikeys", cs.getAPIKeysEndpoint)
+	admin.POST("/apikeys", cs.createAPIKeyEndpoint)
+	admin.DELETE("/apikeys/:id", cs.revokeAPIKeyEndpoint)
 }
 
 func (cs *ChartographerService) createChartaEndpoint(c *gin.Context) {
+	upload, err := isImport(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if upload {
+		cs.importCharta(c, c.Request.Body)
+		return
+	}
+
 	var newCharta Charta
 	if err := c.BindQuery(&newCharta); err != nil {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
+	var expiry ChartaExpiry
+	if err := c.BindQuery(&expiry); err != nil || !expiry.valid(time.Now()) || expiry.Persist {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	expiry.apply(&newCharta, time.Now())
+	newCharta.Project = requestProject(c)
+	newCharta.Creator = requestCreator(c)
 
-	err := cs.DB.Update(func(tx *bolt.Tx) error {
+	err = cs.DB.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("chartas"))
 
+		err := cs.checkQuota(tx, newCharta.Project, 1, int64(newCharta.Width)*int64(newCharta.Height))
+		if err != nil {
+			return err
+		}
+
 		id, _ := b.NextSequence()
 		newCharta.Id = strconv.Itoa(int(id))
 
-		chartaImg := createBlackImage(newCharta.Width, newCharta.Height)
-		filename := fmt.Sprintf("%s/chartas/%s.png", cs.pathName, newCharta.Id)
-		file, err := os.Create(filename)
+		err = cs.store.Create(&newCharta)
 		if err != nil {
 			return err
 		}
-
-		enc := &png.Encoder{
-			CompressionLevel: png.NoCompression,
-		}
-		err = enc.Encode(file, &chartaImg)
+		err = cs.accountCharta(tx, &newCharta, 0)
 		if err != nil {
 			return err
 		}
 
-		_ = file.Close()
-
 		buf, err := json.Marshal(newCharta)
 		if err != nil {
 			return err
@@ -110,7 +237,7 @@ func (cs *ChartographerService) createChartaEndpoint(c *gin.Context) {
 		return b.Put([]byte(newCharta.Id), buf)
 	})
 	if err != nil {
-		c.AbortWithStatus(http.StatusInternalServerError)
+		c.AbortWithStatus(quotaStatus(err))
 	}
 
 }
@@ -122,9 +249,50 @@ func (cs *ChartographerService) addFragmentEndpoint(c *gin.Context) {
 		return
 	}
 
+	if !cs.chartaExists(c) {
+		return
+	}
+
+	fragmentImg, err := bmp.Decode(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	report, ok := cs.addFragment(c, &fragment, fragmentImg)
+	if ok && fragment.Report {
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+// chartaExists aborts c with 404 if the charta from the request path doesn't
+// exist, so it is reported before the body is read.
+func (cs *ChartographerService) chartaExists(c *gin.Context) bool {
+	var charta *Charta
+	err := cs.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		charta, err = getCharta(tx, c.Param("id"))
+		return err
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+	if charta == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// addFragment draws fragmentImg into the charta from the request path. If the
+// fragment can't be placed, c is aborted with the matching status and false is
+// returned.
+func (cs *ChartographerService) addFragment(c *gin.Context, fragment *Fragment, fragmentImg image.Image) (ConflictReport, bool) {
 	x, y := *fragment.X, *fragment.Y
+	var report ConflictReport
 
-	err := cs.DB.Update(func(tx *bolt.Tx) error {
+	err := cs.updateFragments(func(tx *bolt.Tx, images *fragmentImages) error {
 		b := tx.Bucket([]byte("chartas"))
 
 		v := b.Get([]byte(c.Param("id")))
@@ -138,28 +306,22 @@ func (cs *ChartographerService) addFragmentEndpoint(c *gin.Context) {
 		if err != nil {
 			return err
 		}
-
-		filename := fmt.Sprintf("%s/chartas/%s.png", cs.pathName, charta.Id)
-		chartaImgPng, err := os.OpenFile(filename, os.O_RDWR, 0644)
+		err = cs.checkQuota(tx, chartaProject(&charta), 0, 0)
 		if err != nil {
 			return err
 		}
-		chartaImgRaw, err := png.Decode(chartaImgPng)
-		if err != nil {
-			return err
-		}
-		_ = chartaImgPng.Close()
-
-		fragmentImg, err := bmp.Decode(c.Request.Body)
-		if err != nil {
-			return err
-		}
-		chartaImg := image.NewNRGBA(image.Rect(0, 0, charta.Width, charta.Height))
-		draw.Draw(chartaImg, image.Rect(0, 0, charta.Width, charta.Height), chartaImgRaw, image.Point{}, draw.Over)
 
 		var fragmentOfFragmentImg *image.NRGBA
+		var placement image.Rectangle
 
 		switch {
+		case fragment.isTransformed():
+			fragmentOfFragmentImg, placement, err = transformFragment(fragmentImg, fragment)
+			if err != nil || placement.Intersect(image.Rect(0, 0, charta.Width, charta.Height)).Empty() {
+				c.AbortWithStatus(http.StatusBadRequest)
+				return nil
+			}
+
 		case x < 0 && y < 0:
 			//case 1
 			if fragment.Width <= -x || fragment.Width <= -y {
@@ -170,10 +332,10 @@ func (cs *ChartographerService) addFragmentEndpoint(c *gin.Context) {
 			//case 24
 			if fragment.Width-x >= charta.Width && fragment.Height-y >= charta.Height {
 				fragmentOfFragmentImg = imaging.Crop(fragmentImg, image.Rect(-x, -y, charta.Width-x, charta.Height-x))
-				draw.Draw(chartaImg, image.Rectangle{
+				placement = image.Rectangle{
 					Min: image.Point{X: 0, Y: 0},
 					Max: image.Point{X: charta.Width, Y: charta.Height},
-				}, fragmentOfFragmentImg, image.Point{}, draw.Over)
+				}
 				break
 			}
 
@@ -181,27 +343,27 @@ func (cs *ChartographerService) addFragmentEndpoint(c *gin.Context) {
 				if fragment.Width-x > charta.Width {
 					//case 11
 					fragmentOfFragmentImg = imaging.Crop(fragmentImg, image.Rect(-x, -y, charta.Width-x, fragment.Height))
-					draw.Draw(chartaImg, image.Rectangle{
+					placement = image.Rectangle{
 						Min: image.Point{X: 0, Y: 0},
 						Max: image.Point{X: charta.Width, Y: fragment.Height + y},
-					}, fragmentOfFragmentImg, image.Point{}, draw.Over)
+					}
 					break
 				} else {
 					//case 9
 					fragmentOfFragmentImg = imaging.Crop(fragmentImg, image.Rect(-x, -y, fragment.Width, fragment.Height))
-					draw.Draw(chartaImg, image.Rectangle{
+					placement = image.Rectangle{
 						Min: image.Point{X: 0, Y: 0},
 						Max: image.Point{X: fragment.Width + x, Y: fragment.Height + y},
-					}, fragmentOfFragmentImg, image.Point{}, draw.Over)
+					}
 					break
 				}
 			} else {
 				//case 10
 				fragmentOfFragmentImg = imaging.Crop(fragmentImg, image.Rect(-x, -y, fragment.Width, fragment.Height-y))
-				draw.Draw(chartaImg, image.Rectangle{
+				placement = image.Rectangle{
 					Min: image.Point{X: 0, Y: 0},
 					Max: image.Point{X: fragment.Width + x, Y: fragment.Height},
-				}, fragmentOfFragmentImg, image.Point{}, draw.Over)
+				}
 				break
 			}
 
@@ -216,27 +378,27 @@ func (cs *ChartographerService) addFragmentEndpoint(c *gin.Context) {
 				if x+fragment.Width > charta.Width {
 					//case 13
 					fragmentOfFragmentImg = imaging.Crop(fragmentImg, image.Rect(0, -y, charta.Width-x, fragment.Height))
-					draw.Draw(chartaImg, image.Rectangle{
+					placement = image.Rectangle{
 						Min: image.Point{X: x, Y: 0},
 						Max: image.Point{X: charta.Width, Y: fragment.Height + y},
-					}, fragmentOfFragmentImg, image.Point{}, draw.Over)
+					}
 					break
 				} else {
 					//case 12
 					fragmentOfFragmentImg = imaging.Crop(fragmentImg, image.Rect(0, -y, fragment.Width, fragment.Height))
-					draw.Draw(chartaImg, image.Rectangle{
+					placement = image.Rectangle{
 						Min: image.Point{X: x, Y: 0},
 						Max: image.Point{X: fragment.Width + x, Y: fragment.Height + y},
-					}, fragmentOfFragmentImg, image.Point{}, draw.Over)
+					}
 					break
 				}
 			} else {
 				//case 14 and 15
 				fragmentOfFragmentImg = imaging.Crop(fragmentImg, image.Rect(0, -y, fragment.Width, charta.Height-y))
-				draw.Draw(chartaImg, image.Rectangle{
+				placement = image.Rectangle{
 					Min: image.Point{X: x, Y: 0},
 					Max: image.Point{X: charta.Width, Y: charta.Height},
-				}, fragmentOfFragmentImg, image.Point{}, draw.Over)
+				}
 				break
 			}
 
@@ -251,27 +413,27 @@ func (cs *ChartographerService) addFragmentEndpoint(c *gin.Context) {
 				if fragment.Height+y >= charta.Height {
 					//case 17
 					fragmentOfFragmentImg = imaging.Crop(fragmentImg, image.Rect(-x, 0, fragment.Width, charta.Height-y))
-					draw.Draw(chartaImg, image.Rectangle{
+					placement = image.Rectangle{
 						Min: image.Point{X: 0, Y: y},
 						Max: image.Point{X: fragment.Width + x, Y: charta.Height},
-					}, fragmentOfFragmentImg, image.Point{}, draw.Over)
+					}
 					break
 				} else {
 					//case 16
 					fragmentOfFragmentImg = imaging.Crop(fragmentImg, image.Rect(-x, 0, fragment.Width, fragment.Height))
-					draw.Draw(chartaImg, image.Rectangle{
+					placement = image.Rectangle{
 						Min: image.Point{X: 0, Y: y},
 						Max: image.Point{X: fragment.Width + x, Y: fragment.Height + y},
-					}, fragmentOfFragmentImg, image.Point{}, draw.Over)
+					}
 					break
 				}
 			} else {
 				//case 18 and 19
 				fragmentOfFragmentImg = imaging.Crop(fragmentImg, image.Rect(-x, 0, charta.Width-x, charta.Height-y))
-				draw.Draw(chartaImg, image.Rectangle{
+				placement = image.Rectangle{
 					Min: image.Point{X: 0, Y: y},
 					Max: image.Point{X: charta.Width, Y: charta.Height},
-				}, fragmentOfFragmentImg, image.Point{}, draw.Over)
+				}
 				break
 			}
 
@@ -285,58 +447,107 @@ func (cs *ChartographerService) addFragmentEndpoint(c *gin.Context) {
 			//case 20
 			if fragment.Width+x <= charta.Width && fragment.Height+y <= charta.Height {
 				fragmentOfFragmentImg = imaging.Crop(fragmentImg, image.Rect(0, 0, fragment.Width, fragment.Height))
-				draw.Draw(chartaImg, image.Rectangle{
+				placement = image.Rectangle{
 					Min: image.Point{X: x, Y: y},
 					Max: image.Point{X: fragment.Width + x, Y: fragment.Height + y},
-				}, fragmentOfFragmentImg, image.Point{}, draw.Over)
+				}
 				break
 			} else {
 				if fragment.Width+x >= charta.Width && fragment.Height+y >= charta.Height {
 					//case 23
 					fragmentOfFragmentImg = imaging.Crop(fragmentImg, image.Rect(0, 0, charta.Width-x, charta.Height-y))
-					draw.Draw(chartaImg, image.Rectangle{
+					placement = image.Rectangle{
 						Min: image.Point{X: x, Y: y},
 						Max: image.Point{X: charta.Width, Y: charta.Height},
-					}, fragmentOfFragmentImg, image.Point{}, draw.Over)
+					}
 					break
 				} else {
 					if fragment.Width+x >= charta.Width {
 						//case 21
 						fragmentOfFragmentImg = imaging.Crop(fragmentImg, image.Rect(0, 0, charta.Width-x, fragment.Height))
-						draw.Draw(chartaImg, image.Rectangle{
+						placement = image.Rectangle{
 							Min: image.Point{X: x, Y: y},
 							Max: image.Point{X: charta.Width, Y: fragment.Height + y},
-						}, fragmentOfFragmentImg, image.Point{}, draw.Over)
+						}
 						break
 					} else {
 						//case 22
 						fragmentOfFragmentImg = imaging.Crop(fragmentImg, image.Rect(0, 0, fragment.Width, charta.Height-y))
-						draw.Draw(chartaImg, image.Rectangle{
+						placement = image.Rectangle{
 							Min: image.Point{X: x, Y: y},
 							Max: image.Point{X: fragment.Width + y, Y: charta.Height},
-						}, fragmentOfFragmentImg, image.Point{}, draw.Over)
+						}
 						break
 					}
 				}
 			}
 		}
 
-		enc := &png.Encoder{
-			CompressionLevel: png.NoCompression,
+		chartaImg, err := cs.store.Read(&charta, placement)
+		if err != nil {
+			return err
 		}
-		chartaImgPng, err = os.OpenFile(filename, os.O_RDWR, 0644)
-		err = enc.Encode(chartaImgPng, chartaImg)
+
+		if fragment.Report || fragment.Strict {
+			report = findConflicts(chartaImg, placement, fragmentOfFragmentImg, image.Point{})
+			if fragment.Strict && report.DifferingPixels > 0 {
+				c.AbortWithStatusJSON(http.StatusConflict, report)
+				return nil
+			}
+		}
+
+		if fragment.Exposure {
+			fragmentOfFragmentImg = compensateExposure(chartaImg, placement, fragmentOfFragmentImg, image.Point{})
+		}
+
+		if fragment.Feather > 0 {
+			full := image.Rect(x, y, x+fragment.Width, y+fragment.Height)
+			if fragment.isTransformed() {
+				full = placement
+			}
+			featherFragment(chartaImg, placement, fragmentOfFragmentImg, image.Point{}, fragment.Mode, full, fragment.Feather)
+		} else {
+			blendFragment(chartaImg, placement, fragmentOfFragmentImg, image.Point{}, fragment.Mode)
+		}
+
+		err = cs.store.Write(&charta, chartaImg)
 		if err != nil {
 			return err
 		}
-		_ = chartaImgPng.Close()
 
-		return nil
+		affected, sp := clipPlacement(chartaImg, placement, fragmentOfFragmentImg, image.Point{})
+		record := &FragmentRecord{
+			ChartaId:  charta.Id,
+			X:         affected.Min.X,
+			Y:         affected.Min.Y,
+			Width:     affected.Dx(),
+			Height:    affected.Dy(),
+			Mode:      fragment.Mode,
+			Feather:   fragment.Feather,
+			Exposure:  fragment.Exposure,
+			Creator:   requestCreator(c),
+			CreatedAt: time.Now().UTC(),
+		}
+		err = putFragmentRecord(tx, record)
+		if err != nil {
+			return err
+		}
+
+		size, err := images.write(record, fragmentOfFragmentImg.SubImage(image.Rectangle{
+			Min: sp,
+			Max: sp.Add(affected.Size()),
+		}))
+		if err != nil {
+			return err
+		}
+		return cs.accountCharta(tx, &charta, size)
 	})
 	if err != nil {
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
+		c.AbortWithStatus(quotaStatus(err))
+		return report, false
 	}
+
+	return report, !c.IsAborted()
 }
 
 func (cs *ChartographerService) getFragmentEndpoint(c *gin.Context) {
@@ -363,16 +574,10 @@ func (cs *ChartographerService) getFragmentEndpoint(c *gin.Context) {
 			return err
 		}
 
-		filename := fmt.Sprintf("%s/chartas/%s.png", cs.pathName, charta.Id)
-		chartaImgPng, err := os.Open(filename)
-		if err != nil {
-			return err
-		}
-		chartaImg, err := png.Decode(chartaImgPng)
+		chartaImg, err := cs.store.Read(&charta, image.Rect(x, y, x+fragment.Width, y+fragment.Height))
 		if err != nil {
 			return err
 		}
-		_ = chartaImgPng.Close()
 
 		var fragmentOfChartaImg *image.NRGBA
 		var fragmentImgBg image.NRGBA
@@ -552,17 +757,28 @@ func (cs *ChartographerService) getFragmentEndpoint(c *gin.Context) {
 	}
 }
 
+// deleteChartaEndpoint moves the charta to the trash, or deletes it for good
+// with hard=true. A charta that is already in the trash can only be deleted
+// for good.
 func (cs *ChartographerService) deleteChartaEndpoint(c *gin.Context) {
 	id := c.Param("id")
 
+	var query DeleteQuery
+	if err := c.BindQuery(&query); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
 	err := cs.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("chartas"))
-		filename := fmt.Sprintf("%s/chartas/%s.png", cs.pathName, id)
-		err := os.Remove(filename)
-		if err != nil {
+		if query.Hard || cs.TrashRetention < 0 {
+			return cs.purgeCharta(tx, id)
+		}
+
+		charta, err := getCharta(tx, id)
+		if err != nil || charta == nil {
 			return err
 		}
-		return b.Delete([]byte(id))
+		return cs.trashCharta(tx, charta)
 	})
 	if err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
@@ -571,3 +787,136 @@ func (cs *ChartographerService) deleteChartaEndpoint(c *gin.Context) {
 
 	c.Status(http.StatusOK)
 }
+
+func (cs *ChartographerService) resizeCharta(tx *bolt.Tx, images *fragmentImages, charta *Charta, resize *ChartaResize) error {
+	old := *charta
+	offset := resize.offset(charta.Width, charta.Height)
+	err := cs.store.Resize(charta, resize.Width, resize.Height, offset)
+	if err != nil {
+		return err
+	}
+	if store, ok := cs.store.(releasingStore); ok {
+		tx.OnCommit(func() {
+			if err := store.Release(&old); err != nil {
+				log.Println("resize:", err)
+			}
+		})
+	}
+
+	records, err := findFragments(tx, charta.Id, image.Rectangle{})
+	if err != nil {
+		return err
+	}
+	var fragments int64
+	for i := range records {
+		size, err := cs.moveFragment(tx, images, &records[i], offset, image.Rect(0, 0, resize.Width, resize.Height))
+		if err != nil {
+			return err
+		}
+		fragments += size
+	}
+
+	charta.Width, charta.Height = resize.Width, resize.Height
+	return cs.accountCharta(tx, charta, fragments)
+}
+
+type ChartaResize struct {
+	Width  int    `form:"width" binding:"required,gte=1,lte=20000"`
+	Height int    `form:"height" binding:"required,gte=1,lte=50000"`
+	Anchor string `form:"anchor" binding:"omitempty,oneof=top-left top top-right left center right bottom-left bottom bottom-right"`
+	Left   *int   `form:"left"`
+	Top    *int   `form:"top"`
+}
+
+// offset returns the position of the old top left corner on the resized
+// canvas. The anchor keeps the matching side or center in place, explicit
+// left and top paddings take precedence over it.
+func (r *ChartaResize) offset(width, height int) image.Point {
+	var p image.Point
+
+	switch r.Anchor {
+	case "top", "center", "bottom":
+		p.X = (r.Width - width) / 2
+	case "top-right", "right", "bottom-right":
+		p.X = r.Width - width
+	}
+	switch r.Anchor {
+	case "left", "center", "right":
+		p.Y = (r.Height - height) / 2
+	case "bottom-left", "bottom", "bottom-right":
+		p.Y = r.Height - height
+	}
+
+	if r.Left != nil {
+		p.X = *r.Left
+	}
+	if r.Top != nil {
+		p.Y = *r.Top
+	}
+	return p
+}
+
+// resizeChartaEndpoint resizes the charta and changes its expiry. Either may be
+// left out, but not both.
+func (cs *ChartographerService) resizeChartaEndpoint(c *gin.Context) {
+	var expiry ChartaExpiry
+	if err := c.BindQuery(&expiry); err != nil || !expiry.valid(time.Now()) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	var resize *ChartaResize
+	if c.Query("width") != "" || c.Query("height") != "" || !expiry.isSet() {
+		resize = &ChartaResize{}
+		if err := c.BindQuery(resize); err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+	}
+
+	var charta Charta
+	err := cs.updateFragments(func(tx *bolt.Tx, images *fragmentImages) error {
+		b := tx.Bucket([]byte("chartas"))
+
+		v := b.Get([]byte(c.Param("id")))
+		if v == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return nil
+		}
+
+		err := json.Unmarshal(v, &charta)
+		if err != nil {
+			return err
+		}
+
+		if resize != nil {
+			// Shrinking a charta is allowed even over the quota.
+			added := int64(resize.Width)*int64(resize.Height) - int64(charta.Width)*int64(charta.Height)
+			if added > 0 {
+				err = cs.checkQuota(tx, chartaProject(&charta), 0, added)
+				if err != nil {
+					return err
+				}
+			}
+			err = cs.resizeCharta(tx, images, &charta, resize)
+			if err != nil {
+				return err
+			}
+		}
+		expiry.apply(&charta, time.Now())
+
+		buf, err := json.Marshal(charta)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(charta.Id), buf)
+	})
+	if err != nil {
+		c.AbortWithStatus(quotaStatus(err))
+		return
+	}
+	if c.IsAborted() {
+		return
+	}
+
+	c.JSON(http.StatusOK, charta)
+}
@@ -1,17 +1,35 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
 	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
 	"image"
+	"image/color"
 	"image/draw"
 	"image/png"
+	"io"
+	"io/fs"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 type fragmentTest struct {
@@ -73,7 +91,7 @@ func TestCreateChartaEndpoint(t *testing.T) {
 		}
 		id := buf.String()
 
-		url = fmt.Sprintf("/chartas/%s/", id)
+		url = fmt.Sprintf("/chartas/%s/?hard=true", id)
 		req, _ = http.NewRequest("DELETE", url, nil)
 		responseDelete := httptest.NewRecorder()
 		cs.Router.ServeHTTP(responseDelete, req)
@@ -319,7 +337,7 @@ func TestGetFragmentEndpoint(t *testing.T) {
 
 	_ = fragmentRedFile.Close()
 
-	url = fmt.Sprintf("/chartas/%s/", id)
+	url = fmt.Sprintf("/chartas/%s/?hard=true", id)
 	req, _ = http.NewRequest("DELETE", url, nil)
 	responseDelete := httptest.NewRecorder()
 	cs.Router.ServeHTTP(responseDelete, req)
@@ -527,7 +545,7 @@ func TestAddFragmentEndpoint(t *testing.T) {
 		eqCode := compareBmp(bufLocal.Bytes(), responseGet.Body.Bytes())
 		assert.Equal(t, 0, eqCode)
 
-		url = fmt.Sprintf("/chartas/%s/", id)
+		url = fmt.Sprintf("/chartas/%s/?hard=true", id)
 		req, _ = http.NewRequest("DELETE", url, nil)
 		responseDelete := httptest.NewRecorder()
 		cs.Router.ServeHTTP(responseDelete, req)
@@ -555,7 +573,7 @@ func TestAddFragmentEndpoint(t *testing.T) {
 		assert.Equal(t, http.StatusBadRequest, response.Code)
 	}
 
-	url = fmt.Sprintf("/chartas/%s/", id)
+	url = fmt.Sprintf("/chartas/%s/?hard=true", id)
 	req, _ = http.NewRequest("DELETE", url, nil)
 	responseDelete := httptest.NewRecorder()
 	cs.Router.ServeHTTP(responseDelete, req)
@@ -584,12 +602,22 @@ func TestDeleteFragmentEndpoint(t *testing.T) {
 	}
 	id := buf.String()
 
+	// A deleted charta is moved to the trash and keeps its image.
 	url = fmt.Sprintf("/chartas/%s/", id)
 	responseDelete := httptest.NewRecorder()
 	req, _ = http.NewRequest("DELETE", url, nil)
 	cs.Router.ServeHTTP(responseDelete, req)
 	assert.Equal(t, http.StatusOK, responseDelete.Code)
 	filename := fmt.Sprintf("chartas/%s.png", id)
+	_, err = os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, serveTestRequest(cs.Router, "GET", url+"?x=0&y=0&width=10&height=10", nil).Code)
+
+	url = fmt.Sprintf("/chartas/%s/?hard=true", id)
+	responseDelete = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", url, nil)
+	cs.Router.ServeHTTP(responseDelete, req)
+	assert.Equal(t, http.StatusOK, responseDelete.Code)
 	_, err = os.Open(filename)
 
 	errString := fmt.Sprintf("open chartas/%s.png: no such file or directory", id)
@@ -624,3 +652,2261 @@ func compareBmp(bytes1, bytes2 []byte) int {
 
 	return 0
 }
+
+func TestAddFragmentBlendModes(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+
+	testCases := []struct {
+		Mode     string
+		Expected color.NRGBA
+	}{
+		{Mode: "replace", Expected: blue},
+		{Mode: "over", Expected: blue},
+		{Mode: "average", Expected: color.NRGBA{R: 127, B: 127, A: 255}},
+		{Mode: "max", Expected: color.NRGBA{R: 255, B: 255, A: 255}},
+		{Mode: "min", Expected: color.NRGBA{A: 255}},
+		{Mode: "keep-existing", Expected: red},
+	}
+
+	for _, testCase := range testCases {
+		id := createTestCharta(t, 10, 10)
+
+		url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 0, 0, 5, 10)
+		response := postTestFragment(url, createSolidImage(5, 10, red))
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		url = fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d&mode=%s", id, 0, 0, 10, 10, testCase.Mode)
+		response = postTestFragment(url, createSolidImage(10, 10, blue))
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		img := getTestFragment(t, id, 0, 0, 10, 10)
+		assert.Equal(t, testCase.Expected, color.NRGBAModel.Convert(img.At(2, 5)), testCase.Mode)
+		assert.Equal(t, blue, color.NRGBAModel.Convert(img.At(7, 5)), testCase.Mode)
+
+		deleteTestCharta(t, id)
+	}
+
+	id := createTestCharta(t, 10, 10)
+	url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d&mode=%s", id, 0, 0, 10, 10, "xor")
+	response := postTestFragment(url, createSolidImage(10, 10, blue))
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	deleteTestCharta(t, id)
+}
+
+func serveTestRequest(router http.Handler, method, url string, body []byte) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, req)
+	return response
+}
+
+func createTestCharta(t *testing.T, width, height int) string {
+	url := fmt.Sprintf("/chartas/?width=%d&height=%d", width, height)
+	req, _ := http.NewRequest("POST", url, nil)
+	response := httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusCreated, response.Code)
+
+	return response.Body.String()
+}
+
+func deleteTestCharta(t *testing.T, id string) {
+	url := fmt.Sprintf("/chartas/%s/?hard=true", id)
+	req, _ := http.NewRequest("DELETE", url, nil)
+	response := httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+}
+
+func postTestFragment(url string, img image.Image) *httptest.ResponseRecorder {
+	buf := new(bytes.Buffer)
+	_ = bmp.Encode(buf, img)
+
+	req, _ := http.NewRequest("POST", url, buf)
+	response := httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+
+	return response
+}
+
+func getTestFragment(t *testing.T, id string, x, y, width, height int) image.Image {
+	url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, x, y, width, height)
+	req, _ := http.NewRequest("GET", url, nil)
+	response := httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	img, err := bmp.Decode(response.Body)
+	assert.NoError(t, err)
+
+	return img
+}
+
+func createSolidImage(width, height int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: c}, image.Point{}, draw.Src)
+
+	return img
+}
+
+func TestAddFragmentConflictReport(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+
+	id := createTestCharta(t, 10, 10)
+
+	url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d&report=true", id, 0, 0, 5, 10)
+	response := postTestFragment(url, createSolidImage(5, 10, red))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	var report ConflictReport
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &report))
+	assert.Nil(t, report.Overlap)
+	assert.Equal(t, 0, report.DifferingPixels)
+
+	url = fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d&strict=true", id, -5, 0, 10, 10)
+	response = postTestFragment(url, createSolidImage(10, 10, blue))
+	assert.Equal(t, http.StatusConflict, response.Code)
+	img := getTestFragment(t, id, 0, 0, 10, 10)
+	assert.Equal(t, red, color.NRGBAModel.Convert(img.At(2, 5)))
+
+	url = fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d&report=true", id, -5, 0, 10, 10)
+	response = postTestFragment(url, createSolidImage(10, 10, blue))
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &report))
+	assert.Equal(t, &Rect{X: 0, Y: 0, Width: 5, Height: 10}, report.Overlap)
+	assert.Equal(t, 50, report.OverlapPixels)
+	assert.Equal(t, 50, report.DifferingPixels)
+	assert.Equal(t, float64(170), report.MeanAbsoluteDifference)
+
+	deleteTestCharta(t, id)
+}
+
+func TestAddTransformedFragment(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	black := color.NRGBA{A: 255}
+
+	testCases := []struct {
+		Query  string
+		Width  int
+		Height int
+		Inside image.Point
+		Out    image.Point
+	}{
+		{Query: "x=0&y=0&scale=2", Width: 5, Height: 5, Inside: image.Pt(8, 8), Out: image.Pt(12, 12)},
+		{Query: "x=0&y=0&scale=2&filter=bicubic", Width: 5, Height: 5, Inside: image.Pt(8, 8), Out: image.Pt(12, 12)},
+		{Query: "x=0&y=0&angle=90", Width: 10, Height: 4, Inside: image.Pt(5, 5), Out: image.Pt(1, 1)},
+		{Query: "x=2&y=2&matrix=2,0,0,0,2,0", Width: 5, Height: 5, Inside: image.Pt(10, 10), Out: image.Pt(1, 1)},
+		{Query: "x=0&y=0&matrix=1,0,5,0,1,5&filter=bicubic", Width: 5, Height: 5, Inside: image.Pt(7, 7), Out: image.Pt(3, 3)},
+	}
+
+	for _, testCase := range testCases {
+		id := createTestCharta(t, 20, 20)
+
+		url := fmt.Sprintf("/chartas/%s/?width=%d&height=%d&%s", id, testCase.Width, testCase.Height, testCase.Query)
+		response := postTestFragment(url, createSolidImage(testCase.Width, testCase.Height, red))
+		assert.Equal(t, http.StatusOK, response.Code, testCase.Query)
+
+		img := getTestFragment(t, id, 0, 0, 20, 20)
+		assert.Equal(t, red, color.NRGBAModel.Convert(img.At(testCase.Inside.X, testCase.Inside.Y)), testCase.Query)
+		assert.Equal(t, black, color.NRGBAModel.Convert(img.At(testCase.Out.X, testCase.Out.Y)), testCase.Query)
+
+		deleteTestCharta(t, id)
+	}
+
+	testCasesBadRequest := []string{
+		"x=0&y=0&matrix=1,0,0,0,1",
+		"x=0&y=0&matrix=0,0,0,0,0,0",
+		"x=0&y=0&matrix=1,0,0,0,1,0&angle=30",
+		"x=0&y=0&scale=-1",
+		"x=100&y=100&angle=30",
+		"x=0&y=0&angle=NaN",
+		"x=0&y=0&angle=Inf",
+		"x=0&y=0&angle=-Inf",
+		"x=0&y=0&scale=NaN",
+	}
+
+	// The rotated bounding box is limited as well as the scaled size.
+	x, y := 0, 0
+	_, _, err := transformFragment(createSolidImage(1, 1, red), &Fragment{X: &x, Y: &y, Width: 5000, Height: 2000, Scale: 2, Angle: 30})
+	assert.ErrorIs(t, err, errBadTransform)
+
+	id := createTestCharta(t, 20, 20)
+	for _, query := range testCasesBadRequest {
+		url := fmt.Sprintf("/chartas/%s/?width=%d&height=%d&%s", id, 5, 5, query)
+		response := postTestFragment(url, createSolidImage(5, 5, red))
+		assert.Equal(t, http.StatusBadRequest, response.Code, query)
+	}
+	deleteTestCharta(t, id)
+}
+
+func TestRegisterFragmentEndpoint(t *testing.T) {
+	texture := createNoiseImage(60, 60)
+	id := createTestCharta(t, 100, 100)
+
+	url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 20, 30, 60, 60)
+	response := postTestFragment(url, texture)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	piece := texture.SubImage(image.Rect(15, 10, 45, 40))
+	url = fmt.Sprintf("/chartas/%s/register?x=%d&y=%d&width=%d&height=%d&radius=%d", id, 40, 30, 30, 30, 12)
+	response = postTestFragment(url, piece)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	var result RegistrationResult
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &result))
+	assert.Equal(t, 35, result.X)
+	assert.Equal(t, 40, result.Y)
+	assert.InDelta(t, 1, result.Score, 1e-6)
+	assert.False(t, result.Placed)
+
+	url = fmt.Sprintf("/chartas/%s/register?x=%d&y=%d&width=%d&height=%d&radius=%d&place=true&mode=keep-existing", id, 38, 38, 30, 30, 5)
+	response = postTestFragment(url, piece)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &result))
+	assert.Equal(t, 35, result.X)
+	assert.Equal(t, 40, result.Y)
+	assert.True(t, result.Placed)
+
+	url = fmt.Sprintf("/chartas/%s/register?x=%d&y=%d&width=%d&height=%d", "0", 40, 30, 30, 30)
+	response = postTestFragment(url, piece)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	// An unknown charta is reported before the body is read.
+	for _, path := range []string{"/chartas/0/register?", "/chartas/0/?"} {
+		url = path + "x=40&y=30&width=30&height=30"
+		assert.Equal(t, http.StatusNotFound, serveTestRequest(cs.Router, "POST", url, []byte("not a bmp")).Code, path)
+	}
+
+	// Searches that would take too long are rejected.
+	url = fmt.Sprintf("/chartas/%s/register?x=%d&y=%d&width=%d&height=%d&maxAngle=45&angleStep=0.001", id, 40, 30, 30, 30)
+	assert.Equal(t, http.StatusBadRequest, postTestFragment(url, piece).Code)
+	url = fmt.Sprintf("/chartas/%s/register?x=%d&y=%d&width=%d&height=%d&radius=1000&maxAngle=45", id, 40, 30, 5000, 5000)
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(cs.Router, "POST", url, nil).Code)
+
+	deleteTestCharta(t, id)
+
+	id = createTestCharta(t, 100, 100)
+	url = fmt.Sprintf("/chartas/%s/register?x=%d&y=%d&width=%d&height=%d", id, 40, 30, 30, 30)
+	response = postTestFragment(url, piece)
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	deleteTestCharta(t, id)
+}
+
+func createNoiseImage(width, height int) *image.NRGBA {
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i] = uint8(rnd.Intn(256))
+		img.Pix[i+1] = uint8(rnd.Intn(256))
+		img.Pix[i+2] = uint8(rnd.Intn(256))
+		img.Pix[i+3] = 255
+	}
+
+	return img
+}
+
+func TestAddFragmentSeamBlending(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+
+	id := createTestCharta(t, 20, 10)
+
+	url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 0, 0, 10, 10)
+	response := postTestFragment(url, createSolidImage(10, 10, red))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	url = fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d&feather=%d", id, 0, 0, 20, 10, 4)
+	response = postTestFragment(url, createSolidImage(20, 10, blue))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	img := getTestFragment(t, id, 0, 0, 20, 10)
+	assert.Equal(t, color.NRGBA{R: 191, B: 64, A: 255}, color.NRGBAModel.Convert(img.At(0, 5)))
+	assert.Equal(t, blue, color.NRGBAModel.Convert(img.At(5, 5)))
+	assert.Equal(t, blue, color.NRGBAModel.Convert(img.At(19, 5)))
+
+	deleteTestCharta(t, id)
+
+	id = createTestCharta(t, 20, 10)
+
+	url = fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 0, 0, 10, 10)
+	response = postTestFragment(url, createSolidImage(10, 10, color.NRGBA{R: 100, G: 100, B: 100, A: 255}))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	url = fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d&exposure=true&mode=keep-existing", id, 5, 0, 15, 10)
+	response = postTestFragment(url, createSolidImage(15, 10, color.NRGBA{R: 50, G: 50, B: 50, A: 255}))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	img = getTestFragment(t, id, 0, 0, 20, 10)
+	assert.Equal(t, color.NRGBA{R: 100, G: 100, B: 100, A: 255}, color.NRGBAModel.Convert(img.At(15, 5)))
+
+	deleteTestCharta(t, id)
+}
+
+func TestGetFragmentsEndpoint(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	id := createTestCharta(t, 3000, 100)
+
+	fragments := []fragmentTest{
+		{X: 0, Y: 0, Width: 50, Height: 50},
+		{X: 1500, Y: 0, Width: 100, Height: 50},
+		{X: 40, Y: 10, Width: 1100, Height: 20},
+		{X: -10, Y: 90, Width: 20, Height: 20},
+	}
+	for _, fragment := range fragments {
+		url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, fragment.X, fragment.Y, fragment.Width, fragment.Height)
+		response := postTestFragment(url, createSolidImage(fragment.Width, fragment.Height, red))
+		assert.Equal(t, http.StatusOK, response.Code)
+	}
+
+	testCases := []struct {
+		Query    string
+		Expected []string
+	}{
+		{Query: "", Expected: []string{"1", "2", "3", "4"}},
+		{Query: "?x=45&y=15", Expected: []string{"1", "3"}},
+		{Query: "?x=1000&y=0&width=600&height=100", Expected: []string{"2", "3"}},
+		{Query: "?x=2000&y=0&width=600&height=100", Expected: []string{}},
+	}
+	for _, testCase := range testCases {
+		url := fmt.Sprintf("/chartas/%s/fragments%s", id, testCase.Query)
+		req, _ := http.NewRequest("GET", url, nil)
+		response := httptest.NewRecorder()
+		cs.Router.ServeHTTP(response, req)
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		var records []FragmentRecord
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &records))
+		ids := []string{}
+		for _, record := range records {
+			ids = append(ids, record.Id)
+		}
+		assert.Equal(t, testCase.Expected, ids, testCase.Query)
+	}
+
+	url := fmt.Sprintf("/chartas/%s/fragments?x=0&y=0", id)
+	req, _ := http.NewRequest("GET", url, nil)
+	response := httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	var records []FragmentRecord
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &records))
+	assert.Equal(t, FragmentRecord{Id: "1", ChartaId: id, X: 0, Y: 0, Width: 50, Height: 50, Z: 1, CreatedAt: records[0].CreatedAt}, records[0])
+
+	req, _ = http.NewRequest("GET", "/chartas/0/fragments", nil)
+	response = httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	// Large regions are clipped to the charta, overflowing ones are rejected.
+	response = serveTestRequest(cs.Router, "GET", fmt.Sprintf("/chartas/%s/fragments?x=-50000&y=-50000&width=50000&height=50000", id), nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "[]", response.Body.String())
+	response = serveTestRequest(cs.Router, "GET", fmt.Sprintf("/chartas/%s/fragments?x=-100&y=-100&width=50000&height=50000", id), nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &records))
+	assert.NotEmpty(t, records)
+	for _, query := range []string{"x=9223372036854775807&y=0&width=2", "x=0&y=0&width=1000000000&height=1000000000"} {
+		response = serveTestRequest(cs.Router, "GET", fmt.Sprintf("/chartas/%s/fragments?%s", id, query), nil)
+		assert.Equal(t, http.StatusBadRequest, response.Code, query)
+	}
+
+	deleteTestCharta(t, id)
+}
+
+func TestProvenanceEndpoint(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	green := color.NRGBA{G: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+
+	id := createTestCharta(t, 10, 10)
+
+	url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 0, 0, 6, 10)
+	assert.Equal(t, http.StatusOK, postTestFragment(url, createSolidImage(6, 10, red)).Code)
+	url = fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 4, 0, 6, 10)
+	assert.Equal(t, http.StatusOK, postTestFragment(url, createSolidImage(6, 10, blue)).Code)
+	url = fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d&mode=keep-existing", id, 0, 0, 10, 10)
+	assert.Equal(t, http.StatusOK, postTestFragment(url, createSolidImage(10, 10, green)).Code)
+
+	labels, legend := getTestProvenance(t, id, 0, 0, 10, 10)
+	assert.Equal(t, 2, len(legend))
+	assert.Equal(t, "1", legend[0].Fragment.Id)
+	assert.Equal(t, "2", legend[1].Fragment.Id)
+	assert.Equal(t, color.Gray16{Y: 1}, labels.At(2, 5))
+	assert.Equal(t, color.Gray16{Y: 2}, labels.At(5, 5))
+
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("/chartas/%s/fragments/%s", id, "2"), nil)
+	response := httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	img := getTestFragment(t, id, 0, 0, 10, 10)
+	assert.Equal(t, red, color.NRGBAModel.Convert(img.At(5, 5)))
+	assert.Equal(t, green, color.NRGBAModel.Convert(img.At(8, 5)))
+
+	labels, legend = getTestProvenance(t, id, 0, 0, 10, 10)
+	assert.Equal(t, 2, len(legend))
+	assert.Equal(t, "3", legend[1].Fragment.Id)
+	assert.Equal(t, color.Gray16{Y: 1}, labels.At(5, 5))
+	assert.Equal(t, color.Gray16{Y: 2}, labels.At(8, 5))
+
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("/chartas/%s/fragments/%s", id, "2"), nil)
+	response = httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	deleteTestCharta(t, id)
+}
+
+func TestProvenanceBase(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	green := color.NRGBA{G: 255, A: 255}
+
+	// The left half of the charta is written without a fragment, like the
+	// pixels of chartas restored before fragments were recorded.
+	id := createTestCharta(t, 10, 10)
+	assert.NoError(t, cs.store.Write(&Charta{Id: id, Width: 10, Height: 10}, createSolidImage(5, 10, red)))
+
+	url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d&mode=keep-existing", id, 0, 0, 8, 10)
+	assert.Equal(t, http.StatusOK, postTestFragment(url, createSolidImage(8, 10, green)).Code)
+	url = fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 0, 0, 2, 10)
+	assert.Equal(t, http.StatusOK, postTestFragment(url, createSolidImage(2, 10, green)).Code)
+
+	labels, legend := getTestProvenance(t, id, 0, 0, 10, 10)
+	assert.Equal(t, 2, len(legend))
+	assert.Equal(t, "1", legend[0].Fragment.Id)
+	assert.Equal(t, color.Gray16{Y: 2}, labels.At(1, 5))
+	assert.Equal(t, color.Gray16{Y: provenanceBase}, labels.At(3, 5))
+	assert.Equal(t, color.Gray16{Y: 1}, labels.At(6, 5))
+	assert.Equal(t, color.Gray16{}, labels.At(9, 5))
+
+	deleteTestCharta(t, id)
+}
+
+func getTestProvenance(t *testing.T, id string, x, y, width, height int) (image.Image, []ProvenanceEntry) {
+	url := fmt.Sprintf("/chartas/%s/provenance?x=%d&y=%d&width=%d&height=%d", id, x, y, width, height)
+	req, _ := http.NewRequest("GET", url, nil)
+	response := httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	var provenance Provenance
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &provenance))
+	labels, err := png.Decode(bytes.NewReader(provenance.Labels))
+	assert.NoError(t, err)
+
+	return labels, provenance.Legend
+}
+
+func TestReorderFragmentEndpoint(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	green := color.NRGBA{G: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+
+	id := createTestCharta(t, 10, 10)
+	for _, c := range []color.NRGBA{red, green, blue} {
+		url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 0, 0, 10, 10)
+		assert.Equal(t, http.StatusOK, postTestFragment(url, createSolidImage(10, 10, c)).Code)
+	}
+
+	testCases := []struct {
+		Fragment string
+		Query    string
+		Top      color.NRGBA
+		Order    []string
+	}{
+		{Fragment: "1", Query: "z=3", Top: red, Order: []string{"2", "3", "1"}},
+		{Fragment: "3", Query: "after=1", Top: blue, Order: []string{"2", "1", "3"}},
+		{Fragment: "3", Query: "before=2", Top: red, Order: []string{"3", "2", "1"}},
+		{Fragment: "2", Query: "z=100", Top: green, Order: []string{"3", "1", "2"}},
+	}
+	for _, testCase := range testCases {
+		url := fmt.Sprintf("/chartas/%s/fragments/%s?%s", id, testCase.Fragment, testCase.Query)
+		req, _ := http.NewRequest("PATCH", url, nil)
+		response := httptest.NewRecorder()
+		cs.Router.ServeHTTP(response, req)
+		assert.Equal(t, http.StatusOK, response.Code, testCase.Query)
+
+		img := getTestFragment(t, id, 0, 0, 10, 10)
+		assert.Equal(t, testCase.Top, color.NRGBAModel.Convert(img.At(5, 5)), testCase.Query)
+
+		req, _ = http.NewRequest("GET", fmt.Sprintf("/chartas/%s/fragments", id), nil)
+		response = httptest.NewRecorder()
+		cs.Router.ServeHTTP(response, req)
+		var records []FragmentRecord
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &records))
+		order := []string{}
+		for _, record := range records {
+			order = append(order, record.Id)
+		}
+		assert.Equal(t, testCase.Order, order, testCase.Query)
+	}
+
+	testCasesBadRequest := []struct {
+		Fragment string
+		Query    string
+		Code     int
+	}{
+		{Fragment: "1", Query: "", Code: http.StatusBadRequest},
+		{Fragment: "1", Query: "z=1&after=2", Code: http.StatusBadRequest},
+		{Fragment: "1", Query: "after=1", Code: http.StatusBadRequest},
+		{Fragment: "1", Query: "z=0", Code: http.StatusBadRequest},
+		{Fragment: "1", Query: "after=7", Code: http.StatusNotFound},
+		{Fragment: "7", Query: "z=1", Code: http.StatusNotFound},
+	}
+	for _, testCase := range testCasesBadRequest {
+		url := fmt.Sprintf("/chartas/%s/fragments/%s?%s", id, testCase.Fragment, testCase.Query)
+		req, _ := http.NewRequest("PATCH", url, nil)
+		response := httptest.NewRecorder()
+		cs.Router.ServeHTTP(response, req)
+		assert.Equal(t, testCase.Code, response.Code, testCase.Query)
+	}
+
+	deleteTestCharta(t, id)
+}
+
+func TestRecompositeKeepsPixels(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	green := color.NRGBA{G: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+
+	// The green pixels have no fragment history.
+	id := createTestCharta(t, 10, 10)
+	charta := &Charta{Id: id, Width: 10, Height: 10}
+	assert.NoError(t, cs.store.Write(charta, createSolidImage(10, 10, green)))
+
+	for _, c := range []color.NRGBA{red, blue} {
+		url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 0, 0, 5, 5)
+		assert.Equal(t, http.StatusOK, postTestFragment(url, createSolidImage(5, 5, c)).Code)
+	}
+
+	url := fmt.Sprintf("/chartas/%s/fragments/%s?z=3", id, "1")
+	assert.Equal(t, http.StatusOK, serveTestRequest(cs.Router, "PATCH", url, nil).Code)
+	img := getTestFragment(t, id, 0, 0, 10, 10)
+	assert.Equal(t, red, color.NRGBAModel.Convert(img.At(2, 2)))
+	assert.Equal(t, green, color.NRGBAModel.Convert(img.At(7, 7)))
+
+	url = fmt.Sprintf("/chartas/%s/fragments/%s", id, "1")
+	assert.Equal(t, http.StatusOK, serveTestRequest(cs.Router, "DELETE", url, nil).Code)
+	url = fmt.Sprintf("/chartas/%s/fragments/%s", id, "2")
+	assert.Equal(t, http.StatusOK, serveTestRequest(cs.Router, "DELETE", url, nil).Code)
+	img = getTestFragment(t, id, 0, 0, 10, 10)
+	assert.Equal(t, color.NRGBA{A: 255}, color.NRGBAModel.Convert(img.At(2, 2)))
+	assert.Equal(t, green, color.NRGBAModel.Convert(img.At(7, 7)))
+	assert.Equal(t, green, color.NRGBAModel.Convert(img.At(2, 7)))
+
+	deleteTestCharta(t, id)
+}
+
+func TestResizeChartaEndpoint(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	black := color.NRGBA{A: 255}
+
+	id := createTestCharta(t, 10, 10)
+	url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 0, 0, 10, 10)
+	assert.Equal(t, http.StatusOK, postTestFragment(url, createSolidImage(10, 10, red)).Code)
+
+	testCases := []struct {
+		Query     string
+		Width     int
+		Red       image.Point
+		Black     image.Point
+		Fragments []Rect
+	}{
+		{Query: "width=20&height=10&anchor=right", Width: 20, Red: image.Pt(15, 5), Black: image.Pt(5, 5), Fragments: []Rect{{X: 10, Y: 0, Width: 10, Height: 10}}},
+		{Query: "width=5&height=10&left=-12", Width: 5, Red: image.Pt(2, 5), Black: image.Pt(-1, 5), Fragments: []Rect{{X: 0, Y: 0, Width: 5, Height: 10}}},
+		{Query: "width=9&height=12&anchor=center", Width: 9, Red: image.Pt(3, 5), Black: image.Pt(1, 0), Fragments: []Rect{{X: 2, Y: 1, Width: 5, Height: 10}}},
+		{Query: "width=5&height=10&left=10", Width: 5, Red: image.Pt(-1, -1), Black: image.Pt(2, 5), Fragments: []Rect{}},
+	}
+	for _, testCase := range testCases {
+		req, _ := http.NewRequest("PATCH", fmt.Sprintf("/chartas/%s/?%s", id, testCase.Query), nil)
+		response := httptest.NewRecorder()
+		cs.Router.ServeHTTP(response, req)
+		assert.Equal(t, http.StatusOK, response.Code, testCase.Query)
+
+		var charta Charta
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &charta))
+		assert.Equal(t, testCase.Width, charta.Width, testCase.Query)
+
+		img := getTestFragment(t, id, 0, 0, testCase.Width, 10)
+		if testCase.Red.X >= 0 {
+			assert.Equal(t, red, color.NRGBAModel.Convert(img.At(testCase.Red.X, testCase.Red.Y)), testCase.Query)
+		}
+		if testCase.Black.X >= 0 {
+			assert.Equal(t, black, color.NRGBAModel.Convert(img.At(testCase.Black.X, testCase.Black.Y)), testCase.Query)
+		}
+
+		req, _ = http.NewRequest("GET", fmt.Sprintf("/chartas/%s/fragments", id), nil)
+		response = httptest.NewRecorder()
+		cs.Router.ServeHTTP(response, req)
+		var records []FragmentRecord
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &records))
+		rects := []Rect{}
+		for _, record := range records {
+			rects = append(rects, Rect{X: record.X, Y: record.Y, Width: record.Width, Height: record.Height})
+		}
+		assert.Equal(t, testCase.Fragments, rects, testCase.Query)
+	}
+
+	testCasesBadRequest := []string{"width=0&height=10", "width=10", "width=10&height=10&anchor=middle"}
+	for _, query := range testCasesBadRequest {
+		req, _ := http.NewRequest("PATCH", fmt.Sprintf("/chartas/%s/?%s", id, query), nil)
+		response := httptest.NewRecorder()
+		cs.Router.ServeHTTP(response, req)
+		assert.Equal(t, http.StatusBadRequest, response.Code, query)
+	}
+
+	req, _ := http.NewRequest("PATCH", "/chartas/0/?width=10&height=10", nil)
+	response := httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	deleteTestCharta(t, id)
+}
+
+func TestCloneChartaEndpoint(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+
+	id := createTestCharta(t, 10, 10)
+	url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 0, 0, 10, 10)
+	assert.Equal(t, http.StatusOK, postTestFragment(url, createSolidImage(10, 10, red)).Code)
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/chartas/%s/clone", id), nil)
+	response := httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	cloneId := response.Body.String()
+	assert.NotEqual(t, id, cloneId)
+
+	url = fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", cloneId, 0, 0, 5, 10)
+	assert.Equal(t, http.StatusOK, postTestFragment(url, createSolidImage(5, 10, blue)).Code)
+
+	img := getTestFragment(t, id, 0, 0, 10, 10)
+	assert.Equal(t, red, color.NRGBAModel.Convert(img.At(2, 5)))
+	img = getTestFragment(t, cloneId, 0, 0, 10, 10)
+	assert.Equal(t, blue, color.NRGBAModel.Convert(img.At(2, 5)))
+	assert.Equal(t, red, color.NRGBAModel.Convert(img.At(7, 5)))
+
+	deleteTestCharta(t, id)
+
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("/chartas/%s/fragments/%s", cloneId, "2"), nil)
+	response = httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+	img = getTestFragment(t, cloneId, 0, 0, 10, 10)
+	assert.Equal(t, red, color.NRGBAModel.Convert(img.At(2, 5)))
+
+	deleteTestCharta(t, cloneId)
+
+	req, _ = http.NewRequest("POST", "/chartas/0/clone", nil)
+	response = httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
+
+func TestMergeChartaEndpoint(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+	black := color.NRGBA{A: 255}
+
+	srcId := createTestCharta(t, 10, 10)
+	url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", srcId, 0, 0, 5, 10)
+	assert.Equal(t, http.StatusOK, postTestFragment(url, createSolidImage(5, 10, red)).Code)
+
+	dstId := createTestCharta(t, 10, 10)
+	url = fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", dstId, 0, 0, 10, 10)
+	assert.Equal(t, http.StatusOK, postTestFragment(url, createSolidImage(10, 10, blue)).Code)
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/chartas/%s/merge?from=%s&x=3&y=0", dstId, srcId), nil)
+	response := httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var records []FragmentRecord
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &records))
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, Rect{X: 3, Y: 0, Width: 7, Height: 10}, Rect{X: records[0].X, Y: records[0].Y, Width: records[0].Width, Height: records[0].Height})
+
+	img := getTestFragment(t, dstId, 0, 0, 10, 10)
+	assert.Equal(t, blue, color.NRGBAModel.Convert(img.At(1, 5)))
+	assert.Equal(t, red, color.NRGBAModel.Convert(img.At(5, 5)))
+	assert.Equal(t, blue, color.NRGBAModel.Convert(img.At(9, 5)))
+
+	historyId := createTestCharta(t, 10, 10)
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/chartas/%s/merge?from=%s&x=-2&y=0&history=true", historyId, srcId), nil)
+	response = httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &records))
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, 3, records[0].Width)
+
+	img = getTestFragment(t, historyId, 0, 0, 10, 10)
+	assert.Equal(t, red, color.NRGBAModel.Convert(img.At(2, 5)))
+	assert.Equal(t, black, color.NRGBAModel.Convert(img.At(3, 5)))
+
+	testCases := []struct {
+		Query string
+		Code  int
+	}{
+		{Query: fmt.Sprintf("from=%s&x=10", srcId), Code: http.StatusBadRequest},
+		{Query: fmt.Sprintf("from=%s&history=true&mode=max", srcId), Code: http.StatusBadRequest},
+		{Query: fmt.Sprintf("from=%s", dstId), Code: http.StatusBadRequest},
+		{Query: "", Code: http.StatusBadRequest},
+		{Query: "from=0", Code: http.StatusNotFound},
+	}
+	for _, testCase := range testCases {
+		req, _ = http.NewRequest("POST", fmt.Sprintf("/chartas/%s/merge?%s", dstId, testCase.Query), nil)
+		response = httptest.NewRecorder()
+		cs.Router.ServeHTTP(response, req)
+		assert.Equal(t, testCase.Code, response.Code, testCase.Query)
+	}
+
+	deleteTestCharta(t, srcId)
+	deleteTestCharta(t, dstId)
+	deleteTestCharta(t, historyId)
+}
+
+func TestImportChartaEndpoint(t *testing.T) {
+	noise := createNoiseImage(30, 20)
+	gray := image.NewGray16(image.Rect(0, 0, 30, 20))
+	draw.Draw(gray, gray.Bounds(), noise, image.Point{}, draw.Src)
+
+	encoders := []struct {
+		Name   string
+		Type   string
+		Img    image.Image
+		Encode func(w io.Writer, img image.Image) error
+	}{
+		{Name: "bmp", Type: "image/bmp", Img: noise, Encode: bmp.Encode},
+		{Name: "png", Type: "image/png", Img: noise, Encode: png.Encode},
+		{Name: "png16", Type: "image/png", Img: gray, Encode: png.Encode},
+		{Name: "tiff", Type: "image/tiff", Img: noise, Encode: func(w io.Writer, img image.Image) error {
+			return tiff.Encode(w, img, nil)
+		}},
+		{Name: "tiff-deflate", Type: "image/tiff", Img: noise, Encode: func(w io.Writer, img image.Image) error {
+			return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate, Predictor: true})
+		}},
+	}
+
+	for _, encoder := range encoders {
+		buf := new(bytes.Buffer)
+		assert.NoError(t, encoder.Encode(buf, encoder.Img))
+
+		req, _ := http.NewRequest("POST", "/chartas/", buf)
+		req.Header.Set("Content-Type", encoder.Type)
+		response := httptest.NewRecorder()
+		cs.Router.ServeHTTP(response, req)
+		assert.Equal(t, http.StatusCreated, response.Code, encoder.Name)
+		id := response.Body.String()
+
+		expected := new(bytes.Buffer)
+		assert.NoError(t, bmp.Encode(expected, encoder.Img))
+		url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 0, 0, 30, 20)
+		req, _ = http.NewRequest("GET", url, nil)
+		response = httptest.NewRecorder()
+		cs.Router.ServeHTTP(response, req)
+		assert.Equal(t, http.StatusOK, response.Code, encoder.Name)
+		assert.Equal(t, 0, compareBmp(expected.Bytes(), response.Body.Bytes()), encoder.Name)
+
+		url = fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 0, 0, 10, 10)
+		assert.Equal(t, http.StatusOK, postTestFragment(url, createSolidImage(10, 10, color.NRGBA{R: 255, A: 255})).Code)
+		req, _ = http.NewRequest("DELETE", fmt.Sprintf("/chartas/%s/fragments/%s", id, "2"), nil)
+		response = httptest.NewRecorder()
+		cs.Router.ServeHTTP(response, req)
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		req, _ = http.NewRequest("GET", fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 0, 0, 30, 20), nil)
+		response = httptest.NewRecorder()
+		cs.Router.ServeHTTP(response, req)
+		assert.Equal(t, 0, compareBmp(expected.Bytes(), response.Body.Bytes()), encoder.Name)
+
+		deleteTestCharta(t, id)
+	}
+
+	req, _ := http.NewRequest("POST", "/chartas/?import=true", bytes.NewBufferString("GIF89a"))
+	response := httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, response.Code)
+
+	// The sizes in the headers are checked before anything is allocated for
+	// the rows.
+	header := make([]byte, 54)
+	copy(header, "BM")
+	binary.LittleEndian.PutUint32(header[14:], 40)
+	binary.LittleEndian.PutUint32(header[18:], 0x7fffffff)
+	binary.LittleEndian.PutUint32(header[22:], 1)
+	binary.LittleEndian.PutUint16(header[28:], 24)
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(cs.Router, "POST", "/chartas/?import=true", header).Code)
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], 0x7fffffff)
+	binary.BigEndian.PutUint32(ihdr[4:], 1)
+	ihdr[8], ihdr[9] = 8, 6
+	buf := bytes.NewBuffer(append([]byte{}, pngSignature...))
+	for _, chunk := range []struct {
+		Name string
+		Data []byte
+	}{{"IHDR", ihdr}, {"IDAT", nil}} {
+		assert.NoError(t, binary.Write(buf, binary.BigEndian, uint32(len(chunk.Data))))
+		buf.WriteString(chunk.Name)
+		buf.Write(chunk.Data)
+		buf.Write(make([]byte, 4))
+	}
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(cs.Router, "POST", "/chartas/?import=true", buf.Bytes()).Code)
+
+	// A palette chunk claiming 2GB.
+	buf = bytes.NewBuffer(append([]byte{}, pngSignature...))
+	assert.NoError(t, binary.Write(buf, binary.BigEndian, uint32(0x7fffffff)))
+	buf.WriteString("PLTE")
+	assert.Equal(t, http.StatusUnsupportedMediaType, serveTestRequest(cs.Router, "POST", "/chartas/?import=true", buf.Bytes()).Code)
+
+	// Imported chartas take a lifetime like empty ones.
+	buf.Reset()
+	assert.NoError(t, png.Encode(buf, noise))
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(cs.Router, "POST", "/chartas/?import=true&ttl=-1h", buf.Bytes()).Code)
+	response = serveTestRequest(cs.Router, "POST", "/chartas/?import=true&ttl=1h", buf.Bytes())
+	assert.Equal(t, http.StatusCreated, response.Code)
+	id := response.Body.String()
+	defer deleteTestCharta(t, id)
+	response = serveTestRequest(cs.Router, "GET", fmt.Sprintf("/chartas/%s/meta", id), nil)
+	var charta Charta
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &charta))
+	if assert.NotNil(t, charta.Expires) {
+		assert.WithinDuration(t, time.Now().Add(time.Hour), *charta.Expires, time.Minute)
+	}
+
+	// Other bodies don't make an import.
+	for contentType, body := range map[string]string{
+		"application/json":                  "{}",
+		"application/x-www-form-urlencoded": "width=5",
+	} {
+		req, _ := http.NewRequest("POST", "/chartas/?width=10&height=20", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", contentType)
+		response := httptest.NewRecorder()
+		cs.Router.ServeHTTP(response, req)
+		assert.Equal(t, http.StatusCreated, response.Code, contentType)
+		deleteTestCharta(t, response.Body.String())
+	}
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(cs.Router, "POST", "/chartas/?import=maybe", buf.Bytes()).Code)
+	req, _ = http.NewRequest("POST", "/chartas/?import=true", iotest.ErrReader(errors.New("connection reset")))
+	response = httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	// Spooled uploads left by a restart are removed.
+	path := t.TempDir()
+	for _, name := range []string{"import-1.tmp", "archive-2.png", "archive-3.tmp/1.png"} {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(path, name)), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(path, name), []byte("left"), 0644))
+	}
+	s := &ChartographerService{CompactInterval: -1}
+	s.Initialize(path, "test.db")
+	defer s.DB.Close()
+	leftovers, err := filepath.Glob(filepath.Join(path, "*-*"))
+	assert.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
+
+func TestExportChartaEndpoint(t *testing.T) {
+	id := createTestCharta(t, 300, 200)
+	defer deleteTestCharta(t, id)
+
+	url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 20, 10, 250, 150)
+	assert.Equal(t, http.StatusOK, postTestFragment(url, createNoiseImage(250, 150)).Code)
+
+	export := func(format, ranges string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/chartas/%s/export?format=%s", id, format), nil)
+		if ranges != "" {
+			req.Header.Set("Range", ranges)
+		}
+		response := httptest.NewRecorder()
+		cs.Router.ServeHTTP(response, req)
+		return response
+	}
+
+	response := export("bmp", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "bytes", response.Header().Get("Accept-Ranges"))
+	full := response.Body.Bytes()
+	exported, err := bmp.Decode(bytes.NewReader(full))
+	assert.NoError(t, err)
+	expected := getTestFragment(t, id, 0, 0, 300, 200)
+	assert.Equal(t, imaging.Clone(expected).Pix, imaging.Clone(exported).Pix)
+
+	response = export("bmp", "bytes=100000-100099")
+	assert.Equal(t, http.StatusPartialContent, response.Code)
+	assert.Equal(t, full[100000:100100], response.Body.Bytes())
+	response = export("bmp", "bytes=150000-")
+	assert.Equal(t, http.StatusPartialContent, response.Code)
+	assert.Equal(t, full[150000:], response.Body.Bytes())
+
+	response = export("tiff", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	exported, err = tiff.Decode(bytes.NewReader(response.Body.Bytes()))
+	assert.NoError(t, err)
+	chartaImg, err := cs.store.Read(&Charta{Id: id, Width: 300, Height: 200}, image.Rect(0, 0, 300, 200))
+	assert.NoError(t, err)
+	assert.Equal(t, imaging.Clone(chartaImg).Pix, imaging.Clone(exported).Pix)
+
+	response = export("png", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	exported, err = png.Decode(bytes.NewReader(response.Body.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, imaging.Clone(chartaImg).Pix, imaging.Clone(exported).Pix)
+
+	assert.Equal(t, http.StatusBadRequest, export("gif", "").Code)
+	req, _ := http.NewRequest("GET", "/chartas/unknown/export", nil)
+	response = httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	// Other stores generate PNG exports too, with rows longer than a stored
+	// deflate block.
+	s := &ChartographerService{Storage: "mmap", CompactInterval: -1}
+	s.Initialize(t.TempDir(), "test.db")
+	defer s.DB.Close()
+	response = serveTestRequest(s.Router, "POST", "/chartas/?width=17000&height=3", nil)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	wide := response.Body.String()
+	buf := new(bytes.Buffer)
+	assert.NoError(t, bmp.Encode(buf, createNoiseImage(1000, 2)))
+	url = fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", wide, 16000, 1, 1000, 2)
+	assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "POST", url, buf.Bytes()).Code)
+
+	exportWide := func(ranges string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/chartas/%s/export?format=png", wide), nil)
+		if ranges != "" {
+			req.Header.Set("Range", ranges)
+		}
+		response := httptest.NewRecorder()
+		s.Router.ServeHTTP(response, req)
+		return response
+	}
+	response = exportWide("")
+	assert.Equal(t, http.StatusOK, response.Code)
+	full = response.Body.Bytes()
+	exported, err = png.Decode(bytes.NewReader(full))
+	assert.NoError(t, err)
+	chartaImg, err = s.store.Read(&Charta{Id: wide, Width: 17000, Height: 3}, image.Rect(0, 0, 17000, 3))
+	assert.NoError(t, err)
+	assert.Equal(t, imaging.Clone(chartaImg).Pix, imaging.Clone(exported).Pix)
+
+	response = exportWide("bytes=100000-100099")
+	assert.Equal(t, http.StatusPartialContent, response.Code)
+	assert.Equal(t, full[100000:100100], response.Body.Bytes())
+	response = exportWide("bytes=-50")
+	assert.Equal(t, http.StatusPartialContent, response.Code)
+	assert.Equal(t, full[len(full)-50:], response.Body.Bytes())
+}
+
+func getTestJob(t *testing.T, id string) Job {
+	return getServiceJob(t, &cs, id)
+}
+
+func getServiceJob(t *testing.T, s *ChartographerService, id string) Job {
+	response := serveTestRequest(s.Router, "GET", "/jobs/"+id, nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	var job Job
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &job))
+	return job
+}
+
+func waitTestJob(t *testing.T, response *httptest.ResponseRecorder) Job {
+	return waitServiceJob(t, &cs, response)
+}
+
+func waitServiceJob(t *testing.T, s *ChartographerService, response *httptest.ResponseRecorder) Job {
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	var job Job
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &job))
+
+	for i := 0; i < 1000 && (job.Status == JobQueued || job.Status == JobRunning); i++ {
+		time.Sleep(10 * time.Millisecond)
+		job = getServiceJob(t, s, job.Id)
+	}
+	return job
+}
+
+func TestJobsEndpoints(t *testing.T) {
+	id := createTestCharta(t, 300, 200)
+	defer deleteTestCharta(t, id)
+	url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 20, 10, 250, 150)
+	assert.Equal(t, http.StatusOK, postTestFragment(url, createNoiseImage(250, 150)).Code)
+
+	// Export.
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/chartas/%s/export?format=bmp", id), nil)
+	expected := httptest.NewRecorder()
+	cs.Router.ServeHTTP(expected, req)
+
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/chartas/%s/export?format=bmp", id), nil)
+	response := httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	job := waitTestJob(t, response)
+	assert.Equal(t, JobDone, job.Status)
+	assert.Equal(t, 1.0, job.Progress)
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/jobs/%s/result", job.Id), nil)
+	response = httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, expected.Body.Bytes(), response.Body.Bytes())
+
+	req, _ = http.NewRequest("DELETE", "/jobs/"+job.Id, nil)
+	response = httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	req, _ = http.NewRequest("GET", "/jobs/"+job.Id, nil)
+	response = httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	// Merge.
+	other := createTestCharta(t, 100, 100)
+	defer deleteTestCharta(t, other)
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/chartas/%s/merge?from=%s&async=true", other, id), nil)
+	response = httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	job = waitTestJob(t, response)
+	assert.Equal(t, JobDone, job.Status)
+	var records []FragmentRecord
+	assert.NoError(t, json.Unmarshal(job.Result, &records))
+	assert.Len(t, records, 1)
+
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/chartas/%s/merge?from=%s&async=true", other, "unknown"), nil)
+	response = httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	// Import.
+	buf := new(bytes.Buffer)
+	assert.NoError(t, png.Encode(buf, createNoiseImage(40, 30)))
+	req, _ = http.NewRequest("POST", "/chartas/?async=true&import=true", buf)
+	response = httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	job = waitTestJob(t, response)
+	assert.Equal(t, JobDone, job.Status)
+	var charta Charta
+	assert.NoError(t, json.Unmarshal(job.Result, &charta))
+	assert.Equal(t, 40, charta.Width)
+	deleteTestCharta(t, charta.Id)
+
+	// Cancellation of running and queued jobs.
+	started := make(chan struct{}, defaultJobWorkers+1)
+	block := func(ctx context.Context, job *Job, progress func(float64)) (interface{}, error) {
+		progress(0.5)
+		started <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	var running []*Job
+	for i := 0; i < defaultJobWorkers; i++ {
+		job, err := cs.submitJob("test", "", "", block)
+		assert.NoError(t, err)
+		running = append(running, job)
+		<-started
+	}
+	queued, err := cs.submitJob("test", "", "", block)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 0.5, getTestJob(t, running[0].Id).Progress)
+	for _, job := range append(running, queued) {
+		req, _ = http.NewRequest("DELETE", "/jobs/"+job.Id, nil)
+		response = httptest.NewRecorder()
+		cs.Router.ServeHTTP(response, req)
+		assert.Equal(t, JobCancelled, waitTestJob(t, response).Status)
+	}
+}
+
+func TestJobRetention(t *testing.T) {
+	s := &ChartographerService{CompactInterval: -1, JobRetention: time.Hour}
+	s.Initialize(t.TempDir(), "test.db")
+	defer s.DB.Close()
+
+	response := serveTestRequest(s.Router, "POST", "/chartas/?width=10&height=10", nil)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	response = serveTestRequest(s.Router, "POST", fmt.Sprintf("/chartas/%s/export?format=bmp", response.Body.String()), nil)
+	job := waitServiceJob(t, s, response)
+	assert.Equal(t, JobDone, job.Status)
+	_, err := os.Stat(s.jobResultFilename(job.Id))
+	assert.NoError(t, err)
+
+	purged, err := s.purgeJobs(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, purged)
+
+	s.JobRetention = time.Nanosecond
+	purged, err = s.purgeJobs(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	assert.Equal(t, http.StatusNotFound, serveTestRequest(s.Router, "GET", "/jobs/"+job.Id, nil).Code)
+	_, err = os.Stat(s.jobResultFilename(job.Id))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCompactEndpoint(t *testing.T) {
+	id := createTestCharta(t, 500, 500)
+	defer deleteTestCharta(t, id)
+	url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 100, 100, 50, 50)
+	assert.Equal(t, http.StatusOK, postTestFragment(url, createNoiseImage(50, 50)).Code)
+	expected := imaging.Clone(getTestFragment(t, id, 0, 0, 500, 500))
+
+	storage := func() StorageStats {
+		req, _ := http.NewRequest("GET", "/admin/storage", nil)
+		response := httptest.NewRecorder()
+		cs.Router.ServeHTTP(response, req)
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		var stats StorageStats
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &stats))
+		return stats
+	}
+	compact := func() CompactionStats {
+		req, _ := http.NewRequest("POST", "/admin/compact?level=9", nil)
+		response := httptest.NewRecorder()
+		cs.Router.ServeHTTP(response, req)
+		job := waitTestJob(t, response)
+		assert.Equal(t, JobDone, job.Status)
+
+		var stats CompactionStats
+		assert.NoError(t, json.Unmarshal(job.Result, &stats))
+		return stats
+	}
+
+	before := storage()
+	stats := compact()
+	assert.GreaterOrEqual(t, stats.Compacted, 1)
+	assert.Less(t, stats.BytesAfter, stats.BytesBefore)
+	after := storage()
+	assert.Equal(t, before.Chartas.Files, after.Chartas.Files)
+	assert.Less(t, after.Chartas.Bytes, before.Chartas.Bytes)
+	assert.Equal(t, expected.Pix, imaging.Clone(getTestFragment(t, id, 0, 0, 500, 500)).Pix)
+
+	// Compacted images are left alone until they are written again.
+	assert.Equal(t, 0, compact().Compacted)
+	assert.Equal(t, http.StatusOK, postTestFragment(url, createNoiseImage(50, 50)).Code)
+	assert.GreaterOrEqual(t, compact().Compacted, 1)
+
+	req, _ := http.NewRequest("POST", "/admin/compact?level=10", nil)
+	response := httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
+
+func TestCompactSharedFiles(t *testing.T) {
+	s := &ChartographerService{CompactInterval: -1}
+	s.Initialize(t.TempDir(), "test.db")
+	defer s.DB.Close()
+
+	response := serveTestRequest(s.Router, "POST", "/chartas/?width=100&height=100", nil)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	id := response.Body.String()
+	buf := new(bytes.Buffer)
+	assert.NoError(t, bmp.Encode(buf, createNoiseImage(50, 50)))
+	url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 10, 10, 50, 50)
+	assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "POST", url, buf.Bytes()).Code)
+	response = serveTestRequest(s.Router, "POST", fmt.Sprintf("/chartas/%s/clone", id), nil)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	clone := response.Body.String()
+
+	sameFile := func(a, b string) bool {
+		infoA, err := os.Stat(a)
+		assert.NoError(t, err)
+		infoB, err := os.Stat(b)
+		assert.NoError(t, err)
+		return os.SameFile(infoA, infoB)
+	}
+	files := [][2]string{
+		{s.store.(*pngStore).filename(id), s.store.(*pngStore).filename(clone)},
+		{s.fragmentFilename(id, "1"), s.fragmentFilename(clone, "1")},
+	}
+	for _, pair := range files {
+		assert.True(t, sameFile(pair[0], pair[1]), pair[0])
+	}
+
+	// Each charta gets a compacted copy of its own. The noise of the fragment
+	// doesn't compress, so its image may stay shared.
+	before := serveTestRequest(s.Router, "GET", fmt.Sprintf("/chartas/%s/?x=0&y=0&width=100&height=100", clone), nil)
+	stats, err := s.compact(context.Background(), 9, 0, func(float64) {})
+	assert.NoError(t, err)
+	assert.Greater(t, stats.Compacted, 1)
+	assert.False(t, sameFile(files[0][0], files[0][1]))
+	for _, charta := range []string{id, clone} {
+		response = serveTestRequest(s.Router, "GET", fmt.Sprintf("/chartas/%s/?x=0&y=0&width=100&height=100", charta), nil)
+		assert.Equal(t, before.Body.Bytes(), response.Body.Bytes())
+	}
+
+	// The usage of both chartas counts their own copies.
+	assert.NoError(t, s.DB.Update(func(tx *bolt.Tx) error {
+		for _, charta := range []string{id, clone} {
+			usage, err := getChartaUsage(tx, charta)
+			assert.NoError(t, err)
+			assert.NoError(t, s.recountCharta(tx, charta))
+			recounted, err := getChartaUsage(tx, charta)
+			assert.NoError(t, err)
+			assert.Equal(t, recounted, usage)
+		}
+		return nil
+	}))
+}
+
+func TestCompactBrokenFiles(t *testing.T) {
+	s := &ChartographerService{CompactInterval: -1}
+	s.Initialize(t.TempDir(), "test.db")
+	defer s.DB.Close()
+
+	response := serveTestRequest(s.Router, "POST", "/chartas/?width=100&height=100", nil)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	id := response.Body.String()
+	buf := new(bytes.Buffer)
+	assert.NoError(t, bmp.Encode(buf, createNoiseImage(50, 50)))
+	url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 10, 10, 50, 50)
+	assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "POST", url, buf.Bytes()).Code)
+	assert.NoError(t, os.WriteFile(s.fragmentFilename(id, "99"), []byte("not a png"), 0644))
+
+	// A broken file doesn't keep the others from being compacted.
+	stats, err := s.compact(context.Background(), 9, 0, func(float64) {})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Failed)
+	assert.GreaterOrEqual(t, stats.Compacted, 1)
+}
+
+func TestSweep(t *testing.T) {
+	s := &ChartographerService{CompactInterval: -1, SweepInterval: -1}
+	s.Initialize(t.TempDir(), "test.db")
+	defer s.DB.Close()
+
+	response := serveTestRequest(s.Router, "POST", "/chartas/?width=10&height=10&ttl=1ms", nil)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	id := response.Body.String()
+	time.Sleep(10 * time.Millisecond)
+
+	s.sweep(context.Background())
+	assert.Equal(t, http.StatusNotFound, serveTestRequest(s.Router, "GET", fmt.Sprintf("/chartas/%s/meta", id), nil).Code)
+}
+
+func TestFsck(t *testing.T) {
+	s := &ChartographerService{CompactInterval: -1}
+	path := t.TempDir()
+	s.Initialize(path, "test.db")
+
+	create := func(width, height int, fragment bool) (string, []byte) {
+		response := serveTestRequest(s.Router, "POST", fmt.Sprintf("/chartas/?width=%d&height=%d", width, height), nil)
+		assert.Equal(t, http.StatusCreated, response.Code)
+		id := response.Body.String()
+		if fragment {
+			buf := new(bytes.Buffer)
+			assert.NoError(t, bmp.Encode(buf, createNoiseImage(50, 40)))
+			url := fmt.Sprintf("/chartas/%s/?x=10&y=20&width=50&height=40", id)
+			assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "POST", url, buf.Bytes()).Code)
+		}
+		url := fmt.Sprintf("/chartas/%s/?x=0&y=0&width=%d&height=%d", id, width, height)
+		return id, serveTestRequest(s.Router, "GET", url, nil).Body.Bytes()
+	}
+	filename := func(id string) string {
+		return filepath.Join(path, "chartas", id+".png")
+	}
+	fsck := func(mode string) FsckResult {
+		job := waitServiceJob(t, s, serveTestRequest(s.Router, "POST", "/admin/fsck?mode="+mode, nil))
+		assert.Equal(t, JobDone, job.Status)
+		var result FsckResult
+		assert.NoError(t, json.Unmarshal(job.Result, &result))
+		return result
+	}
+	problems := func(result FsckResult) map[string]string {
+		found := map[string]string{}
+		for _, p := range result.Problems {
+			found[p.Id] = p.Problem
+		}
+		return found
+	}
+
+	corrupt, corruptImg := create(100, 80, true)
+	missing, missingImg := create(60, 60, true)
+	resized, resizedImg := create(70, 90, true)
+	blank, blankImg := create(30, 30, false)
+	_, _ = create(40, 40, true)
+
+	assert.Empty(t, fsck("").Problems)
+
+	data, err := os.ReadFile(filename(corrupt))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filename(corrupt), data[:len(data)/2], 0644))
+	assert.NoError(t, os.Remove(filename(missing)))
+	buf := new(bytes.Buffer)
+	assert.NoError(t, png.Encode(buf, image.NewNRGBA(image.Rect(0, 0, 10, 10))))
+	assert.NoError(t, os.WriteFile(filename(resized), buf.Bytes(), 0644))
+	assert.NoError(t, os.Remove(filename(blank)))
+	assert.NoError(t, os.WriteFile(filename("orphan"), buf.Bytes(), 0644))
+
+	expected := map[string]string{
+		corrupt:  FsckCorrupt,
+		missing:  FsckMissing,
+		resized:  FsckSizeMismatch,
+		blank:    FsckMissing,
+		"orphan": FsckOrphan,
+	}
+	result := fsck(FsckReport)
+	assert.Equal(t, 5, result.Chartas)
+	assert.Equal(t, 4, result.Stored)
+	assert.Equal(t, expected, problems(result))
+	for _, p := range result.Problems {
+		assert.Empty(t, p.Action)
+	}
+
+	result = fsck(FsckRepair)
+	assert.Equal(t, expected, problems(result))
+	for _, p := range result.Problems {
+		assert.NotEmpty(t, p.Action)
+	}
+	assert.Empty(t, fsck(FsckReport).Problems)
+	for id, img := range map[string][]byte{corrupt: corruptImg, missing: missingImg, resized: resizedImg, blank: blankImg} {
+		var charta Charta
+		assert.NoError(t, s.DB.View(func(tx *bolt.Tx) error {
+			return json.Unmarshal(tx.Bucket([]byte("chartas")).Get([]byte(id)), &charta)
+		}))
+		url := fmt.Sprintf("/chartas/%s/?x=0&y=0&width=%d&height=%d", id, charta.Width, charta.Height)
+		assert.Equal(t, img, serveTestRequest(s.Router, "GET", url, nil).Body.Bytes(), id)
+	}
+	_, err = os.Stat(filename("orphan"))
+	assert.True(t, os.IsNotExist(err))
+
+	// The command line check quarantines instead of deleting.
+	assert.NoError(t, os.WriteFile(filename("orphan"), buf.Bytes(), 0644))
+	assert.NoError(t, s.DB.Close())
+	out := new(bytes.Buffer)
+	assert.Equal(t, 1, fsckCommand(&ChartographerService{}, []string{path}, out))
+	assert.Equal(t, 0, fsckCommand(&ChartographerService{}, []string{"-quarantine", path}, out))
+	quarantined, err := filepath.Glob(filepath.Join(path, "quarantine", "*", "orphan.png"))
+	assert.NoError(t, err)
+	assert.Len(t, quarantined, 1)
+	assert.Equal(t, 2, fsckCommand(&ChartographerService{}, []string{"-repair", "-quarantine", path}, out))
+}
+
+func TestAbortResponse(t *testing.T) {
+	s := &ChartographerService{CompactInterval: -1}
+	s.Initialize(t.TempDir(), "test.db")
+	defer s.DB.Close()
+	s.Router.GET("/test/abort", func(c *gin.Context) {
+		c.Header("Content-Length", "1024")
+		c.Status(http.StatusOK)
+		_, _ = c.Writer.Write(make([]byte, 512))
+		c.Writer.Flush()
+		abortResponse("test", errors.New("write failed"))
+	})
+	s.Router.GET("/test/panic", func(c *gin.Context) {
+		panic("test")
+	})
+	server := httptest.NewServer(s.Router)
+	defer server.Close()
+
+	// The client sees that the body is incomplete.
+	resp, err := http.Get(server.URL + "/test/abort")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = io.ReadAll(resp.Body)
+	assert.Error(t, err)
+	resp.Body.Close()
+
+	resp, err = http.Get(server.URL + "/test/panic")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	resp.Body.Close()
+}
+
+func TestBackup(t *testing.T) {
+	s := &ChartographerService{CompactInterval: -1}
+	path := t.TempDir()
+	s.Initialize(path, "chartas.db")
+
+	var ids []string
+	var images [][]byte
+	for i, size := range []image.Point{{200, 150}, {80, 60}} {
+		response := serveTestRequest(s.Router, "POST", fmt.Sprintf("/chartas/?width=%d&height=%d", size.X, size.Y), nil)
+		assert.Equal(t, http.StatusCreated, response.Code)
+		id := response.Body.String()
+		for j := 0; j <= i; j++ {
+			buf := new(bytes.Buffer)
+			assert.NoError(t, bmp.Encode(buf, createNoiseImage(50, 40)))
+			url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=50&height=40", id, 10*j, 5*j)
+			assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "POST", url, buf.Bytes()).Code)
+		}
+		url := fmt.Sprintf("/chartas/%s/?x=0&y=0&width=%d&height=%d", id, size.X, size.Y)
+		ids = append(ids, id)
+		images = append(images, serveTestRequest(s.Router, "GET", url, nil).Body.Bytes())
+	}
+
+	response := serveTestRequest(s.Router, "GET", "/admin/backup", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "application/x-tar", response.Header().Get("Content-Type"))
+	archive := response.Body.Bytes()
+	_, err := os.Stat(filepath.Join(path, "snapshots"))
+	assert.NoError(t, err)
+	entries, err := os.ReadDir(filepath.Join(path, "snapshots"))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Changes after the backup are not in it.
+	assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "DELETE", fmt.Sprintf("/chartas/%s/", ids[0]), nil).Code)
+
+	restored := filepath.Join(t.TempDir(), "restored")
+	file := filepath.Join(t.TempDir(), "backup.tar")
+	assert.NoError(t, os.WriteFile(file, archive, 0644))
+	assert.Equal(t, 0, restoreCommand(&ChartographerService{}, []string{file, restored}, nil))
+
+	rs := &ChartographerService{CompactInterval: -1}
+	rs.Initialize(restored, "chartas.db")
+	for i, id := range ids {
+		var charta Charta
+		assert.NoError(t, rs.DB.View(func(tx *bolt.Tx) error {
+			return json.Unmarshal(tx.Bucket([]byte("chartas")).Get([]byte(id)), &charta)
+		}))
+		url := fmt.Sprintf("/chartas/%s/?x=0&y=0&width=%d&height=%d", id, charta.Width, charta.Height)
+		assert.Equal(t, images[i], serveTestRequest(rs.Router, "GET", url, nil).Body.Bytes())
+	}
+	response = serveTestRequest(rs.Router, "GET", fmt.Sprintf("/chartas/%s/fragments", ids[1]), nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var fragments []FragmentRecord
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &fragments))
+	assert.Len(t, fragments, 2)
+	assert.NoError(t, rs.DB.Close())
+
+	// Only empty directories are restored into, and broken archives leave
+	// nothing behind.
+	assert.Equal(t, 1, restoreCommand(&ChartographerService{}, []string{file, restored}, nil))
+	broken := t.TempDir()
+	assert.Equal(t, 1, restoreCommand(&ChartographerService{}, []string{"-", broken}, bytes.NewReader(archive[:len(archive)/2])))
+	entries, err = os.ReadDir(broken)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// A stopped service is backed up from its directory.
+	assert.NoError(t, s.DB.Close())
+	out := new(bytes.Buffer)
+	assert.Equal(t, 0, backupCommand(&ChartographerService{}, []string{path, "-"}, out))
+	restored = t.TempDir()
+	manifest, err := restoreBackup(out, restored)
+	assert.NoError(t, err)
+	assert.Equal(t, "chartas.db", manifest.Database)
+	_, err = os.Stat(filepath.Join(restored, "chartas", ids[1]+".png"))
+	assert.NoError(t, err)
+}
+
+func TestBackupCommandAuth(t *testing.T) {
+	s := &ChartographerService{CompactInterval: -1, Auth: true}
+	s.Initialize(t.TempDir(), "chartas.db")
+	defer s.DB.Close()
+	var root, alice *NewAPIKey
+	assert.NoError(t, s.DB.Update(func(tx *bolt.Tx) (err error) {
+		if root, err = createAPIKey(tx, &APIKeyQuery{Name: "root", Admin: true}); err != nil {
+			return err
+		}
+		alice, err = createAPIKey(tx, &APIKeyQuery{Name: "alice", Project: "maps"})
+		return err
+	}))
+	server := httptest.NewServer(s.Router)
+	defer server.Close()
+
+	t.Setenv("CHARTOGRAPHER_API_KEY", "")
+	assert.Equal(t, 1, backupCommand(&ChartographerService{}, []string{server.URL, "-"}, new(bytes.Buffer)))
+	assert.Equal(t, 1, backupCommand(&ChartographerService{}, []string{"-key", alice.Key, server.URL, "-"}, new(bytes.Buffer)))
+	assert.Equal(t, 2, backupCommand(&ChartographerService{}, []string{"-key", root.Key, server.URL}, new(bytes.Buffer)))
+
+	out := new(bytes.Buffer)
+	assert.Equal(t, 0, backupCommand(&ChartographerService{}, []string{"-key", root.Key, server.URL, "-"}, out))
+	manifest, err := restoreBackup(out, t.TempDir())
+	assert.NoError(t, err)
+	assert.Equal(t, "chartas.db", manifest.Database)
+
+	t.Setenv("CHARTOGRAPHER_API_KEY", root.Key)
+	out.Reset()
+	assert.Equal(t, 0, backupCommand(&ChartographerService{}, []string{server.URL, "-"}, out))
+	_, err = restoreBackup(out, t.TempDir())
+	assert.NoError(t, err)
+}
+
+func TestChartaArchive(t *testing.T) {
+	id := createTestCharta(t, 300, 200)
+	defer deleteTestCharta(t, id)
+	for i := 0; i < 3; i++ {
+		url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, 40*i, 30*i, 100, 80)
+		assert.Equal(t, http.StatusOK, postTestFragment(url, createNoiseImage(100, 80)).Code)
+	}
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("/chartas/%s/fragments/2", id), nil)
+	response := httptest.NewRecorder()
+	cs.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = serveTestRequest(cs.Router, "GET", fmt.Sprintf("/chartas/%s/archive", id), nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "application/zip", response.Header().Get("Content-Type"))
+	archive := response.Body.Bytes()
+
+	// The archive is imported into another service.
+	s := &ChartographerService{Storage: "mmap", CompactInterval: -1}
+	s.Initialize(t.TempDir(), "test.db")
+	defer s.DB.Close()
+	serveTestRequest(s.Router, "POST", "/chartas/?width=10&height=10", nil)
+
+	response = serveTestRequest(s.Router, "POST", "/chartas/import", archive)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	imported := response.Body.String()
+	assert.Equal(t, "2", imported)
+
+	region := "?x=-10&y=-10&width=320&height=220"
+	expected := serveTestRequest(cs.Router, "GET", fmt.Sprintf("/chartas/%s/%s", id, region), nil).Body.Bytes()
+	assert.Equal(t, expected, serveTestRequest(s.Router, "GET", fmt.Sprintf("/chartas/%s/%s", imported, region), nil).Body.Bytes())
+	fragments := func(s *ChartographerService, id string) []FragmentRecord {
+		response := serveTestRequest(s.Router, "GET", fmt.Sprintf("/chartas/%s/fragments", id), nil)
+		assert.Equal(t, http.StatusOK, response.Code)
+		var records []FragmentRecord
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &records))
+		for i := range records {
+			records[i].ChartaId = ""
+		}
+		return records
+	}
+	assert.Equal(t, fragments(&cs, id), fragments(s, imported))
+
+	// The history works as before: new fragments get new ids and deleting
+	// one recomposites from the imported fragments.
+	buf := new(bytes.Buffer)
+	assert.NoError(t, bmp.Encode(buf, createNoiseImage(50, 50)))
+	url := fmt.Sprintf("/chartas/%s/?x=0&y=0&width=50&height=50", imported)
+	assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "POST", url, buf.Bytes()).Code)
+	records := fragments(s, imported)
+	assert.Equal(t, "4", records[len(records)-1].Id)
+	assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "DELETE", fmt.Sprintf("/chartas/%s/fragments/4", imported), nil).Code)
+	assert.Equal(t, expected, serveTestRequest(s.Router, "GET", fmt.Sprintf("/chartas/%s/%s", imported, region), nil).Body.Bytes())
+
+	assert.Equal(t, http.StatusNotFound, serveTestRequest(cs.Router, "GET", "/chartas/1000000/archive", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(s.Router, "POST", "/chartas/import", archive[:len(archive)/2]).Code)
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(s.Router, "POST", "/chartas/import", []byte("not a zip")).Code)
+
+	// Records that don't fit the charta or the images are rejected.
+	rewrite := func(change func(name string, data []byte) []byte) []byte {
+		zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		assert.NoError(t, err)
+		buf := new(bytes.Buffer)
+		zw := zip.NewWriter(buf)
+		for _, f := range zr.File {
+			r, err := f.Open()
+			assert.NoError(t, err)
+			data, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			r.Close()
+			w, err := zw.Create(f.Name)
+			assert.NoError(t, err)
+			_, err = w.Write(change(f.Name, data))
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, zw.Close())
+		return buf.Bytes()
+	}
+	changeRecords := func(change func(records []FragmentRecord)) []byte {
+		return rewrite(func(name string, data []byte) []byte {
+			if name != "fragments.json" {
+				return data
+			}
+			var records []FragmentRecord
+			assert.NoError(t, json.Unmarshal(data, &records))
+			change(records)
+			data, err := json.Marshal(records)
+			assert.NoError(t, err)
+			return data
+		})
+	}
+	assert.Equal(t, http.StatusCreated, serveTestRequest(s.Router, "POST", "/chartas/import", changeRecords(func([]FragmentRecord) {})).Code)
+	for name, change := range map[string]func(records []FragmentRecord){
+		"huge":      func(records []FragmentRecord) { records[0].Width, records[0].Height = 1<<30, 1<<30 },
+		"outside":   func(records []FragmentRecord) { records[0].X = -1 },
+		"mode":      func(records []FragmentRecord) { records[0].Mode = "xor" },
+		"feather":   func(records []FragmentRecord) { records[0].Feather = -1 },
+		"z":         func(records []FragmentRecord) { records[0].Z = 0 },
+		"same z":    func(records []FragmentRecord) { records[1].Z = records[0].Z },
+		"z too big": func(records []FragmentRecord) { records[0].Z = 1000 },
+	} {
+		assert.Equal(t, http.StatusBadRequest, serveTestRequest(s.Router, "POST", "/chartas/import", changeRecords(change)).Code, name)
+	}
+	small := new(bytes.Buffer)
+	assert.NoError(t, png.Encode(small, createNoiseImage(10, 10)))
+	resized := rewrite(func(name string, data []byte) []byte {
+		if name == "fragments/1.png" {
+			return small.Bytes()
+		}
+		return data
+	})
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(s.Router, "POST", "/chartas/import", resized).Code)
+	leftovers, err := filepath.Glob(filepath.Join(s.pathName, "archive-*"))
+	assert.NoError(t, err)
+	assert.Empty(t, leftovers)
+
+	// The archive is written after its transaction, from the files opened
+	// in it.
+	var snapshot *archiveSnapshot
+	assert.NoError(t, s.DB.View(func(tx *bolt.Tx) error {
+		charta, err := getCharta(tx, imported)
+		if err != nil {
+			return err
+		}
+		snapshot, err = s.openArchiveSnapshot(tx, charta)
+		return err
+	}))
+	assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "DELETE", fmt.Sprintf("/chartas/%s/fragments/1", imported), nil).Code)
+	buf = new(bytes.Buffer)
+	assert.NoError(t, snapshot.writeArchive(buf))
+	snapshot.Close()
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.NoError(t, err)
+	names := map[string]bool{}
+	for _, f := range zr.File {
+		names[f.Name] = true
+	}
+	assert.True(t, names["fragments/1.png"])
+
+	// A download that fails halfway is aborted.
+	fragment := s.fragmentFilename(imported, "3")
+	assert.NoError(t, os.Remove(fragment))
+	assert.NoError(t, os.Mkdir(fragment, 0755))
+	server := httptest.NewServer(s.Router)
+	defer server.Close()
+	resp, err := http.Get(fmt.Sprintf("%s/chartas/%s/archive", server.URL, imported))
+	if assert.NoError(t, err) {
+		_, err = io.ReadAll(resp.Body)
+		assert.Error(t, err)
+		resp.Body.Close()
+	}
+}
+
+func TestTrash(t *testing.T) {
+	s := &ChartographerService{CompactInterval: -1}
+	s.Initialize(t.TempDir(), "test.db")
+	defer s.DB.Close()
+
+	response := serveTestRequest(s.Router, "POST", "/chartas/?width=200&height=100", nil)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	id := response.Body.String()
+	buf := new(bytes.Buffer)
+	assert.NoError(t, bmp.Encode(buf, createNoiseImage(50, 50)))
+	assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "POST", fmt.Sprintf("/chartas/%s/?x=10&y=10&width=50&height=50", id), buf.Bytes()).Code)
+	region := fmt.Sprintf("/chartas/%s/?x=0&y=0&width=200&height=100", id)
+	expected := serveTestRequest(s.Router, "GET", region, nil).Body.Bytes()
+
+	trash := func() []TrashEntry {
+		response := serveTestRequest(s.Router, "GET", "/trash", nil)
+		assert.Equal(t, http.StatusOK, response.Code)
+		var entries []TrashEntry
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &entries))
+		return entries
+	}
+	purge := func(query string) *PurgeStats {
+		job := waitServiceJob(t, s, serveTestRequest(s.Router, "POST", "/admin/purge"+query, nil))
+		assert.Equal(t, JobDone, job.Status)
+		var stats PurgeStats
+		assert.NoError(t, json.Unmarshal(job.Result, &stats))
+		return &stats
+	}
+
+	assert.Empty(t, trash())
+	assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "DELETE", fmt.Sprintf("/chartas/%s/", id), nil).Code)
+	assert.Equal(t, http.StatusNotFound, serveTestRequest(s.Router, "GET", region, nil).Code)
+	entries := trash()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, id, entries[0].Id)
+	assert.Equal(t, 200, entries[0].Width)
+	assert.Equal(t, defaultTrashRetention, entries[0].Expires.Sub(entries[0].DeletedAt))
+
+	// The trash is not reported by fsck and not purged before it expires.
+	result, err := s.fsck(context.Background(), FsckReport, func(float64) {})
+	assert.NoError(t, err)
+	assert.Empty(t, result.Problems)
+	assert.Equal(t, &PurgeStats{Trash: 1}, purge(""))
+
+	// A restored charta keeps its id, pixels and history.
+	assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "POST", fmt.Sprintf("/chartas/%s/restore", id), nil).Code)
+	assert.Empty(t, trash())
+	assert.Equal(t, expected, serveTestRequest(s.Router, "GET", region, nil).Body.Bytes())
+	assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "DELETE", fmt.Sprintf("/chartas/%s/fragments/1", id), nil).Code)
+	assert.Equal(t, http.StatusNotFound, serveTestRequest(s.Router, "POST", fmt.Sprintf("/chartas/%s/restore", id), nil).Code)
+
+	assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "DELETE", fmt.Sprintf("/chartas/%s/", id), nil).Code)
+	assert.Equal(t, &PurgeStats{Purged: 1}, purge("?all=true"))
+	assert.Empty(t, trash())
+	assert.Equal(t, http.StatusNotFound, serveTestRequest(s.Router, "POST", fmt.Sprintf("/chartas/%s/restore", id), nil).Code)
+	_, err = os.Stat(filepath.Join(s.pathName, "chartas", id+".png"))
+	assert.True(t, os.IsNotExist(err))
+
+	// A charta keeps its lifetime in the trash unless it has run out.
+	restore := func(ttl string) *time.Time {
+		response := serveTestRequest(s.Router, "POST", "/chartas/?width=10&height=10&ttl="+ttl, nil)
+		assert.Equal(t, http.StatusCreated, response.Code)
+		id := response.Body.String()
+		assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "DELETE", fmt.Sprintf("/chartas/%s/", id), nil).Code)
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "POST", fmt.Sprintf("/chartas/%s/restore", id), nil).Code)
+		response = serveTestRequest(s.Router, "GET", fmt.Sprintf("/chartas/%s/meta", id), nil)
+		assert.Equal(t, http.StatusOK, response.Code)
+		var charta Charta
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &charta))
+		return charta.Expires
+	}
+	assert.NotNil(t, restore("1h"))
+	assert.Nil(t, restore("1ms"))
+
+	// Expired chartas are purged, hard deletes skip the trash.
+	s.TrashRetention = time.Nanosecond
+	for i := 0; i < 2; i++ {
+		response = serveTestRequest(s.Router, "POST", "/chartas/?width=10&height=10", nil)
+		assert.Equal(t, http.StatusCreated, response.Code)
+		id = response.Body.String()
+		assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "DELETE", fmt.Sprintf("/chartas/%s/?hard=%t", id, i == 1), nil).Code)
+	}
+	assert.Len(t, trash(), 1)
+	assert.Equal(t, &PurgeStats{Purged: 1}, purge(""))
+	assert.Empty(t, trash())
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(s.Router, "DELETE", fmt.Sprintf("/chartas/%s/?hard=maybe", id), nil).Code)
+}
+
+func TestChartaExpiry(t *testing.T) {
+	s := &ChartographerService{CompactInterval: -1}
+	s.Initialize(t.TempDir(), "test.db")
+	defer s.DB.Close()
+
+	meta := func(id string) *Charta {
+		response := serveTestRequest(s.Router, "GET", fmt.Sprintf("/chartas/%s/meta", id), nil)
+		assert.Equal(t, http.StatusOK, response.Code)
+		var charta Charta
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &charta))
+		return &charta
+	}
+	create := func(query string) string {
+		response := serveTestRequest(s.Router, "POST", "/chartas/?width=100&height=50"+query, nil)
+		assert.Equal(t, http.StatusCreated, response.Code)
+		return response.Body.String()
+	}
+
+	before := time.Now()
+	id := create("&ttl=1h")
+	charta := meta(id)
+	assert.Equal(t, 100, charta.Width)
+	assert.WithinDuration(t, before.Add(time.Hour), *charta.Expires, time.Minute)
+	assert.Nil(t, meta(create("")).Expires)
+	expires := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	assert.True(t, expires.Equal(*meta(create("&expires=" + expires.Format(time.RFC3339))).Expires))
+
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	for _, query := range []string{"&ttl=-1h", "&ttl=soon", "&expires=" + past, "&expires=tomorrow", "&ttl=1h&expires=" + expires.Format(time.RFC3339), "&persist=true"} {
+		assert.Equal(t, http.StatusBadRequest, serveTestRequest(s.Router, "POST", "/chartas/?width=100&height=50"+query, nil).Code, query)
+	}
+
+	// PATCH extends or removes the expiry, with or without resizing.
+	response := serveTestRequest(s.Router, "PATCH", fmt.Sprintf("/chartas/%s/?ttl=72h", id), nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	charta = meta(id)
+	assert.Equal(t, 100, charta.Width)
+	assert.WithinDuration(t, before.Add(72*time.Hour), *charta.Expires, time.Minute)
+	assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "PATCH", fmt.Sprintf("/chartas/%s/?width=120&height=60&ttl=2h", id), nil).Code)
+	charta = meta(id)
+	assert.Equal(t, 120, charta.Width)
+	assert.WithinDuration(t, before.Add(2*time.Hour), *charta.Expires, time.Minute)
+	assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "PATCH", fmt.Sprintf("/chartas/%s/?persist=true", id), nil).Code)
+	assert.Nil(t, meta(id).Expires)
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(s.Router, "PATCH", fmt.Sprintf("/chartas/%s/?width=120&ttl=2h", id), nil).Code)
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(s.Router, "PATCH", fmt.Sprintf("/chartas/%s/", id), nil).Code)
+	assert.Equal(t, http.StatusNotFound, serveTestRequest(s.Router, "PATCH", "/chartas/1000/?ttl=1h", nil).Code)
+
+	// A charta restored from the trash keeps its expiry and project.
+	req, _ := http.NewRequest("POST", "/chartas/?width=100&height=50&ttl=1h", nil)
+	req.Header.Set(projectHeader, "maps")
+	response = httptest.NewRecorder()
+	s.Router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	trashed := response.Body.String()
+	charta = meta(trashed)
+	assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "DELETE", fmt.Sprintf("/chartas/%s/", trashed), nil).Code)
+	assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "POST", fmt.Sprintf("/chartas/%s/restore", trashed), nil).Code)
+	assert.Equal(t, charta, meta(trashed))
+	assert.Equal(t, "maps", charta.Project)
+	assert.NotNil(t, charta.Expires)
+
+	// Expired chartas are deleted with their files.
+	expired := create("&ttl=1ns")
+	buf := new(bytes.Buffer)
+	assert.NoError(t, bmp.Encode(buf, createNoiseImage(20, 20)))
+	assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "POST", fmt.Sprintf("/chartas/%s/?x=0&y=0&width=20&height=20", expired), buf.Bytes()).Code)
+	stats, err := s.expireChartas(context.Background(), func(float64) {})
+	assert.NoError(t, err)
+	assert.Equal(t, &ExpiryStats{Expired: 1}, stats)
+	assert.Equal(t, http.StatusNotFound, serveTestRequest(s.Router, "GET", fmt.Sprintf("/chartas/%s/meta", expired), nil).Code)
+	_, err = os.Stat(filepath.Join(s.pathName, "chartas", expired+".png"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(s.pathName, "fragments", expired))
+	assert.True(t, os.IsNotExist(err))
+	meta(id)
+}
+
+func TestQuotas(t *testing.T) {
+	s := &ChartographerService{CompactInterval: -1, Quota: Quota{Chartas: 3}}
+	s.Initialize(t.TempDir(), "test.db")
+	defer s.DB.Close()
+
+	serve := func(project, method, url string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+		req.Header.Set("X-Project", project)
+		response := httptest.NewRecorder()
+		s.Router.ServeHTTP(response, req)
+		return response
+	}
+	create := func(project string, width, height, code int) string {
+		response := serve(project, "POST", fmt.Sprintf("/chartas/?width=%d&height=%d", width, height), nil)
+		assert.Equal(t, code, response.Code)
+		return response.Body.String()
+	}
+	usage := func(project string) *ProjectUsage {
+		response := serve(project, "GET", "/usage", nil)
+		assert.Equal(t, http.StatusOK, response.Code)
+		var usage ProjectUsage
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &usage))
+		return &usage
+	}
+
+	assert.Equal(t, http.StatusOK, serve("", "PUT", "/admin/quotas/a?chartas=2&pixels=10000", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, serve("", "PUT", "/admin/quotas/a?pixels=-1", nil).Code)
+	id := create("a", 50, 100, http.StatusCreated)
+	create("a", 100, 60, http.StatusInsufficientStorage)
+	small := create("a", 50, 50, http.StatusCreated)
+	create("a", 10, 10, http.StatusForbidden)
+	u := usage("a")
+	assert.Equal(t, "a", u.Project)
+	assert.Equal(t, int64(2), u.Usage.Chartas)
+	assert.Equal(t, int64(7500), u.Usage.Pixels)
+	assert.Greater(t, u.Usage.Bytes, int64(0))
+	assert.Equal(t, Quota{Chartas: 2, Pixels: 10000}, u.Limits)
+
+	// Other projects have the default quota.
+	for i := 0; i < 3; i++ {
+		create("b", 1000, 1000, http.StatusCreated)
+	}
+	create("b", 10, 10, http.StatusForbidden)
+	assert.Equal(t, Quota{Chartas: 3}, usage("b").Limits)
+	assert.Equal(t, int64(0), usage("").Usage.Chartas)
+
+	// Growing, cloning, importing and restoring count too.
+	assert.Equal(t, http.StatusInsufficientStorage, serve("a", "PATCH", fmt.Sprintf("/chartas/%s/?width=100&height=100", id), nil).Code)
+	assert.Equal(t, http.StatusOK, serve("a", "PATCH", fmt.Sprintf("/chartas/%s/?width=50&height=50", id), nil).Code)
+	assert.Equal(t, http.StatusForbidden, serve("a", "POST", fmt.Sprintf("/chartas/%s/clone", id), nil).Code)
+	buf := new(bytes.Buffer)
+	assert.NoError(t, png.Encode(buf, createNoiseImage(20, 20)))
+	assert.Equal(t, http.StatusForbidden, serve("a", "POST", "/chartas/?import=true", buf.Bytes()).Code)
+	assert.Equal(t, http.StatusOK, serve("a", "DELETE", fmt.Sprintf("/chartas/%s/", id), nil).Code)
+	assert.Equal(t, http.StatusCreated, serve("a", "POST", "/chartas/?import=true", buf.Bytes()).Code)
+	assert.Equal(t, http.StatusForbidden, serve("a", "POST", fmt.Sprintf("/chartas/%s/restore", id), nil).Code)
+	assert.Equal(t, int64(2), usage("a").Usage.Chartas)
+
+	// A project over its disk space limit can't add more.
+	assert.Equal(t, http.StatusOK, serve("", "PUT", "/admin/quotas/c?bytes=1", nil).Code)
+	c := create("c", 10, 10, http.StatusCreated)
+	create("c", 10, 10, http.StatusInsufficientStorage)
+	fragment := new(bytes.Buffer)
+	assert.NoError(t, bmp.Encode(fragment, createSolidImage(5, 5, color.NRGBA{R: 255, A: 255})))
+	assert.Equal(t, http.StatusInsufficientStorage, serve("c", "POST", fmt.Sprintf("/chartas/%s/?x=0&y=0&width=5&height=5", c), fragment.Bytes()).Code)
+
+	// Lowering a limit below the usage only stops what would add more.
+	assert.Equal(t, http.StatusOK, serve("", "PUT", "/admin/quotas/a?chartas=1&pixels=100", nil).Code)
+	fragment.Reset()
+	assert.NoError(t, bmp.Encode(fragment, createSolidImage(5, 5, color.NRGBA{R: 255, A: 255})))
+	assert.Equal(t, http.StatusOK, serve("a", "POST", fmt.Sprintf("/chartas/%s/?x=0&y=0&width=5&height=5", small), fragment.Bytes()).Code)
+	assert.Equal(t, http.StatusOK, serve("a", "PATCH", fmt.Sprintf("/chartas/%s/?width=40&height=40", small), nil).Code)
+	assert.Equal(t, http.StatusInsufficientStorage, serve("a", "PATCH", fmt.Sprintf("/chartas/%s/?width=50&height=50", small), nil).Code)
+	create("a", 1, 1, http.StatusForbidden)
+
+	assert.Equal(t, http.StatusOK, serve("", "DELETE", "/admin/quotas/a", nil).Code)
+	response := serve("", "GET", "/admin/quotas/a", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var a ProjectUsage
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &a))
+	assert.Equal(t, Quota{Chartas: 3}, a.Limits)
+	assert.Equal(t, int64(2), a.Usage.Chartas)
+}
+
+func TestFragmentImagesCommit(t *testing.T) {
+	s := &ChartographerService{CompactInterval: -1}
+	s.Initialize(t.TempDir(), "test.db")
+	defer s.DB.Close()
+
+	response := serveTestRequest(s.Router, "POST", "/chartas/?width=50&height=50", nil)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	id := response.Body.String()
+	buf := new(bytes.Buffer)
+	assert.NoError(t, bmp.Encode(buf, createNoiseImage(20, 20)))
+	for i := 0; i < 2; i++ {
+		url := fmt.Sprintf("/chartas/%s/?x=%d&y=0&width=20&height=20", id, 10*i)
+		assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "POST", url, buf.Bytes()).Code)
+	}
+	first, second := s.fragmentFilename(id, "1"), s.fragmentFilename(id, "2")
+	before, err := os.ReadFile(first)
+	assert.NoError(t, err)
+
+	// A failed transaction leaves the images as they were.
+	err = s.updateFragments(func(tx *bolt.Tx, images *fragmentImages) error {
+		if _, err := images.write(&FragmentRecord{ChartaId: id, Id: "1"}, createNoiseImage(5, 5)); err != nil {
+			return err
+		}
+		images.remove(&FragmentRecord{ChartaId: id, Id: "2"})
+		return errors.New("failed")
+	})
+	assert.Error(t, err)
+	after, err := os.ReadFile(first)
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+	assert.FileExists(t, second)
+	staged, err := filepath.Glob(filepath.Join(s.pathName, "fragments", id, "*.tmp"))
+	assert.NoError(t, err)
+	assert.Empty(t, staged)
+
+	// A committed one applies the changes.
+	assert.NoError(t, s.updateFragments(func(tx *bolt.Tx, images *fragmentImages) error {
+		if _, err := images.write(&FragmentRecord{ChartaId: id, Id: "1"}, createNoiseImage(5, 5)); err != nil {
+			return err
+		}
+		images.remove(&FragmentRecord{ChartaId: id, Id: "2"})
+		return nil
+	}))
+	after, err = os.ReadFile(first)
+	assert.NoError(t, err)
+	assert.NotEqual(t, before, after)
+	assert.NoFileExists(t, second)
+}
+
+func TestUsageCounters(t *testing.T) {
+	s := &ChartographerService{CompactInterval: -1}
+	s.Initialize(t.TempDir(), "test.db")
+	defer s.DB.Close()
+
+	serve := func(method, url string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+		req.Header.Set("X-Project", "p")
+		response := httptest.NewRecorder()
+		s.Router.ServeHTTP(response, req)
+		return response
+	}
+	// The counters must match what a fresh count of the storage gives.
+	check := func(step string, chartas int64) {
+		var counted, recounted Quota
+		assert.NoError(t, s.DB.View(func(tx *bolt.Tx) (err error) {
+			counted, err = getProjectUsage(tx, "p")
+			return err
+		}), step)
+		assert.NoError(t, s.DB.Update(func(tx *bolt.Tx) error {
+			for _, name := range []string{"usage", "charta-usage"} {
+				if err := tx.DeleteBucket([]byte(name)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}), step)
+		assert.NoError(t, s.countUsage(), step)
+		assert.NoError(t, s.DB.View(func(tx *bolt.Tx) (err error) {
+			recounted, err = getProjectUsage(tx, "p")
+			return err
+		}), step)
+		assert.Equal(t, recounted, counted, step)
+		assert.Equal(t, chartas, counted.Chartas, step)
+	}
+	// Files shared through hard links count once.
+	onDisk := func(step string) {
+		var size int64
+		seen := map[string]bool{}
+		for _, dir := range []string{"chartas", "fragments"} {
+			assert.NoError(t, filepath.WalkDir(filepath.Join(s.pathName, dir), func(path string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				if key := fileKey(info); key == "" || !seen[key] {
+					seen[key] = true
+					size += info.Size()
+				}
+				return nil
+			}), step)
+		}
+		var counted Quota
+		assert.NoError(t, s.DB.View(func(tx *bolt.Tx) (err error) {
+			counted, err = getProjectUsage(tx, "p")
+			return err
+		}), step)
+		if runtime.GOOS == "linux" {
+			// Shares are rounded down, by less than a byte per link.
+			assert.InDelta(t, size, counted.Bytes, float64(3*len(seen)), step)
+			assert.LessOrEqual(t, counted.Bytes, size, step)
+		}
+	}
+	addFragment := func(id string) {
+		buf := new(bytes.Buffer)
+		assert.NoError(t, bmp.Encode(buf, createNoiseImage(20, 20)))
+		assert.Equal(t, http.StatusOK, serve("POST", fmt.Sprintf("/chartas/%s/?x=5&y=5&width=20&height=20", id), buf.Bytes()).Code)
+	}
+
+	response := serve("POST", "/chartas/?width=100&height=100", nil)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	id := response.Body.String()
+	check("create", 1)
+
+	for i := 0; i < 2; i++ {
+		buf := new(bytes.Buffer)
+		assert.NoError(t, bmp.Encode(buf, createNoiseImage(40, 40)))
+		response = serve("POST", fmt.Sprintf("/chartas/%s/?x=%d&y=10&width=40&height=40", id, 20*i), buf.Bytes())
+		assert.Equal(t, http.StatusOK, response.Code)
+	}
+	check("add", 1)
+
+	response = serve("GET", fmt.Sprintf("/chartas/%s/fragments", id), nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var records []FragmentRecord
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &records))
+	assert.Len(t, records, 2)
+	assert.Equal(t, http.StatusOK, serve("DELETE", fmt.Sprintf("/chartas/%s/fragments/%s", id, records[0].Id), nil).Code)
+	check("delete fragment", 1)
+
+	assert.Equal(t, http.StatusOK, serve("PATCH", fmt.Sprintf("/chartas/%s/?width=60&height=70", id), nil).Code)
+	check("resize", 1)
+
+	response = serve("POST", fmt.Sprintf("/chartas/%s/clone", id), nil)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	clone := response.Body.String()
+	check("clone", 2)
+	onDisk("clone")
+	addFragment(clone)
+	check("write clone", 2)
+	onDisk("write clone")
+
+	// Changing the images the clone shares breaks their links once the
+	// change commits.
+	assert.Equal(t, http.StatusOK, serve("PATCH", fmt.Sprintf("/chartas/%s/?width=30&height=30", clone), nil).Code)
+	check("crop shared", 2)
+	onDisk("crop shared")
+	assert.Equal(t, http.StatusOK, serve("DELETE", fmt.Sprintf("/chartas/%s/fragments/%s", clone, records[1].Id), nil).Code)
+	check("delete shared", 2)
+	onDisk("delete shared")
+
+	assert.Equal(t, http.StatusOK, serve("DELETE", fmt.Sprintf("/chartas/%s/", id), nil).Code)
+	check("trash", 1)
+	assert.Equal(t, http.StatusOK, serve("POST", fmt.Sprintf("/chartas/%s/restore", id), nil).Code)
+	check("restore", 2)
+	assert.Equal(t, http.StatusOK, serve("DELETE", fmt.Sprintf("/chartas/%s/?hard=true", clone), nil).Code)
+	check("purge", 1)
+	onDisk("purge")
+
+	buf := new(bytes.Buffer)
+	assert.NoError(t, png.Encode(buf, createNoiseImage(30, 30)))
+	response = serve("POST", "/chartas/?import=true", buf.Bytes())
+	assert.Equal(t, http.StatusCreated, response.Code)
+	imported := response.Body.String()
+	check("import", 2)
+	onDisk("import")
+	response = serve("POST", fmt.Sprintf("/chartas/%s/clone", imported), nil)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	clone = response.Body.String()
+	onDisk("clone import")
+	addFragment(imported)
+	check("write import", 3)
+	onDisk("write import")
+
+	// The clone takes over the files of a purged source.
+	assert.Equal(t, http.StatusOK, serve("DELETE", fmt.Sprintf("/chartas/%s/?hard=true", imported), nil).Code)
+	check("purge source", 2)
+	onDisk("purge source")
+}
+
+func TestAPIKeys(t *testing.T) {
+	path := t.TempDir()
+	out := new(bytes.Buffer)
+	assert.Equal(t, 0, apiKeyCommand(&ChartographerService{}, []string{"create", "-admin", path, "root"}, out))
+	var root NewAPIKey
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &root))
+	assert.True(t, root.Admin)
+	assert.Len(t, root.Key, 64)
+	assert.Equal(t, 1, apiKeyCommand(&ChartographerService{}, []string{"create", path, "root"}, new(bytes.Buffer)))
+	assert.Equal(t, 2, apiKeyCommand(&ChartographerService{}, []string{"create", path}, new(bytes.Buffer)))
+
+	s := &ChartographerService{CompactInterval: -1, Auth: true}
+	s.Initialize(path, "chartas.db")
+	serve := func(header, key, method, url string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+		if key != "" {
+			req.Header.Set(header, key)
+		}
+		req.Header.Set("X-Project", "other")
+		response := httptest.NewRecorder()
+		s.Router.ServeHTTP(response, req)
+		return response
+	}
+
+	response := serve("", "", "POST", "/chartas/?width=100&height=100", nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	assert.Equal(t, "Bearer", response.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, http.StatusUnauthorized, serve("X-API-Key", "wrong", "GET", "/trash", nil).Code)
+	assert.Equal(t, http.StatusOK, serve("Authorization", "Bearer "+root.Key, "GET", "/trash", nil).Code)
+
+	response = serve("X-API-Key", root.Key, "POST", "/admin/apikeys?name=alice&project=maps", nil)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	var alice NewAPIKey
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &alice))
+	assert.Equal(t, "maps", alice.Project)
+	assert.Equal(t, http.StatusConflict, serve("X-API-Key", root.Key, "POST", "/admin/apikeys?name=alice", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, serve("X-API-Key", root.Key, "POST", "/admin/apikeys", nil).Code)
+
+	// The key decides the project and is recorded as the creator.
+	response = serve("X-API-Key", alice.Key, "POST", "/chartas/?width=100&height=100", nil)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	id := response.Body.String()
+	buf := new(bytes.Buffer)
+	assert.NoError(t, bmp.Encode(buf, createNoiseImage(20, 20)))
+	assert.Equal(t, http.StatusOK, serve("X-API-Key", alice.Key, "POST", fmt.Sprintf("/chartas/%s/?x=0&y=0&width=20&height=20", id), buf.Bytes()).Code)
+	response = serve("X-API-Key", alice.Key, "GET", fmt.Sprintf("/chartas/%s/meta", id), nil)
+	var charta Charta
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &charta))
+	assert.Equal(t, "alice", charta.Creator)
+	assert.Equal(t, "maps", charta.Project)
+	response = serve("X-API-Key", alice.Key, "GET", fmt.Sprintf("/chartas/%s/fragments", id), nil)
+	var records []FragmentRecord
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &records))
+	assert.Equal(t, "alice", records[0].Creator)
+	response = serve("X-API-Key", root.Key, "POST", fmt.Sprintf("/chartas/%s/clone", id), nil)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	response = serve("X-API-Key", root.Key, "GET", fmt.Sprintf("/chartas/%s/meta", response.Body.String()), nil)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &charta))
+	assert.Equal(t, "root", charta.Creator)
+	assert.Equal(t, "other", charta.Project)
+
+	for _, route := range s.Router.Routes() {
+		if strings.HasPrefix(route.Path, "/admin/") {
+			url := strings.NewReplacer(":project", "maps", ":id", alice.Id).Replace(route.Path)
+			assert.Equal(t, http.StatusForbidden, serve("X-API-Key", alice.Key, route.Method, url, nil).Code, url)
+		}
+	}
+
+	// Commands don't wait for the running service.
+	started := time.Now()
+	assert.Equal(t, 1, apiKeyCommand(&ChartographerService{}, []string{"list", path}, new(bytes.Buffer)))
+	assert.Equal(t, 1, fsckCommand(&ChartographerService{}, []string{path}, new(bytes.Buffer)))
+	assert.Less(t, time.Since(started), 10*stoppedTimeout)
+	response = serve("X-API-Key", root.Key, "GET", "/admin/apikeys", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NotContains(t, response.Body.String(), alice.Key)
+	var keys []APIKey
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &keys))
+	assert.Len(t, keys, 2)
+
+	assert.Equal(t, http.StatusOK, serve("X-API-Key", root.Key, "DELETE", "/admin/apikeys/"+alice.Id, nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve("X-API-Key", root.Key, "DELETE", "/admin/apikeys/"+alice.Id, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("X-API-Key", alice.Key, "GET", fmt.Sprintf("/chartas/%s/meta", id), nil).Code)
+	assert.NoError(t, s.DB.Close())
+
+	assert.Equal(t, 0, apiKeyCommand(&ChartographerService{}, []string{"revoke", path, "root"}, new(bytes.Buffer)))
+	assert.Equal(t, 1, apiKeyCommand(&ChartographerService{}, []string{"revoke", path, "root"}, new(bytes.Buffer)))
+	out.Reset()
+	assert.Equal(t, 0, apiKeyCommand(&ChartographerService{}, []string{"list", path}, out))
+	assert.Equal(t, "[]\n", out.String())
+}
+
+func TestProjectIsolation(t *testing.T) {
+	s := &ChartographerService{CompactInterval: -1, Auth: true}
+	s.Initialize(t.TempDir(), "test.db")
+	defer s.DB.Close()
+
+	keys := map[string]*NewAPIKey{}
+	assert.NoError(t, s.DB.Update(func(tx *bolt.Tx) error {
+		for _, query := range []APIKeyQuery{{Name: "root", Admin: true}, {Name: "alice", Project: "maps"}, {Name: "bob", Project: "roads"}} {
+			key, err := createAPIKey(tx, &query)
+			if err != nil {
+				return err
+			}
+			keys[query.Name] = key
+		}
+		return nil
+	}))
+	serve := func(name, method, url string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+keys[name].Key)
+		response := httptest.NewRecorder()
+		s.Router.ServeHTTP(response, req)
+		return response
+	}
+	fragment := func() []byte {
+		buf := new(bytes.Buffer)
+		assert.NoError(t, bmp.Encode(buf, createNoiseImage(20, 20)))
+		return buf.Bytes()
+	}
+
+	response := serve("alice", "POST", "/chartas/?width=100&height=100", nil)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	id := response.Body.String()
+	assert.Equal(t, http.StatusOK, serve("alice", "POST", fmt.Sprintf("/chartas/%s/?x=0&y=0&width=20&height=20", id), fragment()).Code)
+	response = serve("bob", "POST", "/chartas/?width=100&height=100", nil)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	other := response.Body.String()
+
+	// The chartas of other projects don't exist for a key.
+	for _, request := range []struct {
+		method, url string
+		body        []byte
+	}{
+		{"GET", "/chartas/%s/?x=0&y=0&width=20&height=20", nil},
+		{"POST", "/chartas/%s/?x=0&y=0&width=20&height=20", fragment()},
+		{"PATCH", "/chartas/%s/?width=50&height=50", nil},
+		{"GET", "/chartas/%s/meta", nil},
+		{"GET", "/chartas/%s/fragments", nil},
+		{"GET", "/chartas/%s/provenance?x=0&y=0", nil},
+		{"POST", "/chartas/%s/clone", nil},
+		{"GET", "/chartas/%s/export?format=png", nil},
+		{"POST", "/chartas/%s/export?format=png", nil},
+		{"GET", "/chartas/%s/archive", nil},
+		{"DELETE", "/chartas/%s/", nil},
+	} {
+		url := fmt.Sprintf(request.url, id)
+		assert.Equal(t, http.StatusNotFound, serve("bob", request.method, url, request.body).Code, url)
+	}
+	assert.Equal(t, http.StatusNotFound, serve("bob", "POST", fmt.Sprintf("/chartas/%s/merge?from=%s", other, id), nil).Code)
+	assert.Equal(t, http.StatusOK, serve("root", "GET", fmt.Sprintf("/chartas/%s/meta", id), nil).Code)
+
+	// So are their jobs.
+	response = serve("alice", "POST", fmt.Sprintf("/chartas/%s/export?format=png", id), nil)
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	var job Job
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &job))
+	assert.Equal(t, "maps", job.Project)
+	for i := 0; i < 1000 && (job.Status == JobQueued || job.Status == JobRunning); i++ {
+		time.Sleep(10 * time.Millisecond)
+		response = serve("alice", "GET", "/jobs/"+job.Id, nil)
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &job))
+	}
+	assert.Equal(t, JobDone, job.Status)
+	assert.Equal(t, http.StatusNotFound, serve("bob", "GET", "/jobs/"+job.Id, nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve("bob", "GET", "/jobs/"+job.Id+"/result", nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve("bob", "DELETE", "/jobs/"+job.Id, nil).Code)
+	assert.Equal(t, http.StatusOK, serve("alice", "GET", "/jobs/"+job.Id+"/result", nil).Code)
+
+	// And their trash.
+	assert.Equal(t, http.StatusOK, serve("alice", "DELETE", fmt.Sprintf("/chartas/%s/", id), nil).Code)
+	trash := func(name string) []TrashEntry {
+		response := serve(name, "GET", "/trash", nil)
+		assert.Equal(t, http.StatusOK, response.Code)
+		var entries []TrashEntry
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &entries))
+		return entries
+	}
+	assert.Empty(t, trash("bob"))
+	assert.Len(t, trash("alice"), 1)
+	assert.Len(t, trash("root"), 1)
+	assert.Equal(t, http.StatusNotFound, serve("bob", "POST", fmt.Sprintf("/chartas/%s/restore", id), nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve("bob", "DELETE", fmt.Sprintf("/chartas/%s/?hard=true", id), nil).Code)
+	assert.Equal(t, http.StatusOK, serve("alice", "POST", fmt.Sprintf("/chartas/%s/restore", id), nil).Code)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"image"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// cloneFragments copies the fragment history of one charta to another one.
+// Fragment images are shared through hard links.
+func (cs *ChartographerService) cloneFragments(tx *bolt.Tx, srcId, dstId string) error {
+	records, err := findFragments(tx, srcId, image.Rectangle{})
+	if err != nil {
+		return err
+	}
+
+	if len(records) > 0 {
+		err = os.MkdirAll(fmt.Sprintf("%s/fragments/%s", cs.pathName, dstId), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range records {
+		record := records[i]
+		record.ChartaId = dstId
+		err = putFragmentRecord(tx, &record)
+		if err != nil {
+			return err
+		}
+
+		err = linkFile(cs.fragmentFilename(srcId, records[i].Id), cs.fragmentFilename(dstId, record.Id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	src := tx.Bucket([]byte("fragments")).Bucket([]byte(srcId))
+	dst := tx.Bucket([]byte("fragments")).Bucket([]byte(dstId))
+	if src == nil || dst == nil {
+		return nil
+	}
+	return dst.SetSequence(src.Sequence())
+}
+
+func (cs *ChartographerService) cloneChartaEndpoint(c *gin.Context) {
+	var clone Charta
+	err := cs.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("chartas"))
+
+		v := b.Get([]byte(c.Param("id")))
+		if v == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return nil
+		}
+
+		err := json.Unmarshal(v, &clone)
+		if err != nil {
+			return err
+		}
+		srcId := clone.Id
+		clone.Project = requestProject(c)
+		clone.Creator = requestCreator(c)
+		err = cs.checkQuota(tx, clone.Project, 1, int64(clone.Width)*int64(clone.Height))
+		if err != nil {
+			return err
+		}
+
+		id, _ := b.NextSequence()
+		clone.Id = strconv.Itoa(int(id))
+
+		err = cs.store.Copy(&Charta{Id: srcId, Width: clone.Width, Height: clone.Height, Generation: clone.Generation}, &clone)
+		if err != nil {
+			return err
+		}
+
+		err = cs.cloneFragments(tx, srcId, clone.Id)
+		if err != nil {
+			return err
+		}
+		err = cs.accountCharta(tx, &clone, 0)
+		if err != nil {
+			return err
+		}
+		err = cs.linkUsage(tx, srcId, clone.Id)
+		if err != nil {
+			return err
+		}
+
+		buf, err := json.Marshal(clone)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(clone.Id), buf)
+	})
+	if err != nil {
+		c.AbortWithStatus(quotaStatus(err))
+		return
+	}
+	if c.IsAborted() {
+		return
+	}
+
+	c.String(http.StatusCreated, clone.Id)
+}
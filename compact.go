@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCompactInterval = 10 * time.Minute
+	defaultCompactIdle     = 10 * time.Minute
+	defaultSweepInterval   = time.Minute
+)
+
+// Images are written without compression to keep fragment uploads fast. The
+// compactor recompresses the ones that haven't been written for a while.
+
+type CompactQuery struct {
+	Level int           `form:"level" binding:"omitempty,gte=1,lte=9"`
+	Idle  time.Duration `form:"idle" binding:"omitempty,gte=0"`
+}
+
+type CompactionStats struct {
+	Files       int   `json:"files"`
+	Compacted   int   `json:"compacted"`
+	Failed      int   `json:"failed"`
+	BytesBefore int64 `json:"bytesBefore"`
+	BytesAfter  int64 `json:"bytesAfter"`
+}
+
+// compactionRecord remembers the file a compaction produced, so the file is
+// not recompressed again until it is rewritten.
+type compactionRecord struct {
+	Level   int
+	Size    int64
+	ModTime time.Time
+}
+
+type DirectoryStats struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+type StorageStats struct {
+	Chartas   DirectoryStats `json:"chartas"`
+	Fragments DirectoryStats `json:"fragments"`
+	Jobs      DirectoryStats `json:"jobs"`
+	Tiles     DirectoryStats `json:"tiles"`
+	Database  int64          `json:"database"`
+	Total     int64          `json:"total"`
+}
+
+func (cs *ChartographerService) compactLevel() int {
+	if cs.CompactLevel == 0 {
+		return 6
+	}
+	return cs.CompactLevel
+}
+
+// startCompactor periodically compacts idle images in the background. A
+// negative CompactInterval disables it.
+func (cs *ChartographerService) startCompactor() {
+	interval := cs.CompactInterval
+	if interval < 0 {
+		return
+	}
+	if interval == 0 {
+		interval = defaultCompactInterval
+	}
+	idle := cs.CompactIdle
+	if idle == 0 {
+		idle = defaultCompactIdle
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			stats, err := cs.compact(context.Background(), cs.compactLevel(), idle, func(float64) {})
+			if err != nil {
+				log.Println("compaction:", err)
+				continue
+			}
+			if stats.Compacted > 0 {
+				log.Printf("compaction: %d files, %d -> %d bytes", stats.Compacted, stats.BytesBefore, stats.BytesAfter)
+			}
+		}
+	}()
+}
+
+// startSweeper periodically deletes expired chartas, purges the expired trash
+// and old finished jobs and collects unreferenced tiles in the background. A
+// negative SweepInterval disables it.
+func (cs *ChartographerService) startSweeper() {
+	interval := cs.SweepInterval
+	if interval < 0 {
+		return
+	}
+	if interval == 0 {
+		interval = defaultSweepInterval
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			cs.sweep(context.Background())
+		}
+	}()
+}
+
+// sweep runs each background cleanup once. A cleanup that fails is retried on
+// the next run and doesn't keep the others from running.
+func (cs *ChartographerService) sweep(ctx context.Context) {
+	if stats, err := cs.expireChartas(ctx, func(float64) {}); err != nil {
+		log.Println("expiry:", err)
+	} else if stats.Expired > 0 {
+		log.Printf("expiry: %d chartas deleted", stats.Expired)
+	}
+
+	if stats, err := cs.purgeTrash(ctx, false, func(float64) {}); err != nil {
+		log.Println("trash:", err)
+	} else if stats.Purged > 0 {
+		log.Printf("trash: %d chartas purged", stats.Purged)
+	}
+
+	if purged, err := cs.purgeJobs(ctx); err != nil {
+		log.Println("jobs:", err)
+	} else if purged > 0 {
+		log.Printf("jobs: %d finished jobs deleted", purged)
+	}
+
+	if stats, err := cs.collectTiles(ctx, defaultTileGCGrace, func(float64) {}); err != nil {
+		log.Println("tile gc:", err)
+	} else if stats.Collected > 0 {
+		log.Printf("tile gc: %d tiles, %d bytes freed", stats.Collected, stats.BytesFreed)
+	}
+}
+
+// compactableFiles lists the images of chartas and fragments relative to the
+// storage path.
+func (cs *ChartographerService) compactableFiles() ([]string, error) {
+	var files []string
+	for _, dir := range []string{"chartas", "fragments"} {
+		err := filepath.WalkDir(filepath.Join(cs.pathName, dir), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !strings.HasSuffix(path, ".png") {
+				return nil
+			}
+
+			rel, err := filepath.Rel(cs.pathName, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, rel)
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// compact recompresses every image that was last written more than idle ago
+// and isn't compacted at the given level yet. A file that can't be compacted
+// is logged and left as it is.
+func (cs *ChartographerService) compact(ctx context.Context, level int, idle time.Duration, progress func(float64)) (*CompactionStats, error) {
+	files, err := cs.compactableFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &CompactionStats{}
+	for i, file := range files {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		progress(float64(i) / float64(len(files)))
+
+		before, after, err := cs.compactFile(file, level, idle)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Printf("compaction: %s: %v", file, err)
+			stats.Failed++
+			continue
+		}
+
+		stats.Files++
+		if after != before {
+			stats.Compacted++
+			stats.BytesBefore += before
+			stats.BytesAfter += after
+		}
+	}
+
+	// Forget the files that were removed since their compaction.
+	err = cs.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("compaction"))
+		var stale [][]byte
+		err := b.ForEach(func(k, _ []byte) error {
+			if _, err := os.Stat(filepath.Join(cs.pathName, string(k))); os.IsNotExist(err) {
+				stale = append(stale, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err = b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+func getCompactionRecord(tx *bolt.Tx, file string) (*compactionRecord, error) {
+	v := tx.Bucket([]byte("compaction")).Get([]byte(file))
+	if v == nil {
+		return nil, nil
+	}
+
+	var record compactionRecord
+	err := json.Unmarshal(v, &record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// compactFile recompresses a single image. The new version is written without
+// holding a transaction; since images are only written inside update
+// transactions, it replaces the old one only if that is still unchanged.
+func (cs *ChartographerService) compactFile(file string, level int, idle time.Duration) (int64, int64, error) {
+	path := filepath.Join(cs.pathName, file)
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	if time.Since(info.ModTime()) < idle {
+		return info.Size(), info.Size(), nil
+	}
+
+	var record *compactionRecord
+	err = cs.DB.View(func(tx *bolt.Tx) error {
+		record, err = getCompactionRecord(tx, file)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if record != nil && record.Level == level && record.Size == info.Size() && record.ModTime.Equal(info.ModTime()) {
+		return info.Size(), info.Size(), nil
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(tmp.Name())
+	err = recompressPNG(in, tmp, level)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	compacted, err := os.Stat(tmp.Name())
+	if err != nil {
+		return 0, 0, err
+	}
+
+	after := info.Size()
+	err = cs.DB.Update(func(tx *bolt.Tx) error {
+		current, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if current.Size() != info.Size() || !current.ModTime().Equal(info.ModTime()) {
+			// Rewritten in the meantime, the next run will pick it up.
+			return nil
+		}
+
+		result := info
+		if compacted.Size() < info.Size() {
+			if err = os.Chmod(tmp.Name(), 0644); err != nil {
+				return err
+			}
+			if err = os.Rename(tmp.Name(), path); err != nil {
+				return err
+			}
+			if result, err = os.Stat(path); err != nil {
+				return err
+			}
+			// Clones and imports share images through hard links. The rename
+			// only replaces this link, so the others keep the old file and
+			// the charta stops sharing it.
+			after = result.Size()
+			if err = cs.accountFile(tx, file, after-sharedSize(current)); err != nil {
+				return err
+			}
+		}
+
+		buf, err := json.Marshal(compactionRecord{Level: level, Size: result.Size(), ModTime: result.ModTime()})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("compaction")).Put([]byte(file), buf)
+	})
+	return info.Size(), after, err
+}
+
+// recompressPNG copies a PNG row by row with the given compression level.
+func recompressPNG(r io.Reader, w io.Writer, level int) error {
+	pr, err := newPNGRowReader(r)
+	if err != nil {
+		return err
+	}
+	defer pr.Close()
+
+	width, height := pr.Size()
+	pw, err := newPNGRowWriter(w, width, height, level)
+	if err != nil {
+		return err
+	}
+
+	row := make([]byte, 4*width)
+	for y := 0; y < height; y++ {
+		if err = pr.ReadRow(row); err != nil {
+			return err
+		}
+		if err = pw.WriteRow(row); err != nil {
+			return err
+		}
+	}
+	return pw.Close()
+}
+
+func directoryStats(dir string) (DirectoryStats, error) {
+	var stats DirectoryStats
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		stats.Files++
+		stats.Bytes += info.Size()
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return stats, err
+}
+
+func (cs *ChartographerService) storageStats() (*StorageStats, error) {
+	var stats StorageStats
+	var err error
+	for dir, dirStats := range map[string]*DirectoryStats{
+		"chartas":   &stats.Chartas,
+		"fragments": &stats.Fragments,
+		"jobs":      &stats.Jobs,
+		"tiles":     &stats.Tiles,
+	} {
+		*dirStats, err = directoryStats(filepath.Join(cs.pathName, dir))
+		if err != nil {
+			return nil, err
+		}
+		stats.Total += dirStats.Bytes
+	}
+
+	info, err := os.Stat(cs.DB.Path())
+	if err != nil {
+		return nil, err
+	}
+	stats.Database = info.Size()
+	stats.Total += stats.Database
+	return &stats, nil
+}
+
+func (cs *ChartographerService) getStorageStatsEndpoint(c *gin.Context) {
+	stats, err := cs.storageStats()
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// compactEndpoint starts a compaction job. Unlike the background compactor it
+// compacts images regardless of their age unless idle is given.
+func (cs *ChartographerService) compactEndpoint(c *gin.Context) {
+	var query CompactQuery
+	if err := c.BindQuery(&query); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	level := query.Level
+	if level == 0 {
+		level = cs.compactLevel()
+	}
+
+	job, err := cs.submitJob("compact", "", "", func(ctx context.Context, job *Job, progress func(float64)) (interface{}, error) {
+		return cs.compact(ctx, level, query.Idle, progress)
+	})
+	cs.respondWithJob(c, job, err)
+}
@@ -0,0 +1,69 @@
+package main
+
+import "image"
+
+type Rect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type ConflictReport struct {
+	Overlap                *Rect   `json:"overlap"`
+	OverlapPixels          int     `json:"overlapPixels"`
+	DifferingPixels        int     `json:"differingPixels"`
+	MeanAbsoluteDifference float64 `json:"meanAbsoluteDifference"`
+}
+
+func newRect(r image.Rectangle) *Rect {
+	return &Rect{X: r.Min.X, Y: r.Min.Y, Width: r.Dx(), Height: r.Dy()}
+}
+
+// findConflicts compares src, placed into r like in blendFragment, with the
+// pixels of dst that are already restored. The overlap is the bounding box of
+// those pixels and the mean absolute difference is averaged over the RGB
+// channels of every overlapping pixel.
+func findConflicts(dst *image.NRGBA, r image.Rectangle, src *image.NRGBA, sp image.Point) ConflictReport {
+	var report ConflictReport
+
+	r, sp = clipPlacement(dst, r, src, sp)
+	if r.Empty() {
+		return report
+	}
+
+	overlap := image.Rectangle{}
+	var diffSum int
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			s := src.NRGBAAt(sp.X+x-r.Min.X, sp.Y+y-r.Min.Y)
+			d := dst.NRGBAAt(x, y)
+			if s.A == 0 || d.A == 0 {
+				continue
+			}
+
+			overlap = overlap.Union(image.Rect(x, y, x+1, y+1))
+			report.OverlapPixels++
+
+			diff := absDiff(s.R, d.R) + absDiff(s.G, d.G) + absDiff(s.B, d.B)
+			if diff > 0 {
+				report.DifferingPixels++
+			}
+			diffSum += diff
+		}
+	}
+
+	if report.OverlapPixels > 0 {
+		report.Overlap = newRect(overlap)
+		report.MeanAbsoluteDifference = float64(diffSum) / float64(3*report.OverlapPixels)
+	}
+
+	return report
+}
+
+func absDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"net/http"
+	"time"
+)
+
+// A charta can be given an expiry when it is created or with PATCH. Expired
+// chartas are deleted for good, bypassing the trash, by the sweeper that runs
+// with the compactor.
+
+// ChartaExpiry sets the expiry either as a ttl from now or as a time. Persist
+// removes the expiry.
+type ChartaExpiry struct {
+	TTL     time.Duration `form:"ttl" binding:"omitempty,gt=0"`
+	Expires time.Time     `form:"expires" time_format:"2006-01-02T15:04:05Z07:00"`
+	Persist bool          `form:"persist"`
+}
+
+type ExpiryStats struct {
+	Expired int `json:"expired"`
+}
+
+func (e *ChartaExpiry) isSet() bool {
+	return e.TTL != 0 || !e.Expires.IsZero() || e.Persist
+}
+
+// valid reports whether at most one option is given and the expiry is not in
+// the past.
+func (e *ChartaExpiry) valid(now time.Time) bool {
+	n := 0
+	for _, set := range []bool{e.TTL != 0, !e.Expires.IsZero(), e.Persist} {
+		if set {
+			n++
+		}
+	}
+	return n <= 1 && (e.Expires.IsZero() || e.Expires.After(now))
+}
+
+func (e *ChartaExpiry) apply(charta *Charta, now time.Time) {
+	var expires time.Time
+	switch {
+	case e.TTL != 0:
+		expires = now.Add(e.TTL).UTC()
+	case !e.Expires.IsZero():
+		expires = e.Expires.UTC()
+	case e.Persist:
+		charta.Expires = nil
+		return
+	default:
+		return
+	}
+	charta.Expires = &expires
+}
+
+func (charta *Charta) expired(now time.Time) bool {
+	return charta.Expires != nil && !charta.Expires.After(now)
+}
+
+// expireChartas deletes the expired chartas, each in its own transaction.
+func (cs *ChartographerService) expireChartas(ctx context.Context, progress func(float64)) (*ExpiryStats, error) {
+	now := time.Now()
+	var expired []string
+	err := cs.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("chartas")).ForEach(func(_, v []byte) error {
+			var charta Charta
+			if err := json.Unmarshal(v, &charta); err != nil {
+				return err
+			}
+			if charta.expired(now) {
+				expired = append(expired, charta.Id)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &ExpiryStats{}
+	for i, id := range expired {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		progress(float64(i) / float64(len(expired)))
+
+		err = cs.DB.Update(func(tx *bolt.Tx) error {
+			// The expiry may have been extended in the meantime.
+			charta, err := getCharta(tx, id)
+			if err != nil || charta == nil || !charta.expired(now) {
+				return err
+			}
+			stats.Expired++
+			return cs.purgeCharta(tx, id)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// getChartaMetaEndpoint returns the size and the expiry of the charta.
+func (cs *ChartographerService) getChartaMetaEndpoint(c *gin.Context) {
+	var charta *Charta
+	err := cs.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		charta, err = getCharta(tx, c.Param("id"))
+		return err
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if charta == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, charta)
+}
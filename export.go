@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"hash/adler32"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"io"
+	"net/http"
+	"time"
+)
+
+// tiffStripSize is the approximate size of one strip of an exported TIFF.
+const tiffStripSize = 1 << 20
+
+type ChartaExport struct {
+	Format string `form:"format" binding:"omitempty,oneof=png tiff bmp"`
+}
+
+// exportLayout describes an uncompressed image file as a header followed by
+// rows of equal size, so any byte of the file can be produced without
+// generating the bytes before it.
+type exportLayout struct {
+	header  []byte
+	rowSize int
+	height  int
+	// encodeRow converts a row of NRGBA pixels into the bytes of the file.
+	encodeRow func(dst, pix []byte)
+	// trailer returns the trailerSize bytes after the rows. It gets every row
+	// of pixels from next, in order, as the trailer of a PNG file holds the
+	// checksum of all of them.
+	trailer     func(next func(pix []byte) error) ([]byte, error)
+	trailerSize int
+}
+
+func (l *exportLayout) rowsEnd() int64 {
+	return int64(len(l.header)) + int64(l.rowSize)*int64(l.height)
+}
+
+func (l *exportLayout) size() int64 {
+	return l.rowsEnd() + int64(l.trailerSize)
+}
+
+// bmpLayout lays out a top-down 24-bit BMP. Unrestored pixels are black, as in
+// the images returned by GET /chartas/{id}/.
+func bmpLayout(width, height int) *exportLayout {
+	rowSize := (3*width + 3) &^ 3
+	header := make([]byte, 54)
+	header[0], header[1] = 'B', 'M'
+	binary.LittleEndian.PutUint32(header[2:], uint32(54+rowSize*height))
+	binary.LittleEndian.PutUint32(header[10:], 54)
+	binary.LittleEndian.PutUint32(header[14:], 40)
+	binary.LittleEndian.PutUint32(header[18:], uint32(width))
+	binary.LittleEndian.PutUint32(header[22:], uint32(-int32(height)))
+	binary.LittleEndian.PutUint16(header[26:], 1)
+	binary.LittleEndian.PutUint16(header[28:], 24)
+	binary.LittleEndian.PutUint32(header[34:], uint32(rowSize*height))
+
+	black := createBlackImage(width, 1)
+	background := createBlackImage(width, 1)
+	source := &image.NRGBA{Stride: 4 * width, Rect: image.Rect(0, 0, width, 1)}
+	return &exportLayout{
+		header:  header,
+		rowSize: rowSize,
+		height:  height,
+		encodeRow: func(dst, pix []byte) {
+			copy(background.Pix, black.Pix)
+			source.Pix = pix
+			draw.Draw(&background, background.Rect, source, image.Point{}, draw.Over)
+			for x := 0; x < width; x++ {
+				p := background.Pix[4*x:]
+				dst[3*x], dst[3*x+1], dst[3*x+2] = p[2], p[1], p[0]
+			}
+		},
+	}
+}
+
+// pngStoredBlockSize is the largest block of a deflate stream that is not
+// compressed.
+const pngStoredBlockSize = 0xffff
+
+// pngLayout lays out an 8-bit RGBA PNG whose zlib stream is not compressed.
+// Every row is an IDAT chunk of stored deflate blocks, so all rows take the
+// same number of bytes. The last chunk holds the Adler-32 checksum of the
+// rows, which is only known once all of them are read.
+func pngLayout(width, height int) *exportLayout {
+	rowData := 1 + 4*width
+	blocks := (rowData + pngStoredBlockSize - 1) / pngStoredBlockSize
+	chunkData := rowData + 5*blocks
+
+	var header bytes.Buffer
+	header.Write(pngSignature)
+	chunks := &pngChunkWriter{w: &header}
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(height))
+	ihdr[8] = 8
+	ihdr[9] = 6
+	_ = chunks.writeChunk("IHDR", ihdr)
+	// The zlib header of a stream without compression.
+	_ = chunks.writeChunk("IDAT", []byte{0x78, 0x01})
+
+	return &exportLayout{
+		header:  header.Bytes(),
+		rowSize: 12 + chunkData,
+		height:  height,
+		encodeRow: func(dst, pix []byte) {
+			binary.BigEndian.PutUint32(dst, uint32(chunkData))
+			copy(dst[4:], "IDAT")
+			p := dst[8:]
+			for start := 0; start < rowData; start += pngStoredBlockSize {
+				n := rowData - start
+				if n > pngStoredBlockSize {
+					n = pngStoredBlockSize
+				}
+				p[0] = 0
+				binary.LittleEndian.PutUint16(p[1:], uint16(n))
+				binary.LittleEndian.PutUint16(p[3:], ^uint16(n))
+				// The row starts with the filter byte, which is always 0.
+				block := p[5 : 5+n]
+				if start == 0 {
+					block[0] = 0
+					copy(block[1:], pix)
+				} else {
+					copy(block, pix[start-1:])
+				}
+				p = p[5+n:]
+			}
+			binary.BigEndian.PutUint32(dst[8+chunkData:], crc32.ChecksumIEEE(dst[4:8+chunkData]))
+		},
+		trailer: func(next func(pix []byte) error) ([]byte, error) {
+			sum := adler32.New()
+			pix := make([]byte, rowData)
+			for y := 0; y < height; y++ {
+				if err := next(pix[1:]); err != nil {
+					return nil, err
+				}
+				_, _ = sum.Write(pix)
+			}
+
+			var trailer bytes.Buffer
+			chunks := &pngChunkWriter{w: &trailer}
+			// The last block of the stream is empty.
+			data := []byte{0x01, 0x00, 0x00, 0xff, 0xff, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(data[5:], sum.Sum32())
+			_ = chunks.writeChunk("IDAT", data)
+			_ = chunks.writeChunk("IEND", nil)
+			return trailer.Bytes(), nil
+		},
+		trailerSize: 12 + 9 + 12,
+	}
+}
+
+// tiffLayout lays out an uncompressed RGBA TIFF with unassociated alpha. The
+// largest charta takes less than 4 GiB in this form, so BigTIFF is not needed.
+func tiffLayout(width, height int) *exportLayout {
+	const short, long = 3, 4
+	rowSize := 4 * width
+	rowsPerStrip := tiffStripSize / rowSize
+	if rowsPerStrip < 1 {
+		rowsPerStrip = 1
+	}
+	if rowsPerStrip > height {
+		rowsPerStrip = height
+	}
+	strips := (height + rowsPerStrip - 1) / rowsPerStrip
+
+	type entry struct {
+		tag, typ uint16
+		values   []uint32
+	}
+	valuesSize := func(e entry) int {
+		if e.typ == short {
+			return 2 * len(e.values)
+		}
+		return 4 * len(e.values)
+	}
+	offsets := make([]uint32, strips)
+	counts := make([]uint32, strips)
+	entries := []entry{
+		{256, long, []uint32{uint32(width)}},
+		{257, long, []uint32{uint32(height)}},
+		{258, short, []uint32{8, 8, 8, 8}},
+		{259, short, []uint32{1}},
+		{262, short, []uint32{2}},
+		{273, long, offsets},
+		{277, short, []uint32{4}},
+		{278, long, []uint32{uint32(rowsPerStrip)}},
+		{279, long, counts},
+		{284, short, []uint32{1}},
+		{338, short, []uint32{2}},
+	}
+
+	// Values that do not fit into an entry are stored right after the IFD.
+	ifdSize := 2 + 12*len(entries) + 4
+	extraSize := 0
+	for _, e := range entries {
+		if n := valuesSize(e); n > 4 {
+			extraSize += n
+		}
+	}
+	dataOffset := 8 + ifdSize + extraSize
+	for i := range offsets {
+		offsets[i] = uint32(dataOffset + i*rowsPerStrip*rowSize)
+		counts[i] = uint32(rowsPerStrip * rowSize)
+	}
+	counts[strips-1] = uint32((height - (strips-1)*rowsPerStrip) * rowSize)
+
+	header := make([]byte, dataOffset)
+	copy(header, "II*\x00")
+	binary.LittleEndian.PutUint32(header[4:], 8)
+	binary.LittleEndian.PutUint16(header[8:], uint16(len(entries)))
+	extra := 8 + ifdSize
+	for i, e := range entries {
+		p := header[10+12*i:]
+		binary.LittleEndian.PutUint16(p[0:], e.tag)
+		binary.LittleEndian.PutUint16(p[2:], e.typ)
+		binary.LittleEndian.PutUint32(p[4:], uint32(len(e.values)))
+
+		values := p[8:12]
+		if n := valuesSize(e); n > 4 {
+			binary.LittleEndian.PutUint32(p[8:], uint32(extra))
+			values = header[extra : extra+n]
+			extra += n
+		}
+		for j, v := range e.values {
+			if e.typ == short {
+				binary.LittleEndian.PutUint16(values[2*j:], uint16(v))
+			} else {
+				binary.LittleEndian.PutUint32(values[4*j:], v)
+			}
+		}
+	}
+
+	return &exportLayout{
+		header:  header,
+		rowSize: rowSize,
+		height:  height,
+		encodeRow: func(dst, pix []byte) {
+			copy(dst, pix)
+		},
+	}
+}
+
+// exportReader generates an exported file from the stored charta on demand,
+// so memory usage stays bounded by a single row for any sequence of ranges.
+type exportReader struct {
+	layout  *exportLayout
+	rows    chartaRows
+	loaded  int
+	pix     []byte
+	row     []byte
+	trailer []byte
+	offset  int64
+}
+
+func newExportReader(rows chartaRows, layout *exportLayout) *exportReader {
+	width, _ := rows.Size()
+	return &exportReader{
+		layout: layout,
+		rows:   rows,
+		loaded: -1,
+		pix:    make([]byte, 4*width),
+		row:    make([]byte, layout.rowSize),
+	}
+}
+
+func (er *exportReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += er.offset
+	case io.SeekEnd:
+		offset += er.layout.size()
+	}
+	if offset < 0 {
+		return 0, errors.New("export: negative position")
+	}
+	er.offset = offset
+	return offset, nil
+}
+
+func (er *exportReader) Read(p []byte) (int, error) {
+	if er.offset >= er.layout.size() {
+		return 0, io.EOF
+	}
+
+	headerSize := int64(len(er.layout.header))
+	if er.offset < headerSize {
+		n := copy(p, er.layout.header[er.offset:])
+		er.offset += int64(n)
+		return n, nil
+	}
+
+	if er.offset >= er.layout.rowsEnd() {
+		return er.readTrailer(p)
+	}
+
+	y := int((er.offset - headerSize) / int64(er.layout.rowSize))
+	if y != er.loaded {
+		if err := er.rows.SeekRow(y); err != nil {
+			return 0, err
+		}
+		if err := er.rows.ReadRow(er.pix); err != nil {
+			return 0, err
+		}
+		er.layout.encodeRow(er.row, er.pix)
+		er.loaded = y
+	}
+	n := copy(p, er.row[(er.offset-headerSize)%int64(er.layout.rowSize):])
+	er.offset += int64(n)
+	return n, nil
+}
+
+// readTrailer reads the bytes after the rows, which are generated from all of
+// them the first time they are needed.
+func (er *exportReader) readTrailer(p []byte) (int, error) {
+	if er.trailer == nil {
+		if err := er.rows.SeekRow(0); err != nil {
+			return 0, err
+		}
+		trailer, err := er.layout.trailer(er.rows.ReadRow)
+		if err != nil {
+			return 0, err
+		}
+		er.trailer = trailer
+		// The rows were read past the loaded one.
+		er.loaded = -1
+	}
+	n := copy(p, er.trailer[er.offset-er.layout.rowsEnd():])
+	er.offset += int64(n)
+	return n, nil
+}
+
+// exportFailure remembers why reading an export failed, as http.ServeContent
+// doesn't report it.
+type exportFailure struct {
+	io.ReadSeeker
+	err error
+}
+
+func (ef *exportFailure) Read(p []byte) (int, error) {
+	n, err := ef.ReadSeeker.Read(p)
+	if err != nil && err != io.EOF {
+		ef.err = err
+	}
+	return n, err
+}
+
+type ExportResult struct {
+	Format string `json:"format"`
+	Size   int64  `json:"size"`
+}
+
+var exportContentTypes = map[string]string{
+	"png":  "image/png",
+	"bmp":  "image/bmp",
+	"tiff": "image/tiff",
+}
+
+// chartaExport is an opened export of a charta.
+type chartaExport struct {
+	content io.ReadSeeker
+	modTime time.Time
+	close   func() error
+}
+
+// openExport opens a snapshot of the charta in the given format. The PNG
+// store keeps chartas as uncompressed PNG files already, so they are served
+// as they are; other stores generate every format on the fly.
+func (cs *ChartographerService) openExport(id, format string) (*chartaExport, error) {
+	var charta *Charta
+	err := cs.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		charta, err = getCharta(tx, id)
+		if err == nil && charta == nil {
+			err = errChartaNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if ps, ok := cs.store.(*pngStore); ok && format == "png" {
+		file, err := ps.Open(charta)
+		if err != nil {
+			return nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		return &chartaExport{content: file, modTime: info.ModTime(), close: file.Close}, nil
+	}
+
+	rows, err := cs.store.Rows(charta)
+	if err != nil {
+		return nil, err
+	}
+	export := &chartaExport{modTime: rows.ModTime(), close: rows.Close}
+	switch format {
+	case "bmp":
+		export.content = newExportReader(rows, bmpLayout(charta.Width, charta.Height))
+	case "tiff":
+		export.content = newExportReader(rows, tiffLayout(charta.Width, charta.Height))
+	case "png":
+		export.content = newExportReader(rows, pngLayout(charta.Width, charta.Height))
+	}
+	return export, nil
+}
+
+func writePNGRows(w io.Writer, rows rowReader, level int) error {
+	width, height := rows.Size()
+	pw, err := newPNGRowWriter(w, width, height, level)
+	if err != nil {
+		return err
+	}
+
+	pix := make([]byte, 4*width)
+	for y := 0; y < height; y++ {
+		if err = rows.ReadRow(pix); err != nil {
+			return err
+		}
+		if err = pw.WriteRow(pix); err != nil {
+			return err
+		}
+	}
+	return pw.Close()
+}
+
+func bindChartaExport(c *gin.Context) (*ChartaExport, bool) {
+	var export ChartaExport
+	if err := c.BindQuery(&export); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return nil, false
+	}
+	if export.Format == "" {
+		export.Format = "png"
+	}
+	return &export, true
+}
+
+func (cs *ChartographerService) exportChartaEndpoint(c *gin.Context) {
+	query, ok := bindChartaExport(c)
+	if !ok {
+		return
+	}
+
+	export, err := cs.openExport(c.Param("id"), query.Format)
+	if errors.Is(err, errChartaNotFound) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer export.close()
+
+	name := fmt.Sprintf("%s.%s", c.Param("id"), query.Format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	c.Header("Content-Type", exportContentTypes[query.Format])
+	content := &exportFailure{ReadSeeker: export.content}
+	http.ServeContent(c.Writer, c.Request, name, export.modTime, content)
+	if content.err != nil {
+		abortResponse("export", content.err)
+	}
+}
+
+// exportChartaJobEndpoint writes the export into a file in a job. The file is
+// downloaded from GET /jobs/{id}/result.
+func (cs *ChartographerService) exportChartaJobEndpoint(c *gin.Context) {
+	query, ok := bindChartaExport(c)
+	if !ok {
+		return
+	}
+
+	export, err := cs.openExport(c.Param("id"), query.Format)
+	if errors.Is(err, errChartaNotFound) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	job, err := cs.submitJob("export", c.Param("id"), requestProject(c), func(ctx context.Context, job *Job, progress func(float64)) (interface{}, error) {
+		defer export.close()
+
+		var size int64
+		err := replaceFile(cs.jobResultFilename(job.Id), func(w io.Writer) error {
+			cw := &contextWriter{ctx: ctx, w: w}
+			total, err := export.content.Seek(0, io.SeekEnd)
+			if err != nil {
+				return err
+			}
+			if _, err = export.content.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			cw.progress = func(written int64) {
+				progress(float64(written) / float64(total))
+			}
+			size, err = io.Copy(cw, export.content)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return ExportResult{Format: query.Format, Size: size}, nil
+	})
+	if err != nil {
+		_ = export.close()
+	}
+	cs.respondWithJob(c, job, err)
+}
+
+// contextWriter stops writing once its context is cancelled.
+type contextWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	written  int64
+	progress func(written int64)
+}
+
+func (cw *contextWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := cw.w.Write(p)
+	cw.written += int64(n)
+	if cw.progress != nil {
+		cw.progress(cw.written)
+	}
+	return n, err
+}
+
+func (cs *ChartographerService) getJobResultEndpoint(c *gin.Context) {
+	job, err := cs.requestJob(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if job == nil || job.Type != "export" || job.Status != JobDone {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	var result ExportResult
+	if err = json.Unmarshal(job.Result, &result); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	name := fmt.Sprintf("%s.%s", job.ChartaId, result.Format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	c.Header("Content-Type", exportContentTypes[result.Format])
+	c.File(cs.jobResultFilename(job.Id))
+}
@@ -0,0 +1,757 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const fragmentTileSize = 1024
+
+// FragmentRecord describes a fragment stored into a charta. The rectangle is
+// the part of the charta the fragment has changed.
+type FragmentRecord struct {
+	Id        string    `json:"id"`
+	ChartaId  string    `json:"chartaId"`
+	X         int       `json:"x"`
+	Y         int       `json:"y"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Z         uint64    `json:"z"`
+	Mode      string    `json:"mode,omitempty"`
+	Feather   int       `json:"feather,omitempty"`
+	Exposure  bool      `json:"exposure,omitempty"`
+	Creator   string    `json:"creator,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// FragmentQuery selects the fragments that intersect a region. The limits keep
+// x+width from overflowing, the region is clipped to the charta anyway.
+type FragmentQuery struct {
+	X      *int `form:"x" binding:"omitempty,gte=-50000,lte=50000"`
+	Y      *int `form:"y" binding:"omitempty,gte=-50000,lte=50000"`
+	Width  int  `form:"width" binding:"omitempty,gte=1,lte=50000"`
+	Height int  `form:"height" binding:"omitempty,gte=1,lte=50000"`
+}
+
+func (r *FragmentRecord) Rect() image.Rectangle {
+	return image.Rect(r.X, r.Y, r.X+r.Width, r.Y+r.Height)
+}
+
+// fragmentTiles returns the keys of the index tiles that r intersects.
+func fragmentTiles(r image.Rectangle) [][]byte {
+	var keys [][]byte
+	for ty := floorDiv(r.Min.Y, fragmentTileSize); ty <= floorDiv(r.Max.Y-1, fragmentTileSize); ty++ {
+		for tx := floorDiv(r.Min.X, fragmentTileSize); tx <= floorDiv(r.Max.X-1, fragmentTileSize); tx++ {
+			keys = append(keys, []byte(fmt.Sprintf("%d,%d", tx, ty)))
+		}
+	}
+	return keys
+}
+
+func floorDiv(a, b int) int {
+	if a < 0 {
+		return -((-a + b - 1) / b)
+	}
+	return a / b
+}
+
+// putFragmentRecord stores the record and adds it to the tile index of its
+// charta. A new record gets the next id and the topmost z.
+func putFragmentRecord(tx *bolt.Tx, record *FragmentRecord) error {
+	fragments, err := tx.Bucket([]byte("fragments")).CreateBucketIfNotExists([]byte(record.ChartaId))
+	if err != nil {
+		return err
+	}
+
+	if record.Id == "" {
+		id, err := fragments.NextSequence()
+		if err != nil {
+			return err
+		}
+		record.Id = strconv.FormatUint(id, 10)
+		record.Z = id
+	} else if err = unindexFragment(tx, record.ChartaId, record.Id); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	err = fragments.Put([]byte(record.Id), buf)
+	if err != nil {
+		return err
+	}
+
+	return indexFragment(tx, record)
+}
+
+func getFragmentRecord(tx *bolt.Tx, chartaId, fragmentId string) (*FragmentRecord, error) {
+	fragments := tx.Bucket([]byte("fragments")).Bucket([]byte(chartaId))
+	if fragments == nil {
+		return nil, nil
+	}
+
+	v := fragments.Get([]byte(fragmentId))
+	if v == nil {
+		return nil, nil
+	}
+
+	var record FragmentRecord
+	err := json.Unmarshal(v, &record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func deleteFragmentRecord(tx *bolt.Tx, chartaId, fragmentId string) error {
+	err := unindexFragment(tx, chartaId, fragmentId)
+	if err != nil {
+		return err
+	}
+
+	fragments := tx.Bucket([]byte("fragments")).Bucket([]byte(chartaId))
+	if fragments == nil {
+		return nil
+	}
+	return fragments.Delete([]byte(fragmentId))
+}
+
+// deleteFragmentRecords removes all fragment records and the index of a charta.
+func deleteFragmentRecords(tx *bolt.Tx, chartaId string) error {
+	for _, name := range []string{"fragments", "fragment-index"} {
+		b := tx.Bucket([]byte(name))
+		if b.Bucket([]byte(chartaId)) == nil {
+			continue
+		}
+		err := b.DeleteBucket([]byte(chartaId))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func indexFragment(tx *bolt.Tx, record *FragmentRecord) error {
+	index, err := tx.Bucket([]byte("fragment-index")).CreateBucketIfNotExists([]byte(record.ChartaId))
+	if err != nil {
+		return err
+	}
+
+	for _, key := range fragmentTiles(record.Rect()) {
+		var ids []string
+		if v := index.Get(key); v != nil {
+			err = json.Unmarshal(v, &ids)
+			if err != nil {
+				return err
+			}
+		}
+
+		buf, err := json.Marshal(append(ids, record.Id))
+		if err != nil {
+			return err
+		}
+		err = index.Put(key, buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func unindexFragment(tx *bolt.Tx, chartaId, fragmentId string) error {
+	record, err := getFragmentRecord(tx, chartaId, fragmentId)
+	if err != nil || record == nil {
+		return err
+	}
+
+	index := tx.Bucket([]byte("fragment-index")).Bucket([]byte(chartaId))
+	if index == nil {
+		return nil
+	}
+
+	for _, key := range fragmentTiles(record.Rect()) {
+		var ids []string
+		if v := index.Get(key); v != nil {
+			err = json.Unmarshal(v, &ids)
+			if err != nil {
+				return err
+			}
+		}
+
+		kept := ids[:0]
+		for _, id := range ids {
+			if id != fragmentId {
+				kept = append(kept, id)
+			}
+		}
+
+		if len(kept) == 0 {
+			err = index.Delete(key)
+		} else {
+			var buf []byte
+			buf, err = json.Marshal(kept)
+			if err == nil {
+				err = index.Put(key, buf)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findFragments returns the fragments of a charta intersecting r ordered by
+// z from the bottom to the top. An empty r selects all fragments.
+func findFragments(tx *bolt.Tx, chartaId string, r image.Rectangle) ([]FragmentRecord, error) {
+	records := []FragmentRecord{}
+
+	if r.Empty() {
+		fragments := tx.Bucket([]byte("fragments")).Bucket([]byte(chartaId))
+		if fragments == nil {
+			return records, nil
+		}
+
+		err := fragments.ForEach(func(k, v []byte) error {
+			var record FragmentRecord
+			err := json.Unmarshal(v, &record)
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		index := tx.Bucket([]byte("fragment-index")).Bucket([]byte(chartaId))
+		if index == nil {
+			return records, nil
+		}
+
+		seen := make(map[string]bool)
+		for _, key := range fragmentTiles(r) {
+			v := index.Get(key)
+			if v == nil {
+				continue
+			}
+
+			var ids []string
+			err := json.Unmarshal(v, &ids)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, id := range ids {
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+
+				record, err := getFragmentRecord(tx, chartaId, id)
+				if err != nil {
+					return nil, err
+				}
+				if record != nil && record.Rect().Overlaps(r) {
+					records = append(records, *record)
+				}
+			}
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Z < records[j].Z
+	})
+	return records, nil
+}
+
+func (cs *ChartographerService) getFragmentsEndpoint(c *gin.Context) {
+	var query FragmentQuery
+	if err := c.BindQuery(&query); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	var r image.Rectangle
+	if query.X != nil || query.Y != nil {
+		if query.X == nil || query.Y == nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if query.Width == 0 {
+			query.Width = 1
+		}
+		if query.Height == 0 {
+			query.Height = 1
+		}
+		r = image.Rect(*query.X, *query.Y, *query.X+query.Width, *query.Y+query.Height)
+	}
+
+	var records []FragmentRecord
+	err := cs.DB.View(func(tx *bolt.Tx) error {
+		charta, err := getCharta(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if charta == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return nil
+		}
+
+		// Only the tiles inside the charta can hold fragments. An empty
+		// region would select all of them.
+		if !r.Empty() {
+			r = r.Intersect(image.Rect(0, 0, charta.Width, charta.Height))
+			if r.Empty() {
+				records = []FragmentRecord{}
+				return nil
+			}
+		}
+		records, err = findFragments(tx, charta.Id, r)
+		return err
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if c.IsAborted() {
+		return
+	}
+
+	c.JSON(http.StatusOK, records)
+}
+
+func (cs *ChartographerService) fragmentFilename(chartaId, fragmentId string) string {
+	return fmt.Sprintf("%s/fragments/%s/%s.png", cs.pathName, chartaId, fragmentId)
+}
+
+// fragmentImages collects the changes to fragment images made in a
+// transaction. New images are staged next to their files and nothing is
+// replaced or removed until the transaction commits, so a failed one leaves
+// the images of its fragments as they were.
+type fragmentImages struct {
+	cs      *ChartographerService
+	staged  map[string]string
+	removed []string
+	chartas map[string]bool
+}
+
+// updateFragments runs fn in a read-write transaction and applies its changes
+// to fragment images once the transaction commits.
+func (cs *ChartographerService) updateFragments(fn func(tx *bolt.Tx, images *fragmentImages) error) error {
+	images := &fragmentImages{cs: cs, staged: map[string]string{}, chartas: map[string]bool{}}
+	err := cs.DB.Update(func(tx *bolt.Tx) error {
+		tx.OnCommit(images.apply)
+		return fn(tx, images)
+	})
+	if err != nil {
+		images.discard()
+	}
+	return err
+}
+
+// write keeps the pixels a fragment has been blended with, so the charta can
+// be composited again from its fragments. It returns the change of the disk
+// space taken by the images of the charta.
+func (fi *fragmentImages) write(record *FragmentRecord, img image.Image) (int64, error) {
+	err := os.MkdirAll(fmt.Sprintf("%s/fragments/%s", fi.cs.pathName, record.ChartaId), 0755)
+	if err != nil {
+		return 0, err
+	}
+
+	name := fi.cs.fragmentFilename(record.ChartaId, record.Id)
+	staged, err := stageFile(name, func(w io.Writer) error {
+		return png.Encode(w, img)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if previous, ok := fi.staged[name]; ok {
+		_ = os.Remove(previous)
+	}
+	fi.staged[name] = staged
+	fi.chartas[record.ChartaId] = true
+
+	info, err := os.Stat(staged)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size() - fi.cs.fragmentBytes(record), nil
+}
+
+// remove deletes the image of a fragment and returns the change of the disk
+// space taken by the images of the charta.
+func (fi *fragmentImages) remove(record *FragmentRecord) int64 {
+	name := fi.cs.fragmentFilename(record.ChartaId, record.Id)
+	if staged, ok := fi.staged[name]; ok {
+		_ = os.Remove(staged)
+		delete(fi.staged, name)
+	}
+	fi.removed = append(fi.removed, name)
+	fi.chartas[record.ChartaId] = true
+	return -fi.cs.fragmentBytes(record)
+}
+
+func (fi *fragmentImages) apply() {
+	for name, staged := range fi.staged {
+		if err := os.Rename(staged, name); err != nil {
+			log.Println("fragments:", err)
+		}
+	}
+	for _, name := range fi.removed {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			log.Println("fragments:", err)
+		}
+	}
+	if err := fi.cs.recountFragments(fi.chartas); err != nil {
+		log.Println("fragments:", err)
+	}
+}
+
+func (fi *fragmentImages) discard() {
+	for _, staged := range fi.staged {
+		_ = os.Remove(staged)
+	}
+}
+
+// readFragmentImage returns the pixels of a fragment positioned at its
+// rectangle in charta coordinates.
+func (cs *ChartographerService) readFragmentImage(record *FragmentRecord) (*image.NRGBA, error) {
+	file, err := os.Open(cs.fragmentFilename(record.ChartaId, record.Id))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	raw, err := png.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	img := imaging.Clone(raw)
+	img.Rect = record.Rect()
+	return img, nil
+}
+
+// replayFragment blends a stored fragment into dst the same way it was blended
+// when it was added. Sides of the fragment lying on the charta border are not
+// feathered, just like during the upload.
+func replayFragment(dst *image.NRGBA, record *FragmentRecord, img *image.NRGBA, chartaBounds image.Rectangle) {
+	if record.Feather == 0 {
+		blendFragment(dst, img.Bounds(), img, img.Bounds().Min, record.Mode)
+		return
+	}
+
+	full := img.Bounds()
+	if full.Min.X == chartaBounds.Min.X {
+		full.Min.X -= record.Feather
+	}
+	if full.Min.Y == chartaBounds.Min.Y {
+		full.Min.Y -= record.Feather
+	}
+	if full.Max.X == chartaBounds.Max.X {
+		full.Max.X += record.Feather
+	}
+	if full.Max.Y == chartaBounds.Max.Y {
+		full.Max.Y += record.Feather
+	}
+	featherFragment(dst, img.Bounds(), img, img.Bounds().Min, record.Mode, full, record.Feather)
+}
+
+// recomposite rebuilds the region r of the charta from its fragment history.
+// The history only knows the pixels its fragments have drawn, so the current
+// pixels are kept where none of them, including the removed ones, has drawn.
+// This keeps the pixels of chartas created before fragments were recorded and
+// of fragments whose images are missing. The images of removed fragments must
+// still exist.
+func (cs *ChartographerService) recomposite(tx *bolt.Tx, charta *Charta, r image.Rectangle, removed ...*FragmentRecord) error {
+	bounds := image.Rect(0, 0, charta.Width, charta.Height)
+	r = r.Intersect(bounds)
+	if r.Empty() {
+		return nil
+	}
+
+	records, err := findFragments(tx, charta.Id, r)
+	if err != nil {
+		return err
+	}
+
+	current, err := cs.store.Read(charta, r)
+	if err != nil {
+		return err
+	}
+	region := image.NewNRGBA(r)
+	draw.Draw(region, r, current, r.Min, draw.Src)
+
+	images := make([]*image.NRGBA, len(records))
+	clear := func(img *image.NRGBA) {
+		area := img.Bounds().Intersect(r)
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			for x := area.Min.X; x < area.Max.X; x++ {
+				if img.Pix[img.PixOffset(x, y)+3] != 0 {
+					region.SetNRGBA(x, y, color.NRGBA{})
+				}
+			}
+		}
+	}
+	for i := range records {
+		images[i], err = cs.readFragmentImage(&records[i])
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		clear(images[i])
+	}
+	for _, record := range removed {
+		img, err := cs.readFragmentImage(record)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		clear(img)
+	}
+
+	for i := range records {
+		if images[i] != nil {
+			replayFragment(region, &records[i], images[i], bounds)
+		}
+	}
+
+	err = cs.store.Write(charta, region)
+	if err != nil {
+		return err
+	}
+	return cs.accountCharta(tx, charta, 0)
+}
+
+func (cs *ChartographerService) deleteFragmentEndpoint(c *gin.Context) {
+	err := cs.updateFragments(func(tx *bolt.Tx, images *fragmentImages) error {
+		v := tx.Bucket([]byte("chartas")).Get([]byte(c.Param("id")))
+		if v == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return nil
+		}
+
+		var charta Charta
+		err := json.Unmarshal(v, &charta)
+		if err != nil {
+			return err
+		}
+
+		record, err := getFragmentRecord(tx, charta.Id, c.Param("fid"))
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return nil
+		}
+
+		err = deleteFragmentRecord(tx, charta.Id, record.Id)
+		if err != nil {
+			return err
+		}
+		err = cs.recomposite(tx, &charta, record.Rect(), record)
+		if err != nil {
+			return err
+		}
+		return cs.accountCharta(tx, &charta, images.remove(record))
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if c.IsAborted() {
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+type FragmentOrder struct {
+	Z      *int   `form:"z" binding:"omitempty,gte=1"`
+	Before string `form:"before"`
+	After  string `form:"after"`
+}
+
+// reorderFragments moves the fragment with the given id within records, which
+// are ordered by z, and renumbers z from 1. It returns false if the fragment
+// referenced by order doesn't exist.
+func reorderFragments(records []FragmentRecord, id string, order *FragmentOrder) ([]FragmentRecord, bool) {
+	var moved *FragmentRecord
+	rest := make([]FragmentRecord, 0, len(records))
+	for i := range records {
+		if records[i].Id == id {
+			moved = &records[i]
+		} else {
+			rest = append(rest, records[i])
+		}
+	}
+	if moved == nil {
+		return nil, false
+	}
+
+	position := -1
+	switch {
+	case order.Z != nil:
+		position = *order.Z - 1
+		if position > len(rest) {
+			position = len(rest)
+		}
+	default:
+		other := order.Before
+		if other == "" {
+			other = order.After
+		}
+		for i := range rest {
+			if rest[i].Id == other {
+				position = i
+			}
+		}
+		if position < 0 {
+			return nil, false
+		}
+		if order.After != "" {
+			position++
+		}
+	}
+
+	ordered := make([]FragmentRecord, 0, len(records))
+	ordered = append(ordered, rest[:position]...)
+	ordered = append(ordered, *moved)
+	ordered = append(ordered, rest[position:]...)
+	for i := range ordered {
+		ordered[i].Z = uint64(i + 1)
+	}
+	return ordered, true
+}
+
+func (cs *ChartographerService) reorderFragmentEndpoint(c *gin.Context) {
+	var order FragmentOrder
+	if err := c.BindQuery(&order); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	given := 0
+	for _, set := range []bool{order.Z != nil, order.Before != "", order.After != ""} {
+		if set {
+			given++
+		}
+	}
+	if given != 1 || order.Before == c.Param("fid") || order.After == c.Param("fid") {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	var moved *FragmentRecord
+	err := cs.DB.Update(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("chartas")).Get([]byte(c.Param("id")))
+		if v == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return nil
+		}
+
+		var charta Charta
+		err := json.Unmarshal(v, &charta)
+		if err != nil {
+			return err
+		}
+
+		records, err := findFragments(tx, charta.Id, image.Rectangle{})
+		if err != nil {
+			return err
+		}
+
+		ordered, ok := reorderFragments(records, c.Param("fid"), &order)
+		if !ok {
+			c.AbortWithStatus(http.StatusNotFound)
+			return nil
+		}
+
+		previous := make(map[string]uint64)
+		for _, record := range records {
+			previous[record.Id] = record.Z
+		}
+
+		for i := range ordered {
+			if ordered[i].Z != previous[ordered[i].Id] {
+				err = putFragmentRecord(tx, &ordered[i])
+				if err != nil {
+					return err
+				}
+			}
+			if ordered[i].Id == c.Param("fid") {
+				moved = &ordered[i]
+			}
+		}
+
+		return cs.recomposite(tx, &charta, moved.Rect())
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if c.IsAborted() {
+		return
+	}
+
+	c.JSON(http.StatusOK, moved)
+}
+
+// moveFragment shifts a fragment by offset and crops it to bounds. A fragment
+// that ends up outside of bounds is deleted. It returns the change of the
+// disk space taken by the fragment images.
+func (cs *ChartographerService) moveFragment(tx *bolt.Tx, images *fragmentImages, record *FragmentRecord, offset image.Point, bounds image.Rectangle) (int64, error) {
+	moved := record.Rect().Add(offset)
+	kept := moved.Intersect(bounds)
+
+	if kept.Empty() {
+		err := deleteFragmentRecord(tx, record.ChartaId, record.Id)
+		if err != nil {
+			return 0, err
+		}
+		return images.remove(record), nil
+	}
+
+	var size int64
+	if kept != moved {
+		img, err := cs.readFragmentImage(record)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		if err == nil {
+			size, err = images.write(record, img.SubImage(kept.Sub(offset)))
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	record.X, record.Y = kept.Min.X, kept.Min.Y
+	record.Width, record.Height = kept.Dx(), kept.Dy()
+	return size, putFragmentRecord(tx, record)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// fsck checks that the stored chartas match the "chartas" bucket. A failed
+// request can leave a stored charta without its entry, or an entry without the
+// stored charta. Problems are only reported in the "report" mode. The
+// "repair" mode deletes orphaned chartas and rebuilds missing or broken ones
+// from their fragment history; "quarantine" does the same but moves the
+// orphaned and broken files aside instead of deleting them.
+
+const (
+	FsckReport     = "report"
+	FsckRepair     = "repair"
+	FsckQuarantine = "quarantine"
+)
+
+const (
+	FsckOrphan       = "orphan"
+	FsckMissing      = "missing"
+	FsckCorrupt      = "corrupt"
+	FsckSizeMismatch = "size-mismatch"
+)
+
+type FsckQuery struct {
+	Mode string `form:"mode" binding:"omitempty,oneof=report repair quarantine"`
+}
+
+type FsckProblem struct {
+	Id      string `json:"id"`
+	Problem string `json:"problem"`
+	Detail  string `json:"detail,omitempty"`
+	// Action is what was done about the problem, empty if nothing was.
+	Action string `json:"action,omitempty"`
+}
+
+type FsckResult struct {
+	Chartas    int           `json:"chartas"`
+	Stored     int           `json:"stored"`
+	Problems   []FsckProblem `json:"problems"`
+	Quarantine string        `json:"quarantine,omitempty"`
+}
+
+// fsck runs the check in a single transaction, so nothing is written while
+// it runs.
+func (cs *ChartographerService) fsck(ctx context.Context, mode string, progress func(float64)) (*FsckResult, error) {
+	store, ok := cs.store.(checkedStore)
+	if !ok {
+		return nil, fmt.Errorf("fsck is not supported for storage %q", cs.Storage)
+	}
+
+	result := &FsckResult{Problems: []FsckProblem{}}
+	if mode == FsckQuarantine {
+		result.Quarantine = filepath.Join(cs.pathName, "quarantine", time.Now().UTC().Format("20060102T150405"))
+	}
+
+	check := func(tx *bolt.Tx) error {
+		var chartas []Charta
+		err := tx.Bucket([]byte("chartas")).ForEach(func(_, v []byte) error {
+			var charta Charta
+			if err := json.Unmarshal(v, &charta); err != nil {
+				return err
+			}
+			chartas = append(chartas, charta)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		result.Chartas = len(chartas)
+
+		ids, err := store.List()
+		if os.IsNotExist(err) {
+			ids, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+		result.Stored = len(ids)
+		sort.Strings(ids)
+
+		known := map[string]bool{}
+		for _, charta := range chartas {
+			known[charta.Id] = true
+		}
+		// Chartas in the trash keep their images until they are purged.
+		err = tx.Bucket([]byte("trash")).ForEach(func(k, _ []byte) error {
+			known[string(k)] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if known[id] {
+				continue
+			}
+			problem := FsckProblem{Id: id, Problem: FsckOrphan}
+			switch mode {
+			case FsckRepair:
+				err = cs.store.Delete(&Charta{Id: id})
+				problem.Action = "deleted"
+			case FsckQuarantine:
+				err = store.Quarantine(id, result.Quarantine)
+				problem.Action = "quarantined"
+			}
+			if err != nil {
+				return err
+			}
+			result.Problems = append(result.Problems, problem)
+		}
+
+		for i := range chartas {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			progress(float64(i) / float64(len(chartas)))
+
+			problem, err := cs.fsckCharta(tx, store, &chartas[i], mode, result.Quarantine)
+			if err != nil {
+				return err
+			}
+			if problem != nil {
+				result.Problems = append(result.Problems, *problem)
+			}
+		}
+		return nil
+	}
+
+	var err error
+	if mode == FsckReport {
+		err = cs.DB.View(check)
+	} else {
+		err = cs.DB.Update(check)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (cs *ChartographerService) fsckCharta(tx *bolt.Tx, store checkedStore, charta *Charta, mode, quarantine string) (*FsckProblem, error) {
+	err := store.Check(charta)
+	if err == nil {
+		return nil, nil
+	}
+
+	problem := &FsckProblem{Id: charta.Id, Detail: err.Error()}
+	switch {
+	case os.IsNotExist(err):
+		problem.Problem, problem.Detail = FsckMissing, ""
+	case errors.Is(err, errSizeMismatch):
+		problem.Problem = FsckSizeMismatch
+	case errors.Is(err, errCorruptImage):
+		problem.Problem = FsckCorrupt
+	default:
+		return nil, err
+	}
+	if mode == FsckReport {
+		return problem, nil
+	}
+
+	if problem.Problem != FsckMissing {
+		if mode == FsckQuarantine {
+			err = store.Quarantine(charta.Id, quarantine)
+		} else {
+			err = cs.store.Delete(charta)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The fragment history is the source of truth for the pixels.
+	err = cs.store.Create(charta)
+	if err != nil {
+		return nil, err
+	}
+	err = cs.recomposite(tx, charta, image.Rect(0, 0, charta.Width, charta.Height))
+	if err != nil {
+		return nil, err
+	}
+	problem.Action = "rebuilt"
+	return problem, nil
+}
+
+// fsckEndpoint starts a consistency check job.
+func (cs *ChartographerService) fsckEndpoint(c *gin.Context) {
+	if _, ok := cs.store.(checkedStore); !ok {
+		c.AbortWithStatus(http.StatusNotImplemented)
+		return
+	}
+
+	var query FsckQuery
+	if err := c.BindQuery(&query); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if query.Mode == "" {
+		query.Mode = FsckReport
+	}
+
+	job, err := cs.submitJob("fsck", "", "", func(ctx context.Context, job *Job, progress func(float64)) (interface{}, error) {
+		return cs.fsck(ctx, query.Mode, progress)
+	})
+	cs.respondWithJob(c, job, err)
+}
+
+// fsckCommand runs "chartographer fsck [-repair | -quarantine] path" and
+// returns the exit code. The service must not be running, since it keeps the
+// database locked.
+func fsckCommand(cs *ChartographerService, args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "delete orphaned chartas and rebuild broken ones")
+	quarantine := flags.Bool("quarantine", false, "like -repair, but move orphaned and broken files aside")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 || *repair && *quarantine {
+		fmt.Fprintln(flags.Output(), "usage: chartographer fsck [-repair | -quarantine] path")
+		return 2
+	}
+
+	mode := FsckReport
+	if *repair {
+		mode = FsckRepair
+	} else if *quarantine {
+		mode = FsckQuarantine
+	}
+
+	if err := cs.initializeStopped(flags.Arg(0), "chartas.db"); err != nil {
+		fmt.Fprintln(flags.Output(), "fsck:", err)
+		return 1
+	}
+	defer cs.DB.Close()
+
+	result, err := cs.fsck(context.Background(), mode, func(float64) {})
+	if err != nil {
+		fmt.Fprintln(flags.Output(), "fsck:", err)
+		return 1
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(result)
+	if mode == FsckReport && len(result.Problems) > 0 {
+		return 1
+	}
+	return 0
+}
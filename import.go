@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/image/tiff/lzw"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const maxImportSize = 5 << 30
+
+var (
+	errUnsupportedImage = errors.New("unsupported image format")
+	errCorruptImage     = errors.New("corrupt image")
+	errImageTooLarge    = errors.New("image too large")
+)
+
+// checkImageSize rejects images larger than a charta may be. The readers call
+// it before they size their buffers from the header.
+func checkImageSize(width, height int) error {
+	if width > 20000 || height > 50000 {
+		return errImageTooLarge
+	}
+	return nil
+}
+
+// rowReader decodes an image row by row into NRGBA pixels.
+type rowReader interface {
+	Size() (int, int)
+	ReadRow(pix []byte) error
+}
+
+// newImportReader detects the format of the image in file and returns a row
+// reader for it. BMP and TIFF files are read with random access, so the image
+// is never decoded into memory as a whole.
+func newImportReader(file *os.File) (rowReader, error) {
+	magic := make([]byte, 8)
+	if _, err := file.ReadAt(magic, 0); err != nil {
+		return nil, errUnsupportedImage
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("BM")):
+		return newBMPRowReader(file)
+	case bytes.HasPrefix(magic, pngSignature):
+		return newPNGRowReader(io.NewSectionReader(file, 0, 1<<62))
+	case bytes.HasPrefix(magic, []byte("II*\x00")), bytes.HasPrefix(magic, []byte("MM\x00*")):
+		return newTIFFRowReader(file)
+	}
+	return nil, errUnsupportedImage
+}
+
+type bmpRowReader struct {
+	r       io.ReaderAt
+	width   int
+	height  int
+	bpp     int
+	topDown bool
+	offset  int64
+	stride  int
+	palette [][3]byte
+	row     []byte
+	nextRow int
+}
+
+func newBMPRowReader(r io.ReaderAt) (*bmpRowReader, error) {
+	header := make([]byte, 54)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, errUnsupportedImage
+	}
+
+	br := &bmpRowReader{
+		r:      r,
+		offset: int64(binary.LittleEndian.Uint32(header[10:])),
+		width:  int(int32(binary.LittleEndian.Uint32(header[18:]))),
+		height: int(int32(binary.LittleEndian.Uint32(header[22:]))),
+		bpp:    int(binary.LittleEndian.Uint16(header[28:])),
+	}
+	infoSize := int64(binary.LittleEndian.Uint32(header[14:]))
+	compression := binary.LittleEndian.Uint32(header[30:])
+
+	if br.height < 0 {
+		br.height = -br.height
+		br.topDown = true
+	}
+	if br.width <= 0 || br.height == 0 || infoSize < 40 || compression != 0 {
+		return nil, errUnsupportedImage
+	}
+	if err := checkImageSize(br.width, br.height); err != nil {
+		return nil, err
+	}
+
+	switch br.bpp {
+	case 8:
+		colors := int(binary.LittleEndian.Uint32(header[46:]))
+		if colors == 0 || colors > 256 {
+			colors = 256
+		}
+		buf := make([]byte, 4*colors)
+		if _, err := r.ReadAt(buf, 14+infoSize); err != nil {
+			return nil, errUnsupportedImage
+		}
+		br.palette = make([][3]byte, colors)
+		for i := range br.palette {
+			br.palette[i] = [3]byte{buf[4*i+2], buf[4*i+1], buf[4*i]}
+		}
+	case 24, 32:
+	default:
+		return nil, errUnsupportedImage
+	}
+
+	br.stride = ((br.width*br.bpp + 31) / 32) * 4
+	br.row = make([]byte, br.stride)
+	return br, nil
+}
+
+func (br *bmpRowReader) Size() (int, int) {
+	return br.width, br.height
+}
+
+func (br *bmpRowReader) ReadRow(pix []byte) error {
+	if br.nextRow == br.height {
+		return io.EOF
+	}
+
+	stored := br.height - 1 - br.nextRow
+	if br.topDown {
+		stored = br.nextRow
+	}
+	br.nextRow++
+
+	if _, err := br.r.ReadAt(br.row, br.offset+int64(stored)*int64(br.stride)); err != nil {
+		return err
+	}
+
+	for x := 0; x < br.width; x++ {
+		p := pix[4*x : 4*x+4]
+		switch br.bpp {
+		case 8:
+			i := int(br.row[x])
+			if i >= len(br.palette) {
+				return errUnsupportedImage
+			}
+			c := br.palette[i]
+			p[0], p[1], p[2], p[3] = c[0], c[1], c[2], 255
+		case 24:
+			p[0], p[1], p[2], p[3] = br.row[3*x+2], br.row[3*x+1], br.row[3*x], 255
+		case 32:
+			p[0], p[1], p[2], p[3] = br.row[4*x+2], br.row[4*x+1], br.row[4*x], 255
+		}
+	}
+	return nil
+}
+
+const (
+	tiffImageWidth      = 256
+	tiffImageLength     = 257
+	tiffBitsPerSample   = 258
+	tiffCompression     = 259
+	tiffPhotometric     = 262
+	tiffStripOffsets    = 273
+	tiffSamplesPerPixel = 277
+	tiffRowsPerStrip    = 278
+	tiffStripByteCounts = 279
+	tiffPlanarConfig    = 284
+	tiffPredictor       = 317
+	tiffTileWidth       = 322
+
+	tiffCompressionNone     = 1
+	tiffCompressionLZW      = 5
+	tiffCompressionDeflate  = 8
+	tiffCompressionPackBits = 32773
+	tiffCompressionZlib     = 32946
+)
+
+// tiffRowReader reads 8-bit gray, RGB and RGBA TIFF images stored in strips.
+// Compressed strips are decompressed as a stream as well.
+type tiffRowReader struct {
+	r            io.ReaderAt
+	order        binary.ByteOrder
+	width        int
+	height       int
+	samples      int
+	invert       bool
+	compression  int
+	predictor    int
+	rowsPerStrip int
+	offsets      []int64
+	counts       []int64
+	strip        int
+	stripReader  io.Reader
+	row          []byte
+	nextRow      int
+}
+
+func newTIFFRowReader(r io.ReaderAt) (*tiffRowReader, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, errUnsupportedImage
+	}
+
+	tr := &tiffRowReader{r: r, strip: -1, compression: tiffCompressionNone, predictor: 1, samples: 1}
+	if header[0] == 'I' {
+		tr.order = binary.LittleEndian
+	} else {
+		tr.order = binary.BigEndian
+	}
+
+	ifd := int64(tr.order.Uint32(header[4:]))
+	countBuf := make([]byte, 2)
+	if _, err := r.ReadAt(countBuf, ifd); err != nil {
+		return nil, errUnsupportedImage
+	}
+	entries := make([]byte, 12*int(tr.order.Uint16(countBuf)))
+	if _, err := r.ReadAt(entries, ifd+2); err != nil {
+		return nil, errUnsupportedImage
+	}
+
+	photometric := -1
+	for i := 0; i < len(entries); i += 12 {
+		tag := int(tr.order.Uint16(entries[i:]))
+		values, err := tr.readValues(entries[i : i+12])
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		switch tag {
+		case tiffImageWidth:
+			tr.width = int(values[0])
+		case tiffImageLength:
+			tr.height = int(values[0])
+		case tiffBitsPerSample:
+			for _, v := range values {
+				if v != 8 {
+					return nil, errUnsupportedImage
+				}
+			}
+		case tiffCompression:
+			tr.compression = int(values[0])
+		case tiffPhotometric:
+			photometric = int(values[0])
+		case tiffStripOffsets:
+			tr.offsets = values
+		case tiffSamplesPerPixel:
+			tr.samples = int(values[0])
+		case tiffRowsPerStrip:
+			tr.rowsPerStrip = int(values[0])
+		case tiffStripByteCounts:
+			tr.counts = values
+		case tiffPlanarConfig:
+			if values[0] != 1 {
+				return nil, errUnsupportedImage
+			}
+		case tiffPredictor:
+			tr.predictor = int(values[0])
+		case tiffTileWidth:
+			return nil, errUnsupportedImage
+		}
+	}
+
+	switch {
+	case photometric == 0 || photometric == 1:
+		tr.invert = photometric == 0
+		if tr.samples != 1 && tr.samples != 2 {
+			return nil, errUnsupportedImage
+		}
+	case photometric == 2:
+		if tr.samples != 3 && tr.samples != 4 {
+			return nil, errUnsupportedImage
+		}
+	default:
+		return nil, errUnsupportedImage
+	}
+	switch tr.compression {
+	case tiffCompressionNone, tiffCompressionLZW, tiffCompressionDeflate, tiffCompressionZlib, tiffCompressionPackBits:
+	default:
+		return nil, errUnsupportedImage
+	}
+	if tr.rowsPerStrip <= 0 || tr.rowsPerStrip > tr.height {
+		tr.rowsPerStrip = tr.height
+	}
+	if tr.width <= 0 || tr.height <= 0 || tr.predictor > 2 || len(tr.offsets) == 0 ||
+		len(tr.offsets) != len(tr.counts) || len(tr.offsets) < (tr.height+tr.rowsPerStrip-1)/tr.rowsPerStrip {
+		return nil, errUnsupportedImage
+	}
+	if err := checkImageSize(tr.width, tr.height); err != nil {
+		return nil, err
+	}
+
+	tr.row = make([]byte, tr.width*tr.samples)
+	return tr, nil
+}
+
+// readValues returns the SHORT or LONG values of an IFD entry.
+func (tr *tiffRowReader) readValues(entry []byte) ([]int64, error) {
+	typ := tr.order.Uint16(entry[2:])
+	count := int(tr.order.Uint32(entry[4:]))
+
+	size := 0
+	switch typ {
+	case 3:
+		size = 2
+	case 4:
+		size = 4
+	default:
+		return nil, nil
+	}
+	if count > 1<<20 {
+		return nil, errUnsupportedImage
+	}
+
+	data := entry[8:12]
+	if size*count > 4 {
+		data = make([]byte, size*count)
+		if _, err := tr.r.ReadAt(data, int64(tr.order.Uint32(entry[8:]))); err != nil {
+			return nil, errUnsupportedImage
+		}
+	}
+
+	values := make([]int64, count)
+	for i := range values {
+		if size == 2 {
+			values[i] = int64(tr.order.Uint16(data[2*i:]))
+		} else {
+			values[i] = int64(tr.order.Uint32(data[4*i:]))
+		}
+	}
+	return values, nil
+}
+
+func (tr *tiffRowReader) Size() (int, int) {
+	return tr.width, tr.height
+}
+
+func (tr *tiffRowReader) ReadRow(pix []byte) error {
+	if tr.nextRow == tr.height {
+		return io.EOF
+	}
+
+	if strip := tr.nextRow / tr.rowsPerStrip; strip != tr.strip {
+		tr.strip = strip
+		section := io.NewSectionReader(tr.r, tr.offsets[strip], tr.counts[strip])
+		switch tr.compression {
+		case tiffCompressionNone:
+			tr.stripReader = section
+		case tiffCompressionLZW:
+			tr.stripReader = lzw.NewReader(section, lzw.MSB, 8)
+		case tiffCompressionDeflate, tiffCompressionZlib:
+			zr, err := zlib.NewReader(section)
+			if err != nil {
+				return err
+			}
+			tr.stripReader = zr
+		case tiffCompressionPackBits:
+			tr.stripReader = &packBitsReader{r: section}
+		}
+	}
+	tr.nextRow++
+
+	if _, err := io.ReadFull(tr.stripReader, tr.row); err != nil {
+		return err
+	}
+	if tr.predictor == 2 {
+		for i := tr.samples; i < len(tr.row); i++ {
+			tr.row[i] += tr.row[i-tr.samples]
+		}
+	}
+
+	for x := 0; x < tr.width; x++ {
+		p := pix[4*x : 4*x+4]
+		s := tr.row[x*tr.samples:]
+		switch tr.samples {
+		case 1, 2:
+			g := s[0]
+			if tr.invert {
+				g = 255 - g
+			}
+			p[0], p[1], p[2], p[3] = g, g, g, 255
+			if tr.samples == 2 {
+				p[3] = s[1]
+			}
+		case 3:
+			p[0], p[1], p[2], p[3] = s[0], s[1], s[2], 255
+		case 4:
+			p[0], p[1], p[2], p[3] = s[0], s[1], s[2], s[3]
+		}
+	}
+	return nil
+}
+
+// packBitsReader decodes a PackBits compressed stream.
+type packBitsReader struct {
+	r       io.Reader
+	literal int
+	repeat  int
+	value   byte
+}
+
+func (pr *packBitsReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		switch {
+		case pr.literal > 0:
+			k := len(p) - n
+			if k > pr.literal {
+				k = pr.literal
+			}
+			m, err := io.ReadFull(pr.r, p[n:n+k])
+			n += m
+			pr.literal -= m
+			if err != nil {
+				return n, err
+			}
+		case pr.repeat > 0:
+			p[n] = pr.value
+			n++
+			pr.repeat--
+		default:
+			header := make([]byte, 2)
+			if _, err := io.ReadFull(pr.r, header[:1]); err != nil {
+				return n, err
+			}
+			control := int8(header[0])
+			switch {
+			case control >= 0:
+				pr.literal = int(control) + 1
+			case control != -128:
+				if _, err := io.ReadFull(pr.r, header[1:]); err != nil {
+					return n, err
+				}
+				pr.repeat = 1 - int(control)
+				pr.value = header[1]
+			}
+		}
+	}
+	return n, nil
+}
+
+// convertImport writes the image of rr as a PNG file that can serve both as
+// the charta image and its first fragment.
+func convertImport(ctx context.Context, rr rowReader, filename string, progress func(float64)) error {
+	width, height := rr.Size()
+	return replaceFile(filename, func(w io.Writer) error {
+		pw, err := newPNGRowWriter(w, width, height, zlib.NoCompression)
+		if err != nil {
+			return err
+		}
+
+		row := make([]byte, 4*width)
+		for y := 0; y < height; y++ {
+			if y%256 == 0 {
+				if err = ctx.Err(); err != nil {
+					return err
+				}
+				progress(float64(y) / float64(height))
+			}
+
+			if err = rr.ReadRow(row); err != nil {
+				return err
+			}
+			if err = pw.WriteRow(row); err != nil {
+				return err
+			}
+		}
+		return pw.Close()
+	})
+}
+
+// importContentTypes are the types of the bodies POST /chartas/ creates a
+// charta from. Any other body is ignored unless import=true is given.
+var importContentTypes = map[string]bool{
+	"image/bmp":  true,
+	"image/png":  true,
+	"image/tiff": true,
+}
+
+type ImportQuery struct {
+	Import bool `form:"import"`
+}
+
+// isImport tells whether the request to create a charta uploads an image.
+func isImport(c *gin.Context) (bool, error) {
+	var query ImportQuery
+	if err := c.BindQuery(&query); err != nil {
+		return false, err
+	}
+	return query.Import || importContentTypes[c.ContentType()], nil
+}
+
+// importCharta spools the uploaded image to disk and checks its header. The
+// conversion itself runs in a job if async is set.
+func (cs *ChartographerService) importCharta(c *gin.Context, body io.Reader) {
+	var query AsyncQuery
+	if err := c.BindQuery(&query); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	var expiry ChartaExpiry
+	if err := c.BindQuery(&expiry); err != nil || !expiry.valid(time.Now()) || expiry.Persist {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	meta := Charta{Project: requestProject(c), Creator: requestCreator(c)}
+	expiry.apply(&meta, time.Now())
+
+	spool, err := os.CreateTemp(cs.pathName, "import-*.tmp")
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	spooled := false
+	defer func() {
+		if !spooled {
+			_ = spool.Close()
+			_ = os.Remove(spool.Name())
+		}
+	}()
+
+	if _, status := spoolBody(c, body, spool, maxImportSize); status != 0 {
+		c.AbortWithStatus(status)
+		return
+	}
+
+	rr, err := newImportReader(spool)
+	if errors.Is(err, errImageTooLarge) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		c.AbortWithStatus(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	width, height := rr.Size()
+	// The quota is checked again when the charta is stored, this only fails
+	// early.
+	err = cs.DB.View(func(tx *bolt.Tx) error {
+		return cs.checkQuota(tx, meta.Project, 1, int64(width)*int64(height))
+	})
+	if err != nil {
+		c.AbortWithStatus(quotaStatus(err))
+		return
+	}
+
+	// From here on the spooled file belongs to storeImport.
+	spooled = true
+	if query.Async {
+		job, err := cs.submitJob("import", "", meta.Project, func(ctx context.Context, job *Job, progress func(float64)) (interface{}, error) {
+			return cs.storeImport(ctx, spool, rr, meta, progress)
+		})
+		cs.respondWithJob(c, job, err)
+		return
+	}
+
+	charta, err := cs.storeImport(c.Request.Context(), spool, rr, meta, func(float64) {})
+	if errors.Is(err, errCorruptImage) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		c.AbortWithStatus(quotaStatus(err))
+		return
+	}
+
+	c.String(http.StatusCreated, charta.Id)
+}
+
+// storeImport converts the spooled image and creates a charta from it with the
+// project, creator and expiry of meta. The spooled file is removed afterwards.
+func (cs *ChartographerService) storeImport(ctx context.Context, spool *os.File, rr rowReader, meta Charta, progress func(float64)) (*Charta, error) {
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	converted := spool.Name() + ".png"
+	defer os.Remove(converted)
+	err := convertImport(ctx, rr, converted, progress)
+	if err != nil && ctx.Err() == nil {
+		return nil, fmt.Errorf("%w: %v", errCorruptImage, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	width, height := rr.Size()
+	var charta Charta
+	err = cs.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("chartas"))
+
+		err := cs.checkQuota(tx, meta.Project, 1, int64(width)*int64(height))
+		if err != nil {
+			return err
+		}
+
+		id, _ := b.NextSequence()
+		charta = meta
+		charta.Width, charta.Height, charta.Id = width, height, strconv.Itoa(int(id))
+
+		record := &FragmentRecord{
+			ChartaId:  charta.Id,
+			Width:     width,
+			Height:    height,
+			Creator:   meta.Creator,
+			CreatedAt: time.Now().UTC(),
+		}
+		err = putFragmentRecord(tx, record)
+		if err != nil {
+			return err
+		}
+
+		err = os.MkdirAll(cs.pathName+"/fragments/"+charta.Id, 0755)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(converted, cs.fragmentFilename(charta.Id, record.Id))
+		if err != nil {
+			return err
+		}
+		err = cs.store.Import(&charta, cs.fragmentFilename(charta.Id, record.Id))
+		if err != nil {
+			return err
+		}
+		err = cs.accountCharta(tx, &charta, 0)
+		if err != nil {
+			return err
+		}
+
+		buf, err := json.Marshal(charta)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(charta.Id), buf)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &charta, nil
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJobWorkers   = 2
+	jobQueueSize        = 256
+	defaultJobRetention = 24 * time.Hour
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+var errJobQueueFull = errors.New("job queue is full")
+
+type Job struct {
+	Id         string          `json:"id"`
+	Type       string          `json:"type"`
+	ChartaId   string          `json:"chartaId,omitempty"`
+	Project    string          `json:"project,omitempty"`
+	Status     string          `json:"status"`
+	Progress   float64         `json:"progress"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	StartedAt  *time.Time      `json:"startedAt,omitempty"`
+	FinishedAt *time.Time      `json:"finishedAt,omitempty"`
+}
+
+type AsyncQuery struct {
+	Async bool `form:"async"`
+}
+
+// jobFunc does the work of a job. It should stop with ctx.Err() once ctx is
+// cancelled and may report its progress as a fraction between 0 and 1.
+type jobFunc func(ctx context.Context, job *Job, progress func(float64)) (interface{}, error)
+
+// activeJob is the in-memory state of a queued or running job. The progress
+// is kept here rather than in bbolt to avoid a write transaction per update.
+type activeJob struct {
+	run      jobFunc
+	ctx      context.Context
+	cancel   context.CancelFunc
+	running  bool
+	progress float64
+}
+
+type jobQueue struct {
+	mu     sync.Mutex
+	active map[string]*activeJob
+	ids    chan string
+}
+
+// startJobs marks the jobs interrupted by a restart as failed and starts the
+// worker pool. Job functions are not persisted, so such jobs cannot resume.
+func (cs *ChartographerService) startJobs() error {
+	err := cs.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("jobs"))
+		return b.ForEach(func(k, v []byte) error {
+			var job Job
+			err := json.Unmarshal(v, &job)
+			if err != nil {
+				return err
+			}
+			if job.Status != JobQueued && job.Status != JobRunning {
+				return nil
+			}
+
+			now := time.Now().UTC()
+			job.Status, job.Error, job.FinishedAt = JobFailed, "interrupted by restart", &now
+			buf, err := json.Marshal(job)
+			if err != nil {
+				return err
+			}
+			return b.Put(k, buf)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// Uploads are spooled and fragment images staged into temporary files,
+	// which are left behind by the requests and jobs a restart interrupted.
+	for _, pattern := range []string{"import-*.tmp", "archive-*", "fragments/*/*.tmp"} {
+		leftovers, err := filepath.Glob(filepath.Join(cs.pathName, pattern))
+		if err != nil {
+			return err
+		}
+		for _, name := range leftovers {
+			if err = os.RemoveAll(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	workers := cs.JobWorkers
+	if workers <= 0 {
+		workers = defaultJobWorkers
+	}
+	cs.jobs = &jobQueue{
+		active: make(map[string]*activeJob),
+		ids:    make(chan string, jobQueueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go cs.jobWorker()
+	}
+	return nil
+}
+
+func getJob(tx *bolt.Tx, id string) (*Job, error) {
+	v := tx.Bucket([]byte("jobs")).Get([]byte(id))
+	if v == nil {
+		return nil, nil
+	}
+
+	var job Job
+	err := json.Unmarshal(v, &job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func putJob(tx *bolt.Tx, job *Job) error {
+	buf, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("jobs")).Put([]byte(job.Id), buf)
+}
+
+func (cs *ChartographerService) updateJob(id string, update func(job *Job)) (*Job, error) {
+	var job *Job
+	err := cs.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+		job, err = getJob(tx, id)
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			return fmt.Errorf("job %s not found", id)
+		}
+
+		update(job)
+		return putJob(tx, job)
+	})
+	return job, err
+}
+
+// submitJob records a new job and queues it for the worker pool. The jobs of
+// the admin endpoints have no project.
+func (cs *ChartographerService) submitJob(kind, chartaId, project string, run jobFunc) (*Job, error) {
+	job := &Job{
+		Type:      kind,
+		ChartaId:  chartaId,
+		Project:   project,
+		Status:    JobQueued,
+		CreatedAt: time.Now().UTC(),
+	}
+	err := cs.DB.Update(func(tx *bolt.Tx) error {
+		id, _ := tx.Bucket([]byte("jobs")).NextSequence()
+		job.Id = strconv.Itoa(int(id))
+		return putJob(tx, job)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cs.jobs.mu.Lock()
+	cs.jobs.active[job.Id] = &activeJob{run: run, ctx: ctx, cancel: cancel}
+	cs.jobs.mu.Unlock()
+
+	select {
+	case cs.jobs.ids <- job.Id:
+		return job, nil
+	default:
+	}
+
+	cs.jobs.mu.Lock()
+	delete(cs.jobs.active, job.Id)
+	cs.jobs.mu.Unlock()
+	cancel()
+	_, err = cs.updateJob(job.Id, func(job *Job) {
+		now := time.Now().UTC()
+		job.Status, job.Error, job.FinishedAt = JobFailed, errJobQueueFull.Error(), &now
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nil, errJobQueueFull
+}
+
+func (cs *ChartographerService) jobWorker() {
+	for id := range cs.jobs.ids {
+		cs.jobs.mu.Lock()
+		aj := cs.jobs.active[id]
+		if aj != nil {
+			aj.running = true
+		}
+		cs.jobs.mu.Unlock()
+		if aj == nil {
+			// Cancelled while queued.
+			continue
+		}
+
+		cs.runJob(id, aj)
+
+		cs.jobs.mu.Lock()
+		delete(cs.jobs.active, id)
+		cs.jobs.mu.Unlock()
+		aj.cancel()
+	}
+}
+
+func (cs *ChartographerService) runJob(id string, aj *activeJob) {
+	job, err := cs.updateJob(id, func(job *Job) {
+		now := time.Now().UTC()
+		job.Status, job.StartedAt = JobRunning, &now
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	progress := func(p float64) {
+		cs.jobs.mu.Lock()
+		aj.progress = p
+		cs.jobs.mu.Unlock()
+	}
+	result, runErr := aj.run(aj.ctx, job, progress)
+
+	var buf []byte
+	if runErr == nil && result != nil {
+		buf, runErr = json.Marshal(result)
+	}
+
+	_, err = cs.updateJob(id, func(job *Job) {
+		now := time.Now().UTC()
+		job.FinishedAt = &now
+		switch {
+		case runErr != nil && aj.ctx.Err() != nil:
+			job.Status = JobCancelled
+		case runErr != nil:
+			job.Status, job.Error = JobFailed, runErr.Error()
+		default:
+			job.Status, job.Progress, job.Result = JobDone, 1, buf
+		}
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// jobStatus returns the stored job with the progress of the running job.
+func (cs *ChartographerService) jobStatus(id string) (*Job, error) {
+	var job *Job
+	err := cs.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		job, err = getJob(tx, id)
+		return err
+	})
+	if err != nil || job == nil {
+		return job, err
+	}
+
+	cs.jobs.mu.Lock()
+	if aj := cs.jobs.active[id]; aj != nil && job.Status == JobRunning {
+		job.Progress = aj.progress
+	}
+	cs.jobs.mu.Unlock()
+	return job, nil
+}
+
+// respondWithJob sends the accepted job or the reason it was not accepted.
+func (cs *ChartographerService) respondWithJob(c *gin.Context, job *Job, err error) {
+	switch {
+	case errors.Is(err, errJobQueueFull):
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+	case err != nil:
+		c.AbortWithStatus(http.StatusInternalServerError)
+	default:
+		c.Header("Location", "/jobs/"+job.Id)
+		c.JSON(http.StatusAccepted, job)
+	}
+}
+
+func (cs *ChartographerService) jobResultFilename(id string) string {
+	return fmt.Sprintf("%s/jobs/%s", cs.pathName, id)
+}
+
+// requestJob returns the job from the request path, nil if there is none or
+// it belongs to a project the request may not see.
+func (cs *ChartographerService) requestJob(c *gin.Context) (*Job, error) {
+	job, err := cs.jobStatus(c.Param("id"))
+	if err != nil || job == nil || !inScope(c, job.Project) {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (cs *ChartographerService) getJobEndpoint(c *gin.Context) {
+	job, err := cs.requestJob(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// deleteJobEndpoint cancels a queued or running job. A finished job is removed
+// together with its result.
+func (cs *ChartographerService) deleteJobEndpoint(c *gin.Context) {
+	id := c.Param("id")
+	job, err := cs.requestJob(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	cs.jobs.mu.Lock()
+	aj := cs.jobs.active[id]
+	if aj != nil && !aj.running {
+		delete(cs.jobs.active, id)
+	}
+	cs.jobs.mu.Unlock()
+
+	if aj != nil {
+		aj.cancel()
+		if !aj.running {
+			_, err = cs.updateJob(id, func(job *Job) {
+				now := time.Now().UTC()
+				job.Status, job.FinishedAt = JobCancelled, &now
+			})
+			if err != nil {
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		job, err = cs.jobStatus(id)
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		c.JSON(http.StatusAccepted, job)
+		return
+	}
+
+	err = cs.DB.Update(func(tx *bolt.Tx) error {
+		job, err := getJob(tx, id)
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return nil
+		}
+		if job.Status == JobQueued || job.Status == JobRunning {
+			// The job was picked up or finished between the checks above.
+			c.AbortWithStatus(http.StatusConflict)
+			return nil
+		}
+
+		err = os.Remove(cs.jobResultFilename(id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return tx.Bucket([]byte("jobs")).Delete([]byte(id))
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if c.IsAborted() {
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (cs *ChartographerService) jobRetention() time.Duration {
+	if cs.JobRetention == 0 {
+		return defaultJobRetention
+	}
+	return cs.JobRetention
+}
+
+// purgeJobs deletes the jobs that finished longer than the retention period
+// ago together with their results and returns how many it deleted. A negative
+// JobRetention keeps them until they are deleted with DELETE /jobs/:id.
+func (cs *ChartographerService) purgeJobs(ctx context.Context) (int, error) {
+	retention := cs.jobRetention()
+	if retention < 0 {
+		return 0, nil
+	}
+
+	purged := 0
+	deadline := time.Now().Add(-retention)
+	err := cs.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("jobs"))
+		var expired []string
+		err := b.ForEach(func(_, v []byte) error {
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			if job.FinishedAt != nil && job.FinishedAt.Before(deadline) {
+				expired = append(expired, job.Id)
+			}
+			return ctx.Err()
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range expired {
+			err = os.Remove(cs.jobResultFilename(id))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err = b.Delete([]byte(id)); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
@@ -1,9 +1,88 @@
 package main
 
-import "os"
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+func envInt(name string) int {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("%s: %s", name, err)
+	}
+	return n
+}
+
+func envDuration(name string) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("%s: %s", name, err)
+	}
+	return d
+}
+
+func envBool(name string) bool {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("%s: %s", name, err)
+	}
+	return b
+}
 
 func main() {
-	cs := ChartographerService{}
+	cs := ChartographerService{
+		JobWorkers:      envInt("JOB_WORKERS"),
+		JobRetention:    envDuration("JOB_RETENTION"),
+		CompactInterval: envDuration("COMPACT_INTERVAL"),
+		SweepInterval:   envDuration("SWEEP_INTERVAL"),
+		CompactIdle:     envDuration("COMPACT_IDLE"),
+		CompactLevel:    envInt("COMPACT_LEVEL"),
+		Storage:         os.Getenv("STORAGE"),
+		TileSize:        envInt("TILE_SIZE"),
+		TrashRetention:  envDuration("TRASH_RETENTION"),
+		Quota: Quota{
+			Chartas: int64(envInt("QUOTA_CHARTAS")),
+			Pixels:  int64(envInt("QUOTA_PIXELS")),
+			Bytes:   int64(envInt("QUOTA_BYTES")),
+		},
+		Auth: envBool("AUTH"),
+		S3: S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Prefix:    os.Getenv("S3_PREFIX"),
+			TileSize:  envInt("S3_TILE_SIZE"),
+		},
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fsck":
+			os.Exit(fsckCommand(&cs, os.Args[2:], os.Stdout))
+		case "backup":
+			os.Exit(backupCommand(&cs, os.Args[2:], os.Stdout))
+		case "restore":
+			os.Exit(restoreCommand(&cs, os.Args[2:], os.Stdin))
+		case "apikey":
+			os.Exit(apiKeyCommand(&cs, os.Args[2:], os.Stdout))
+		}
+	}
+
 	cs.Initialize(os.Args[1], "chartas.db")
 	cs.Run(":8080")
 	_ = cs.DB.Close()
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"image"
+	"net/http"
+	"os"
+	"time"
+)
+
+type Merge struct {
+	From    string `form:"from" binding:"required"`
+	X       int    `form:"x"`
+	Y       int    `form:"y"`
+	Mode    string `form:"mode" binding:"omitempty,oneof=replace over average max min keep-existing"`
+	History bool   `form:"history"`
+	Async   bool   `form:"async"`
+	Creator string `form:"-"`
+	// Scope is the project the source charta must belong to, empty for any.
+	Scope string `form:"-"`
+}
+
+var (
+	errChartaNotFound = errors.New("charta not found")
+	errNoOverlap      = errors.New("chartas do not overlap")
+)
+
+func getCharta(tx *bolt.Tx, id string) (*Charta, error) {
+	v := tx.Bucket([]byte("chartas")).Get([]byte(id))
+	if v == nil {
+		return nil, nil
+	}
+
+	var charta Charta
+	err := json.Unmarshal(v, &charta)
+	if err != nil {
+		return nil, err
+	}
+	return &charta, nil
+}
+
+// mergeCharta composites the restored pixels of src onto dst with its top left
+// corner at offset. Without history the whole src becomes a single fragment of
+// dst, otherwise every fragment of src is replayed and recorded on top of dst.
+func (cs *ChartographerService) mergeCharta(ctx context.Context, tx *bolt.Tx, images *fragmentImages, dst, src *Charta, offset image.Point, mode string, history bool, creator string, progress func(float64)) ([]FragmentRecord, error) {
+	dstBounds := image.Rect(0, 0, dst.Width, dst.Height)
+	dstImg, err := cs.store.Read(dst, image.Rect(0, 0, src.Width, src.Height).Add(offset))
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []FragmentRecord
+	if history {
+		sources, err = findFragments(tx, src.Id, image.Rectangle{})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		sources = []FragmentRecord{{ChartaId: src.Id, X: 0, Y: 0, Width: src.Width, Height: src.Height, Mode: mode, Creator: creator}}
+	}
+
+	records := []FragmentRecord{}
+	var fragments int64
+	for i := range sources {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		progress(float64(i) / float64(len(sources)))
+
+		var img *image.NRGBA
+		if history {
+			img, err = cs.readFragmentImage(&sources[i])
+			if os.IsNotExist(err) {
+				continue
+			}
+		} else {
+			img, err = cs.store.Read(src, image.Rect(0, 0, src.Width, src.Height))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		img.Rect = img.Rect.Add(offset)
+		area := img.Bounds().Intersect(dstImg.Bounds())
+		if area.Empty() {
+			continue
+		}
+		img = img.SubImage(area).(*image.NRGBA)
+
+		record := sources[i]
+		record.Id = ""
+		record.ChartaId = dst.Id
+		record.X, record.Y = area.Min.X, area.Min.Y
+		record.Width, record.Height = area.Dx(), area.Dy()
+		record.CreatedAt = time.Now().UTC()
+
+		replayFragment(dstImg, &record, img, dstBounds)
+
+		err = putFragmentRecord(tx, &record)
+		if err != nil {
+			return nil, err
+		}
+		size, err := images.write(&record, img)
+		if err != nil {
+			return nil, err
+		}
+		fragments += size
+		records = append(records, record)
+	}
+
+	err = cs.store.Write(dst, dstImg)
+	if err != nil {
+		return nil, err
+	}
+	return records, cs.accountCharta(tx, dst, fragments)
+}
+
+// getMergedChartas returns the chartas of a merge after checking that they
+// exist and overlap and that the project of dst may store more images.
+func (cs *ChartographerService) getMergedChartas(tx *bolt.Tx, id string, merge *Merge) (*Charta, *Charta, error) {
+	dst, err := getCharta(tx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	src, err := getCharta(tx, merge.From)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dst == nil || src == nil || (merge.Scope != "" && chartaProject(src) != merge.Scope) {
+		return nil, nil, errChartaNotFound
+	}
+
+	srcBounds := image.Rect(0, 0, src.Width, src.Height).Add(image.Point{X: merge.X, Y: merge.Y})
+	if !srcBounds.Overlaps(image.Rect(0, 0, dst.Width, dst.Height)) {
+		return nil, nil, errNoOverlap
+	}
+	return dst, src, cs.checkQuota(tx, chartaProject(dst), 0, 0)
+}
+
+func (cs *ChartographerService) runMerge(ctx context.Context, id string, merge *Merge, progress func(float64)) ([]FragmentRecord, error) {
+	var records []FragmentRecord
+	err := cs.updateFragments(func(tx *bolt.Tx, images *fragmentImages) error {
+		dst, src, err := cs.getMergedChartas(tx, id, merge)
+		if err != nil {
+			return err
+		}
+
+		offset := image.Point{X: merge.X, Y: merge.Y}
+		records, err = cs.mergeCharta(ctx, tx, images, dst, src, offset, merge.Mode, merge.History, merge.Creator, progress)
+		return err
+	})
+	return records, err
+}
+
+func (cs *ChartographerService) mergeChartaEndpoint(c *gin.Context) {
+	var merge Merge
+	if err := c.BindQuery(&merge); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if merge.From == c.Param("id") || (merge.History && merge.Mode != "") {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	id := c.Param("id")
+	merge.Creator, merge.Scope = requestCreator(c), requestScope(c)
+
+	var records []FragmentRecord
+	var err error
+	if merge.Async {
+		err = cs.DB.View(func(tx *bolt.Tx) error {
+			_, _, err := cs.getMergedChartas(tx, id, &merge)
+			return err
+		})
+	} else {
+		records, err = cs.runMerge(c.Request.Context(), id, &merge, func(float64) {})
+	}
+	switch {
+	case errors.Is(err, errChartaNotFound):
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	case errors.Is(err, errNoOverlap):
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	case err != nil:
+		c.AbortWithStatus(quotaStatus(err))
+		return
+	}
+
+	if merge.Async {
+		job, err := cs.submitJob("merge", id, requestProject(c), func(ctx context.Context, job *Job, progress func(float64)) (interface{}, error) {
+			return cs.runMerge(ctx, id, &merge, progress)
+		})
+		cs.respondWithJob(c, job, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, records)
+}
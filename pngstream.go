@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// The standard image/png package always holds the whole image in memory,
+// which is too much for the largest chartas. pngRowWriter and pngRowReader
+// encode and decode PNG images one row at a time instead.
+
+const pngIDATSize = 1 << 16
+
+var (
+	pngSignature      = []byte("\x89PNG\r\n\x1a\n")
+	errUnsupportedPNG = errors.New("png: unsupported format")
+)
+
+type pngChunkWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (cw *pngChunkWriter) writeChunk(name string, data []byte) error {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	copy(header[4:], name)
+
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write(header[4:])
+	_, _ = crc.Write(data)
+	footer := make([]byte, 4)
+	binary.BigEndian.PutUint32(footer, crc.Sum32())
+
+	for _, b := range [][]byte{header, data, footer} {
+		if _, err := cw.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write collects compressed data and emits it as IDAT chunks.
+func (cw *pngChunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		free := pngIDATSize - len(cw.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		cw.buf = append(cw.buf, p[:free]...)
+		p = p[free:]
+
+		if len(cw.buf) == pngIDATSize {
+			if err := cw.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (cw *pngChunkWriter) flush() error {
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	err := cw.writeChunk("IDAT", cw.buf)
+	cw.buf = cw.buf[:0]
+	return err
+}
+
+// pngRowWriter writes a non-interlaced 8-bit RGBA PNG from NRGBA rows.
+type pngRowWriter struct {
+	chunks *pngChunkWriter
+	zw     *zlib.Writer
+	row    []byte
+	rows   int
+	height int
+}
+
+func newPNGRowWriter(w io.Writer, width, height, level int) (*pngRowWriter, error) {
+	if _, err := w.Write(pngSignature); err != nil {
+		return nil, err
+	}
+
+	chunks := &pngChunkWriter{w: w, buf: make([]byte, 0, pngIDATSize)}
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header[0:], uint32(width))
+	binary.BigEndian.PutUint32(header[4:], uint32(height))
+	header[8] = 8
+	header[9] = 6
+	if err := chunks.writeChunk("IHDR", header); err != nil {
+		return nil, err
+	}
+
+	zw, err := zlib.NewWriterLevel(chunks, level)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pngRowWriter{
+		chunks: chunks,
+		zw:     zw,
+		row:    make([]byte, 1+4*width),
+		height: height,
+	}, nil
+}
+
+// WriteRow writes the next row given as NRGBA pixels without filtering.
+func (pw *pngRowWriter) WriteRow(pix []byte) error {
+	if pw.rows == pw.height {
+		return errors.New("png: too many rows")
+	}
+	pw.rows++
+
+	copy(pw.row[1:], pix)
+	_, err := pw.zw.Write(pw.row)
+	return err
+}
+
+func (pw *pngRowWriter) Close() error {
+	if pw.rows != pw.height {
+		return errors.New("png: not enough rows")
+	}
+	if err := pw.zw.Close(); err != nil {
+		return err
+	}
+	if err := pw.chunks.flush(); err != nil {
+		return err
+	}
+	return pw.chunks.writeChunk("IEND", nil)
+}
+
+// pngRowReader reads a non-interlaced PNG row by row and converts the rows to
+// NRGBA pixels. Sub-byte depths are not supported.
+type pngRowReader struct {
+	r         *bufio.Reader
+	idat      *pngIDATReader
+	zr        io.ReadCloser
+	width     int
+	height    int
+	depth     int
+	colorType int
+	bpp       int
+	palette   [][4]byte
+	cur       []byte
+	prev      []byte
+	rows      int
+}
+
+// pngChunkLimits are the longest chunks newPNGRowReader reads.
+var pngChunkLimits = map[string]int{"IHDR": 13, "PLTE": 3 * 256, "tRNS": 256, "IEND": 0}
+
+func newPNGRowReader(r io.Reader) (*pngRowReader, error) {
+	pr := &pngRowReader{r: bufio.NewReader(r)}
+
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(pr.r, signature); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(signature, pngSignature) {
+		return nil, errors.New("png: invalid signature")
+	}
+
+	for {
+		name, length, err := pr.readChunkHeader()
+		if err != nil {
+			return nil, err
+		}
+
+		if name == "IDAT" {
+			if pr.width == 0 {
+				return nil, errors.New("png: missing IHDR")
+			}
+			pr.idat = &pngIDATReader{pr: pr, remaining: length}
+			break
+		}
+
+		// Only the chunks the reader needs are read into memory, their
+		// lengths are checked first. The others are skipped.
+		limit, ok := pngChunkLimits[name]
+		if !ok {
+			if _, err = pr.r.Discard(length + 4); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if length > limit {
+			return nil, errors.New("png: invalid " + name)
+		}
+		data := make([]byte, length)
+		if _, err = io.ReadFull(pr.r, data); err != nil {
+			return nil, err
+		}
+		if _, err = pr.r.Discard(4); err != nil {
+			return nil, err
+		}
+
+		switch name {
+		case "IHDR":
+			err = pr.parseHeader(data)
+		case "PLTE":
+			pr.palette = make([][4]byte, len(data)/3)
+			for i := range pr.palette {
+				pr.palette[i] = [4]byte{data[3*i], data[3*i+1], data[3*i+2], 255}
+			}
+		case "tRNS":
+			for i := 0; i < len(data) && i < len(pr.palette); i++ {
+				pr.palette[i][3] = data[i]
+			}
+		case "IEND":
+			return nil, errors.New("png: missing IDAT")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	zr, err := zlib.NewReader(pr.idat)
+	if err != nil {
+		return nil, err
+	}
+	pr.zr = zr
+
+	rowSize := 1 + (pr.width*pr.bpp*pr.depth+7)/8
+	pr.cur = make([]byte, rowSize)
+	pr.prev = make([]byte, rowSize)
+	return pr, nil
+}
+
+func (pr *pngRowReader) parseHeader(data []byte) error {
+	if len(data) != 13 {
+		return errors.New("png: invalid IHDR")
+	}
+
+	pr.width = int(binary.BigEndian.Uint32(data[0:]))
+	pr.height = int(binary.BigEndian.Uint32(data[4:]))
+	pr.depth = int(data[8])
+	pr.colorType = int(data[9])
+	if data[12] != 0 || (pr.depth != 8 && pr.depth != 16) || pr.width <= 0 || pr.height <= 0 {
+		return errUnsupportedPNG
+	}
+	if err := checkImageSize(pr.width, pr.height); err != nil {
+		return err
+	}
+
+	switch pr.colorType {
+	case 0:
+		pr.bpp = 1
+	case 2:
+		pr.bpp = 3
+	case 3:
+		pr.bpp = 1
+		if pr.depth != 8 {
+			return errUnsupportedPNG
+		}
+	case 4:
+		pr.bpp = 2
+	case 6:
+		pr.bpp = 4
+	default:
+		return errUnsupportedPNG
+	}
+	return nil
+}
+
+func (pr *pngRowReader) readChunkHeader() (string, int, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(pr.r, header); err != nil {
+		return "", 0, err
+	}
+	return string(header[4:]), int(binary.BigEndian.Uint32(header)), nil
+}
+
+func (pr *pngRowReader) Size() (int, int) {
+	return pr.width, pr.height
+}
+
+// ReadRow decodes the next row into pix as NRGBA pixels.
+func (pr *pngRowReader) ReadRow(pix []byte) error {
+	if pr.rows == pr.height {
+		return io.EOF
+	}
+	pr.rows++
+
+	pr.prev, pr.cur = pr.cur, pr.prev
+	if _, err := io.ReadFull(pr.zr, pr.cur); err != nil {
+		return err
+	}
+	if err := unfilterPNGRow(pr.cur, pr.prev, (pr.bpp*pr.depth+7)/8); err != nil {
+		return err
+	}
+
+	data := pr.cur[1:]
+	step := pr.depth / 8
+	for x := 0; x < pr.width; x++ {
+		p := pix[4*x : 4*x+4]
+		s := data[x*pr.bpp*step:]
+		switch pr.colorType {
+		case 0:
+			p[0], p[1], p[2], p[3] = s[0], s[0], s[0], 255
+		case 2:
+			p[0], p[1], p[2], p[3] = s[0], s[step], s[2*step], 255
+		case 3:
+			if int(s[0]) >= len(pr.palette) {
+				return errors.New("png: palette index out of range")
+			}
+			c := pr.palette[s[0]]
+			p[0], p[1], p[2], p[3] = c[0], c[1], c[2], c[3]
+		case 4:
+			p[0], p[1], p[2], p[3] = s[0], s[0], s[0], s[step]
+		case 6:
+			p[0], p[1], p[2], p[3] = s[0], s[step], s[2*step], s[3*step]
+		}
+	}
+	return nil
+}
+
+func (pr *pngRowReader) Close() error {
+	return pr.zr.Close()
+}
+
+func unfilterPNGRow(cur, prev []byte, bpp int) error {
+	data, up := cur[1:], prev[1:]
+	switch cur[0] {
+	case 0:
+	case 1:
+		for i := bpp; i < len(data); i++ {
+			data[i] += data[i-bpp]
+		}
+	case 2:
+		for i := range data {
+			data[i] += up[i]
+		}
+	case 3:
+		for i := range data {
+			var left int
+			if i >= bpp {
+				left = int(data[i-bpp])
+			}
+			data[i] += byte((left + int(up[i])) / 2)
+		}
+	case 4:
+		for i := range data {
+			var a, c int
+			if i >= bpp {
+				a, c = int(data[i-bpp]), int(up[i-bpp])
+			}
+			data[i] += paeth(a, int(up[i]), c)
+		}
+	default:
+		return errors.New("png: invalid filter")
+	}
+	return nil
+}
+
+func paeth(a, b, c int) byte {
+	p := a + b - c
+	pa, pb, pc := abs(p-a), abs(p-b), abs(p-c)
+	switch {
+	case pa <= pb && pa <= pc:
+		return byte(a)
+	case pb <= pc:
+		return byte(b)
+	default:
+		return byte(c)
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// pngIDATReader joins the data of consecutive IDAT chunks.
+type pngIDATReader struct {
+	pr        *pngRowReader
+	remaining int
+	done      bool
+}
+
+func (ir *pngIDATReader) Read(p []byte) (int, error) {
+	for ir.remaining == 0 {
+		if ir.done {
+			return 0, io.EOF
+		}
+		if _, err := ir.pr.r.Discard(4); err != nil {
+			return 0, err
+		}
+		name, length, err := ir.pr.readChunkHeader()
+		if err != nil {
+			return 0, err
+		}
+		if name != "IDAT" {
+			ir.done = true
+			return 0, io.EOF
+		}
+		ir.remaining = length
+	}
+
+	if len(p) > ir.remaining {
+		p = p[:ir.remaining]
+	}
+	n, err := ir.pr.r.Read(p)
+	ir.remaining -= n
+	return n, err
+}
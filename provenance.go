@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"os"
+)
+
+type ProvenanceEntry struct {
+	Label    int            `json:"label"`
+	Fragment FragmentRecord `json:"fragment"`
+}
+
+// provenanceBase is the label of the pixels that were restored before the
+// fragment history starts, such as those of imported chartas.
+const provenanceBase = math.MaxUint16
+
+// Provenance attributes every pixel of a region to the fragment it comes from.
+// Labels is a 16-bit grayscale PNG where 0 marks unrestored pixels,
+// provenanceBase the pixels older than the history and any other value is the
+// label of an entry of Legend.
+type Provenance struct {
+	X      int               `json:"x"`
+	Y      int               `json:"y"`
+	Width  int               `json:"width"`
+	Height int               `json:"height"`
+	Legend []ProvenanceEntry `json:"legend"`
+	Labels []byte            `json:"labels"`
+}
+
+// provenanceLabels replays the fragment history of region r and records the
+// last fragment that has contributed to every pixel. Like recomposite, it
+// attributes the restored pixels that no fragment of the history has drawn to
+// the base. Fragments that only fill gaps don't take over pixels restored
+// before them, whether by a fragment or by the base.
+func (cs *ChartographerService) provenanceLabels(tx *bolt.Tx, charta *Charta, r image.Rectangle) (*image.Gray16, []ProvenanceEntry, error) {
+	labels := image.NewGray16(r)
+	legend := []ProvenanceEntry{}
+
+	records, err := findFragments(tx, charta.Id, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) > provenanceBase-1 {
+		records = records[len(records)-(provenanceBase-1):]
+	}
+
+	current, err := cs.store.Read(charta, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	area := current.Bounds()
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			if current.NRGBAAt(x, y).A != 0 {
+				labels.SetGray16(x, y, color.Gray16{Y: provenanceBase})
+			}
+		}
+	}
+
+	// A pixel first drawn by a fragment that only fills gaps still comes from
+	// the base if the fragment didn't leave its color there.
+	drawn := make([]bool, r.Dx()*r.Dy())
+	images := make([]*image.NRGBA, len(records))
+	for i := range records {
+		images[i], err = cs.readFragmentImage(&records[i])
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		area := images[i].Bounds().Intersect(r)
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			for x := area.Min.X; x < area.Max.X; x++ {
+				p := images[i].NRGBAAt(x, y)
+				if p.A == 0 {
+					continue
+				}
+				j := (y-r.Min.Y)*r.Dx() + x - r.Min.X
+				if records[i].Mode != modeKeepExisting || !drawn[j] && current.NRGBAAt(x, y) == p {
+					labels.SetGray16(x, y, color.Gray16{})
+				}
+				drawn[j] = true
+			}
+		}
+	}
+
+	for i, img := range images {
+		if img == nil {
+			continue
+		}
+
+		label := uint16(len(legend) + 1)
+		used := false
+		area := img.Bounds().Intersect(r)
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			for x := area.Min.X; x < area.Max.X; x++ {
+				if img.NRGBAAt(x, y).A == 0 {
+					continue
+				}
+				if records[i].Mode == modeKeepExisting && labels.Gray16At(x, y).Y != 0 {
+					continue
+				}
+				labels.SetGray16(x, y, color.Gray16{Y: label})
+				used = true
+			}
+		}
+
+		if used {
+			legend = append(legend, ProvenanceEntry{Label: int(label), Fragment: records[i]})
+		}
+	}
+
+	return labels, legend, nil
+}
+
+func (cs *ChartographerService) getProvenanceEndpoint(c *gin.Context) {
+	var fragment Fragment
+	if err := c.BindQuery(&fragment); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	r := image.Rect(*fragment.X, *fragment.Y, *fragment.X+fragment.Width, *fragment.Y+fragment.Height)
+
+	var provenance *Provenance
+	err := cs.DB.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("chartas")).Get([]byte(c.Param("id")))
+		if v == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return nil
+		}
+
+		var charta Charta
+		err := json.Unmarshal(v, &charta)
+		if err != nil {
+			return err
+		}
+
+		if !r.Overlaps(image.Rect(0, 0, charta.Width, charta.Height)) {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return nil
+		}
+
+		labels, legend, err := cs.provenanceLabels(tx, &charta, r)
+		if err != nil {
+			return err
+		}
+
+		buf := new(bytes.Buffer)
+		err = png.Encode(buf, labels)
+		if err != nil {
+			return err
+		}
+
+		provenance = &Provenance{
+			X:      r.Min.X,
+			Y:      r.Min.Y,
+			Width:  r.Dx(),
+			Height: r.Dy(),
+			Legend: legend,
+			Labels: buf.Bytes(),
+		}
+		return nil
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if c.IsAborted() {
+		return
+	}
+
+	c.JSON(http.StatusOK, provenance)
+}
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Chartas belong to the project given in the X-Project header, or to the
+// default project. With authentication the API key decides the project.
+// Every project is limited by the default quota of the service unless it has
+// a quota of its own in the "quotas" bucket. A zero limit means no limit.
+//
+// Quotas are checked in the transaction that creates or grows a charta, so
+// concurrent requests can't exceed them together. Chartas in the trash are
+// not counted.
+//
+// The usage is counted as the chartas change rather than when it is needed:
+// the "charta-usage" bucket keeps what every charta adds to its project and
+// the "usage" bucket the sums per project. The disk space of the fragment
+// images is updated with every image written or removed, so the fragment
+// directories are only walked once, to count an existing database.
+//
+// Imports and clones share files through hard links. Each link of a file is
+// counted with its share of the size, so a file counts once however many
+// chartas use it. Adding or removing a link changes the shares of the other
+// links too, so the chartas that share files are recounted when one of them
+// changes.
+
+const (
+	defaultProject = "default"
+	projectHeader  = "X-Project"
+)
+
+var (
+	errChartaQuota  = errors.New("charta quota exceeded")
+	errStorageQuota = errors.New("storage quota exceeded")
+)
+
+type Quota struct {
+	Chartas int64 `json:"chartas"`
+	Pixels  int64 `json:"pixels"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// QuotaQuery sets the limits of a project. Limits that are left out keep the
+// default of the service.
+type QuotaQuery struct {
+	Chartas *int64 `form:"chartas" binding:"omitempty,gte=0"`
+	Pixels  *int64 `form:"pixels" binding:"omitempty,gte=0"`
+	Bytes   *int64 `form:"bytes" binding:"omitempty,gte=0"`
+}
+
+type ProjectUsage struct {
+	Project string `json:"project"`
+	Usage   Quota  `json:"usage"`
+	Limits  Quota  `json:"limits"`
+}
+
+// requestProject returns the project the request is made for. Only admin
+// keys may choose it.
+func requestProject(c *gin.Context) string {
+	if key := requestAPIKey(c); key != nil && !key.Admin {
+		if key.Project == "" {
+			return defaultProject
+		}
+		return key.Project
+	}
+	if project := c.GetHeader(projectHeader); project != "" {
+		return project
+	}
+	return defaultProject
+}
+
+func chartaProject(charta *Charta) string {
+	if charta.Project == "" {
+		return defaultProject
+	}
+	return charta.Project
+}
+
+// quotaStatus returns the response status for a failed request, 500 if the
+// error is not about quotas.
+func quotaStatus(err error) int {
+	switch {
+	case errors.Is(err, errChartaQuota):
+		return http.StatusForbidden
+	case errors.Is(err, errStorageQuota):
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+func getQuotaQuery(tx *bolt.Tx, project string) (*QuotaQuery, error) {
+	var query QuotaQuery
+	v := tx.Bucket([]byte("quotas")).Get([]byte(project))
+	if v == nil {
+		return &query, nil
+	}
+	err := json.Unmarshal(v, &query)
+	if err != nil {
+		return nil, err
+	}
+	return &query, nil
+}
+
+func (cs *ChartographerService) projectLimits(tx *bolt.Tx, project string) (Quota, error) {
+	limits := cs.Quota
+	query, err := getQuotaQuery(tx, project)
+	if err != nil {
+		return limits, err
+	}
+	for _, limit := range []struct {
+		value *int64
+		set   *int64
+	}{
+		{&limits.Chartas, query.Chartas},
+		{&limits.Pixels, query.Pixels},
+		{&limits.Bytes, query.Bytes},
+	} {
+		if limit.set != nil {
+			*limit.value = *limit.set
+		}
+	}
+	return limits, nil
+}
+
+// chartaUsage is what a charta adds to the usage of its project.
+type chartaUsage struct {
+	Project   string `json:"project"`
+	Pixels    int64  `json:"pixels"`
+	Bytes     int64  `json:"bytes"`
+	Fragments int64  `json:"fragments"`
+	Trashed   bool   `json:"trashed,omitempty"`
+	// Shared is set while some fragment image of the charta has other hard
+	// links, so that its share changes without the charta being written.
+	Shared bool `json:"shared,omitempty"`
+	// Linked lists the chartas cloned from the charta or from the same one,
+	// which may share files with it.
+	Linked []string `json:"linked,omitempty"`
+}
+
+func (u *chartaUsage) quota() Quota {
+	if u == nil || u.Trashed {
+		return Quota{}
+	}
+	return Quota{Chartas: 1, Pixels: u.Pixels, Bytes: u.Bytes + u.Fragments}
+}
+
+// storeBytes returns the disk space taken by the pixels of the charta. For
+// stores that can't tell, the size of the uncompressed pixels is counted.
+func (cs *ChartographerService) storeBytes(charta *Charta) (int64, error) {
+	if store, ok := cs.store.(sizedStore); ok {
+		return store.Size(charta)
+	}
+	return 4 * int64(charta.Width) * int64(charta.Height), nil
+}
+
+// fragmentBytes returns the share of the image of the fragment, 0 if it has
+// none.
+func (cs *ChartographerService) fragmentBytes(record *FragmentRecord) int64 {
+	info, err := os.Stat(cs.fragmentFilename(record.ChartaId, record.Id))
+	if err != nil {
+		return 0
+	}
+	return sharedSize(info)
+}
+
+// fragmentUsage counts the shares of all fragment images of the charta and
+// reports whether any of them has other links.
+func (cs *ChartographerService) fragmentUsage(id string) (int64, bool, error) {
+	entries, err := os.ReadDir(fmt.Sprintf("%s/fragments/%s", cs.pathName, id))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	var size int64
+	shared := false
+	for _, entry := range entries {
+		// Staged images only count once they replace the images of their
+		// fragments.
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		size += sharedSize(info)
+		shared = shared || linkCount(info) > 1
+	}
+	return size, shared, nil
+}
+
+func getChartaUsage(tx *bolt.Tx, id string) (*chartaUsage, error) {
+	v := tx.Bucket([]byte("charta-usage")).Get([]byte(id))
+	if v == nil {
+		return nil, nil
+	}
+	var usage chartaUsage
+	if err := json.Unmarshal(v, &usage); err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// usageCharta returns the charta with the given id, in the trash too.
+func usageCharta(tx *bolt.Tx, id string) (*Charta, error) {
+	charta, err := getCharta(tx, id)
+	if err != nil || charta != nil {
+		return charta, err
+	}
+	entry, err := getTrashEntry(tx, id)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	return &entry.Charta, nil
+}
+
+func addProjectUsage(tx *bolt.Tx, project string, delta Quota, sign int64) error {
+	if delta == (Quota{}) {
+		return nil
+	}
+	usage, err := getProjectUsage(tx, project)
+	if err != nil {
+		return err
+	}
+	usage.Chartas += sign * delta.Chartas
+	usage.Pixels += sign * delta.Pixels
+	usage.Bytes += sign * delta.Bytes
+
+	b := tx.Bucket([]byte("usage"))
+	if usage == (Quota{}) {
+		return b.Delete([]byte(project))
+	}
+	buf, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(project), buf)
+}
+
+// putChartaUsage replaces the usage old of a charta, nil if it had none, with
+// usage, nil to remove it.
+func putChartaUsage(tx *bolt.Tx, id string, old, usage *chartaUsage) error {
+	if old != nil {
+		if err := addProjectUsage(tx, old.Project, old.quota(), -1); err != nil {
+			return err
+		}
+	}
+	b := tx.Bucket([]byte("charta-usage"))
+	if usage == nil {
+		return b.Delete([]byte(id))
+	}
+	if err := addProjectUsage(tx, usage.Project, usage.quota(), 1); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(id), buf)
+}
+
+// accountCharta counts the charta as it is now for its project. fragments is
+// the disk space its fragment images have gained since it was last counted,
+// negative if they have shrunk. The fragment images of a new charta, or of
+// one that shares them, are counted from scratch instead.
+func (cs *ChartographerService) accountCharta(tx *bolt.Tx, charta *Charta, fragments int64) error {
+	old, err := getChartaUsage(tx, charta.Id)
+	if err != nil {
+		return err
+	}
+	var usage chartaUsage
+	if old != nil {
+		usage = *old
+	}
+	usage.Project = chartaProject(charta)
+	usage.Pixels = int64(charta.Width) * int64(charta.Height)
+	usage.Bytes, err = cs.storeBytes(charta)
+	if err != nil {
+		return err
+	}
+	if old == nil || old.Shared {
+		usage.Fragments, usage.Shared, err = cs.fragmentUsage(charta.Id)
+		if err != nil {
+			return err
+		}
+	} else {
+		usage.Fragments += fragments
+	}
+	if err = putChartaUsage(tx, charta.Id, old, &usage); err != nil {
+		return err
+	}
+	// Writing may have broken links to the files of the linked chartas.
+	return cs.recountCharta(tx, usage.Linked...)
+}
+
+// recountFragments counts the chartas whose fragment images have changed
+// after a transaction again if they were counted from the images as they
+// were in it: those that share images and the chartas they share them with.
+func (cs *ChartographerService) recountFragments(chartas map[string]bool) error {
+	var ids []string
+	err := cs.DB.View(func(tx *bolt.Tx) error {
+		for id := range chartas {
+			usage, err := getChartaUsage(tx, id)
+			if err != nil {
+				return err
+			}
+			if usage != nil && (usage.Shared || len(usage.Linked) > 0) {
+				ids = append(append(ids, id), usage.Linked...)
+			}
+		}
+		return nil
+	})
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	return cs.DB.Update(func(tx *bolt.Tx) error {
+		return cs.recountCharta(tx, ids...)
+	})
+}
+
+// recountCharta counts the chartas with the given ids from scratch.
+func (cs *ChartographerService) recountCharta(tx *bolt.Tx, ids ...string) error {
+	for _, id := range ids {
+		old, err := getChartaUsage(tx, id)
+		if err != nil {
+			return err
+		}
+		charta, err := usageCharta(tx, id)
+		if err != nil {
+			return err
+		}
+		if old == nil || charta == nil {
+			continue
+		}
+
+		usage := *old
+		if usage.Bytes, err = cs.storeBytes(charta); err != nil {
+			return err
+		}
+		if usage.Fragments, usage.Shared, err = cs.fragmentUsage(id); err != nil {
+			return err
+		}
+		if err = putChartaUsage(tx, id, old, &usage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkUsage records that clone shares files with src and with the chartas
+// src shares files with, and recounts them since their shares have shrunk.
+func (cs *ChartographerService) linkUsage(tx *bolt.Tx, srcId, cloneId string) error {
+	src, err := getChartaUsage(tx, srcId)
+	if err != nil || src == nil {
+		return err
+	}
+	group := append([]string{srcId}, src.Linked...)
+	for _, id := range append(group, cloneId) {
+		old, err := getChartaUsage(tx, id)
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			continue
+		}
+		usage := *old
+		usage.Linked = nil
+		for _, other := range append(group, cloneId) {
+			if other != id {
+				usage.Linked = append(usage.Linked, other)
+			}
+		}
+		if err = putChartaUsage(tx, id, old, &usage); err != nil {
+			return err
+		}
+	}
+	return cs.recountCharta(tx, group...)
+}
+
+// accountFile adds the change of the size of a stored file, given relative to
+// the storage path, to the usage of its charta.
+func (cs *ChartographerService) accountFile(tx *bolt.Tx, file string, delta int64) error {
+	id, fragment := fileCharta(file)
+	old, err := getChartaUsage(tx, id)
+	if err != nil || old == nil {
+		return err
+	}
+	if old.Shared || len(old.Linked) > 0 {
+		return cs.recountCharta(tx, append([]string{id}, old.Linked...)...)
+	}
+
+	usage := *old
+	if fragment {
+		usage.Fragments += delta
+	} else {
+		usage.Bytes += delta
+	}
+	return putChartaUsage(tx, id, old, &usage)
+}
+
+// fileCharta returns the id of the charta a stored file, given relative to
+// the storage path, belongs to and whether it is a fragment image. The id is
+// empty for other files.
+func fileCharta(file string) (string, bool) {
+	parts := strings.Split(filepath.ToSlash(file), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "chartas":
+		return strings.TrimSuffix(parts[1], filepath.Ext(parts[1])), false
+	case len(parts) == 3 && parts[0] == "fragments":
+		return parts[1], true
+	}
+	return "", false
+}
+
+// trashUsage stops or starts counting a charta that is moved to or restored
+// from the trash.
+func trashUsage(tx *bolt.Tx, id string, trashed bool) error {
+	old, err := getChartaUsage(tx, id)
+	if err != nil || old == nil {
+		return err
+	}
+	usage := *old
+	usage.Trashed = trashed
+	return putChartaUsage(tx, id, old, &usage)
+}
+
+// dropUsage stops counting a purged charta. The chartas it shared files with
+// are recounted, since their shares have grown.
+func (cs *ChartographerService) dropUsage(tx *bolt.Tx, id string) error {
+	old, err := getChartaUsage(tx, id)
+	if err != nil || old == nil {
+		return err
+	}
+	if err = putChartaUsage(tx, id, old, nil); err != nil {
+		return err
+	}
+
+	for _, other := range old.Linked {
+		linked, err := getChartaUsage(tx, other)
+		if err != nil {
+			return err
+		}
+		if linked == nil {
+			continue
+		}
+		usage := *linked
+		usage.Linked = nil
+		for _, l := range linked.Linked {
+			if l != id {
+				usage.Linked = append(usage.Linked, l)
+			}
+		}
+		if err = putChartaUsage(tx, other, linked, &usage); err != nil {
+			return err
+		}
+	}
+	return cs.recountCharta(tx, old.Linked...)
+}
+
+// countUsage counts the usage of a database that has no counters yet. The
+// chartas that share files are found by the identity of the files.
+func (cs *ChartographerService) countUsage() error {
+	return cs.DB.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("usage")) != nil {
+			return nil
+		}
+		for _, name := range []string{"usage", "charta-usage"} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+
+		count := func(charta *Charta, trashed bool) error {
+			if err := cs.accountCharta(tx, charta, 0); err != nil {
+				return err
+			}
+			if trashed {
+				return trashUsage(tx, charta.Id, true)
+			}
+			return nil
+		}
+		err := tx.Bucket([]byte("chartas")).ForEach(func(_, v []byte) error {
+			var charta Charta
+			if err := json.Unmarshal(v, &charta); err != nil {
+				return err
+			}
+			return count(&charta, false)
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte("trash")).ForEach(func(_, v []byte) error {
+			var entry TrashEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			return count(&entry.Charta, true)
+		})
+		if err != nil {
+			return err
+		}
+
+		linked, err := cs.linkedChartas()
+		if err != nil {
+			return err
+		}
+		for id, others := range linked {
+			old, err := getChartaUsage(tx, id)
+			if err != nil {
+				return err
+			}
+			if old == nil {
+				continue
+			}
+			usage := *old
+			usage.Linked = others
+			if err = putChartaUsage(tx, id, old, &usage); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// linkedChartas finds the chartas whose stored files are hard links to the
+// same files, for each charta the sorted ids of the others.
+func (cs *ChartographerService) linkedChartas() (map[string][]string, error) {
+	files := map[string]map[string]bool{}
+	for _, dir := range []string{"chartas", "fragments"} {
+		err := filepath.WalkDir(filepath.Join(cs.pathName, dir), func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil || linkCount(info) < 2 {
+				return err
+			}
+			rel, err := filepath.Rel(cs.pathName, path)
+			if err != nil {
+				return err
+			}
+			id, _ := fileCharta(rel)
+			key := fileKey(info)
+			if id == "" || key == "" {
+				return nil
+			}
+			if files[key] == nil {
+				files[key] = map[string]bool{}
+			}
+			files[key][id] = true
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	groups := map[string]map[string]bool{}
+	for _, ids := range files {
+		for id := range ids {
+			for other := range ids {
+				if other == id {
+					continue
+				}
+				if groups[id] == nil {
+					groups[id] = map[string]bool{}
+				}
+				groups[id][other] = true
+			}
+		}
+	}
+	linked := map[string][]string{}
+	for id, others := range groups {
+		for other := range others {
+			linked[id] = append(linked[id], other)
+		}
+		sort.Strings(linked[id])
+	}
+	return linked, nil
+}
+
+func getProjectUsage(tx *bolt.Tx, project string) (Quota, error) {
+	var usage Quota
+	v := tx.Bucket([]byte("usage")).Get([]byte(project))
+	if v == nil {
+		return usage, nil
+	}
+	err := json.Unmarshal(v, &usage)
+	return usage, err
+}
+
+// checkQuota checks that the project may add the given number of chartas and
+// pixels. Only what is added is checked, so a project over a lowered limit
+// can still use what it has. The disk space can't be known in advance, so
+// only a project that has already reached its limit is stopped; every write
+// that stores images checks it, even if it adds no chartas or pixels.
+func (cs *ChartographerService) checkQuota(tx *bolt.Tx, project string, chartas, pixels int64) error {
+	limits, err := cs.projectLimits(tx, project)
+	if err != nil || limits == (Quota{}) {
+		return err
+	}
+	usage, err := getProjectUsage(tx, project)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case chartas > 0 && limits.Chartas > 0 && usage.Chartas+chartas > limits.Chartas:
+		return fmt.Errorf("%w: %d of %d chartas", errChartaQuota, usage.Chartas, limits.Chartas)
+	case pixels > 0 && limits.Pixels > 0 && usage.Pixels+pixels > limits.Pixels:
+		return fmt.Errorf("%w: %d of %d pixels", errStorageQuota, usage.Pixels, limits.Pixels)
+	case limits.Bytes > 0 && usage.Bytes >= limits.Bytes:
+		return fmt.Errorf("%w: %d of %d bytes", errStorageQuota, usage.Bytes, limits.Bytes)
+	}
+	return nil
+}
+
+func (cs *ChartographerService) respondWithUsage(c *gin.Context, project string) {
+	usage := ProjectUsage{Project: project}
+	err := cs.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		usage.Limits, err = cs.projectLimits(tx, project)
+		if err != nil {
+			return err
+		}
+		usage.Usage, err = getProjectUsage(tx, project)
+		return err
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, usage)
+}
+
+// usageEndpoint returns the usage and the limits of the project of the request.
+func (cs *ChartographerService) usageEndpoint(c *gin.Context) {
+	cs.respondWithUsage(c, requestProject(c))
+}
+
+func (cs *ChartographerService) getQuotaEndpoint(c *gin.Context) {
+	cs.respondWithUsage(c, c.Param("project"))
+}
+
+func (cs *ChartographerService) putQuotaEndpoint(c *gin.Context) {
+	var query QuotaQuery
+	if err := c.BindQuery(&query); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	err := cs.DB.Update(func(tx *bolt.Tx) error {
+		buf, err := json.Marshal(query)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("quotas")).Put([]byte(c.Param("project")), buf)
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	cs.respondWithUsage(c, c.Param("project"))
+}
+
+// deleteQuotaEndpoint returns the project to the default quota.
+func (cs *ChartographerService) deleteQuotaEndpoint(c *gin.Context) {
+	err := cs.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("quotas")).Delete([]byte(c.Param("project")))
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
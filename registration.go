@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/image/bmp"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+)
+
+const (
+	registrationSamples    = 128
+	registrationMinOverlap = 0.1
+	// registrationMaxCost bounds the work of a single request, a few
+	// seconds at most.
+	registrationMaxCost = 4e9
+)
+
+type RegistrationQuery struct {
+	Fragment
+	Radius    int     `form:"radius" binding:"omitempty,gte=0,lte=1000"`
+	MaxAngle  float64 `form:"maxAngle" binding:"omitempty,gte=0,lte=45"`
+	AngleStep float64 `form:"angleStep" binding:"omitempty,gt=0,lte=45"`
+	Place     bool    `form:"place"`
+}
+
+type RegistrationResult struct {
+	X          int             `json:"x"`
+	Y          int             `json:"y"`
+	Angle      float64         `json:"angle"`
+	Score      float64         `json:"score"`
+	Overlap    float64         `json:"overlap"`
+	Confidence float64         `json:"confidence"`
+	Placed     bool            `json:"placed"`
+	Conflicts  *ConflictReport `json:"conflicts,omitempty"`
+}
+
+// cost estimates the work of the search: every angle rotates the fragment and
+// compares it with the charta at the positions visited by register, each over
+// at most registrationSamples² pixels.
+func (q *RegistrationQuery) cost() float64 {
+	angles := math.Floor(2*q.MaxAngle/q.AngleStep) + 1
+
+	step := q.Radius / 16
+	if step < 1 {
+		step = 1
+	}
+	positions := 2*q.Radius/step + 1
+	matches := float64(positions*positions) + 25*math.Log2(float64(step))
+	pixels := float64(q.Width) * float64(q.Height)
+	samples := math.Min(pixels, registrationSamples*registrationSamples)
+	return angles * (pixels + matches*samples)
+}
+
+// grayImage keeps the luminance of an image together with the pixels that
+// carry data: the restored part of a charta or the rotated fragment itself.
+type grayImage struct {
+	Pix    []uint8
+	Mask   []bool
+	Width  int
+	Height int
+}
+
+func newGrayImage(img *image.NRGBA) *grayImage {
+	b := img.Bounds()
+	g := &grayImage{
+		Pix:    make([]uint8, b.Dx()*b.Dy()),
+		Mask:   make([]bool, b.Dx()*b.Dy()),
+		Width:  b.Dx(),
+		Height: b.Dy(),
+	}
+
+	for y := 0; y < g.Height; y++ {
+		for x := 0; x < g.Width; x++ {
+			p := img.NRGBAAt(b.Min.X+x, b.Min.Y+y)
+			i := y*g.Width + x
+			g.Pix[i] = color.GrayModel.Convert(p).(color.Gray).Y
+			g.Mask[i] = p.A >= 128
+		}
+	}
+
+	return g
+}
+
+type registrationMatch struct {
+	X, Y    int
+	Score   float64
+	Overlap float64
+}
+
+// match computes the normalized cross-correlation between the fragment placed
+// at (x, y) and the charta over a grid of fragment samples with the given step.
+func (g *grayImage) match(fragment *grayImage, x, y, step int) registrationMatch {
+	m := registrationMatch{X: x, Y: y, Score: -1}
+
+	var n, total int
+	var sumF, sumC, sumFF, sumCC, sumFC float64
+	for fy := step / 2; fy < fragment.Height; fy += step {
+		for fx := step / 2; fx < fragment.Width; fx += step {
+			fi := fy*fragment.Width + fx
+			if !fragment.Mask[fi] {
+				continue
+			}
+			total++
+
+			cx, cy := x+fx, y+fy
+			if cx < 0 || cy < 0 || cx >= g.Width || cy >= g.Height {
+				continue
+			}
+			ci := cy*g.Width + cx
+			if !g.Mask[ci] {
+				continue
+			}
+
+			f, c := float64(fragment.Pix[fi]), float64(g.Pix[ci])
+			n++
+			sumF += f
+			sumC += c
+			sumFF += f * f
+			sumCC += c * c
+			sumFC += f * c
+		}
+	}
+
+	if total == 0 {
+		return m
+	}
+	m.Overlap = float64(n) / float64(total)
+	if m.Overlap < registrationMinOverlap {
+		return m
+	}
+
+	cov := sumFC - sumF*sumC/float64(n)
+	varF := sumFF - sumF*sumF/float64(n)
+	varC := sumCC - sumC*sumC/float64(n)
+	switch {
+	case varF < 1e-9 && varC < 1e-9:
+		// Both sides are flat, so they agree only if they have the same level.
+		if math.Abs(sumF-sumC)/float64(n) < 1 {
+			m.Score = 1
+		} else {
+			m.Score = 0
+		}
+	case varF < 1e-9 || varC < 1e-9:
+		m.Score = 0
+	default:
+		m.Score = cov / math.Sqrt(varF*varC)
+	}
+
+	return m
+}
+
+// register searches the window of the given radius around (x, y) for the best
+// position of the fragment. The window is scanned coarsely first and the best
+// candidate is then refined with halved steps down to a single pixel.
+func (g *grayImage) register(fragment *grayImage, x, y, radius int) registrationMatch {
+	sampleStep := func(step int) int {
+		size := fragment.Width
+		if fragment.Height > size {
+			size = fragment.Height
+		}
+		s := size / registrationSamples
+		if step > 1 && s < step/2 {
+			s = step / 2
+		}
+		if s < 1 {
+			s = 1
+		}
+		return s
+	}
+
+	step := radius / 16
+	if step < 1 {
+		step = 1
+	}
+
+	best := registrationMatch{X: x, Y: y, Score: -2}
+	for oy := -radius; oy <= radius; oy += step {
+		for ox := -radius; ox <= radius; ox += step {
+			m := g.match(fragment, x+ox, y+oy, sampleStep(step))
+			if m.Score > best.Score {
+				best = m
+			}
+		}
+	}
+
+	for step > 1 {
+		step /= 2
+		center := best
+		for oy := -2 * step; oy <= 2*step; oy += step {
+			for ox := -2 * step; ox <= 2*step; ox += step {
+				cx, cy := center.X+ox, center.Y+oy
+				if cx < x-radius || cx > x+radius || cy < y-radius || cy > y+radius {
+					continue
+				}
+				m := g.match(fragment, cx, cy, sampleStep(step))
+				if m.Score > best.Score {
+					best = m
+				}
+			}
+		}
+	}
+
+	return g.match(fragment, best.X, best.Y, sampleStep(1))
+}
+
+func (cs *ChartographerService) registerFragmentEndpoint(c *gin.Context) {
+	var query RegistrationQuery
+	if err := c.BindQuery(&query); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if query.isTransformed() {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if query.Radius == 0 {
+		query.Radius = 50
+	}
+	if query.AngleStep == 0 {
+		query.AngleStep = 1
+	}
+	if query.cost() > registrationMaxCost {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if !cs.chartaExists(c) {
+		return
+	}
+
+	fragmentImg, err := bmp.Decode(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	fragmentNRGBA := imaging.Clone(fragmentImg)
+	x, y := *query.X, *query.Y
+
+	var result *RegistrationResult
+	err = cs.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("chartas"))
+
+		v := b.Get([]byte(c.Param("id")))
+		if v == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return nil
+		}
+
+		var charta Charta
+		err := json.Unmarshal(v, &charta)
+		if err != nil {
+			return err
+		}
+
+		margin := query.Radius + 2*(query.Width+query.Height)
+		window := image.Rect(x-margin, y-margin, x+margin, y+margin).Intersect(image.Rect(0, 0, charta.Width, charta.Height))
+		if window.Empty() {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return nil
+		}
+
+		chartaImg, err := cs.store.Read(&charta, window)
+		if err != nil {
+			return err
+		}
+		chartaGray := newGrayImage(chartaImg)
+
+		for angle := -query.MaxAngle; angle <= query.MaxAngle; angle += query.AngleStep {
+			rotated := fragmentNRGBA
+			if angle != 0 {
+				rotated = imaging.Rotate(fragmentNRGBA, angle, color.Transparent)
+			}
+
+			// Rotation keeps the center of the fragment, so search for the top
+			// left corner of the rotated image and convert it back afterwards.
+			dx := (query.Width - rotated.Bounds().Dx()) / 2
+			dy := (query.Height - rotated.Bounds().Dy()) / 2
+			m := chartaGray.register(newGrayImage(rotated), x+dx-window.Min.X, y+dy-window.Min.Y, query.Radius)
+			if result == nil || m.Score > result.Score {
+				result = &RegistrationResult{
+					X:       m.X - dx + window.Min.X,
+					Y:       m.Y - dy + window.Min.Y,
+					Angle:   angle,
+					Score:   m.Score,
+					Overlap: m.Overlap,
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if c.IsAborted() {
+		return
+	}
+	if result == nil || result.Overlap < registrationMinOverlap {
+		c.AbortWithStatus(http.StatusUnprocessableEntity)
+		return
+	}
+	result.Confidence = math.Max(0, result.Score) * math.Min(1, result.Overlap)
+
+	if query.Place {
+		fragment := query.Fragment
+		fragment.X, fragment.Y, fragment.Angle = &result.X, &result.Y, result.Angle
+		report, ok := cs.addFragment(c, &fragment, fragmentImg)
+		if !ok {
+			return
+		}
+		result.Placed = true
+		if fragment.Report {
+			result.Conflicts = &report
+		}
+	}
+
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+const (
+	minExposureOverlap = 16
+	maxExposureGain    = 2
+)
+
+// featherFragment blends src like blendFragment, but near the border of the
+// fragment the new pixels fade into the restored ones over width pixels. The
+// border is the edge of full, the whole fragment in charta coordinates, or of
+// the transparent part of src, so cropping by the charta bounds doesn't
+// introduce a seam.
+func featherFragment(dst *image.NRGBA, r image.Rectangle, src *image.NRGBA, sp image.Point, mode string, full image.Rectangle, width int) {
+	r, sp = clipPlacement(dst, r, src, sp)
+	if r.Empty() {
+		return
+	}
+
+	region := r.Inset(-width).Intersect(full)
+	dist := borderDistance(region, func(x, y int) bool {
+		if !(image.Point{X: x, Y: y}).In(r) {
+			return true
+		}
+		return src.NRGBAAt(sp.X+x-r.Min.X, sp.Y+y-r.Min.Y).A != 0
+	})
+
+	blendFragmentWeighted(dst, r, src, sp, mode, func(x, y int) float64 {
+		d := dist[(y-region.Min.Y)*region.Dx()+x-region.Min.X]
+		return math.Min(1, d/float64(width))
+	})
+}
+
+// borderDistance computes the approximate euclidean distance from every pixel
+// of region to the nearest pixel that is not inside, with two chamfer passes.
+// Pixels just outside region are treated as outside.
+func borderDistance(region image.Rectangle, inside func(x, y int) bool) []float64 {
+	w, h := region.Dx(), region.Dy()
+	dist := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if inside(region.Min.X+x, region.Min.Y+y) {
+				dist[y*w+x] = math.Inf(1)
+			}
+		}
+	}
+
+	at := func(x, y int) float64 {
+		if x < 0 || y < 0 || x >= w || y >= h {
+			return 0
+		}
+		return dist[y*w+x]
+	}
+	relax := func(x, y int, neighbours [4][2]int) {
+		i := y*w + x
+		for k, n := range neighbours {
+			step := 1.0
+			if k%2 == 0 {
+				step = math.Sqrt2
+			}
+			if d := at(x+n[0], y+n[1]) + step; d < dist[i] {
+				dist[i] = d
+			}
+		}
+	}
+
+	forward := [4][2]int{{-1, -1}, {0, -1}, {1, -1}, {-1, 0}}
+	backward := [4][2]int{{1, 1}, {0, 1}, {-1, 1}, {1, 0}}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			relax(x, y, forward)
+		}
+	}
+	for y := h - 1; y >= 0; y-- {
+		for x := w - 1; x >= 0; x-- {
+			relax(x, y, backward)
+		}
+	}
+
+	return dist
+}
+
+// compensateExposure returns a copy of src with every channel scaled so that
+// its mean over the restored pixels it overlaps matches the mean of those
+// pixels. src is returned unchanged if the overlap is too small.
+func compensateExposure(dst *image.NRGBA, r image.Rectangle, src *image.NRGBA, sp image.Point) *image.NRGBA {
+	clipped, csp := clipPlacement(dst, r, src, sp)
+
+	var n int
+	var sumD, sumS [3]float64
+	for y := clipped.Min.Y; y < clipped.Max.Y; y++ {
+		for x := clipped.Min.X; x < clipped.Max.X; x++ {
+			s := src.NRGBAAt(csp.X+x-clipped.Min.X, csp.Y+y-clipped.Min.Y)
+			d := dst.NRGBAAt(x, y)
+			if s.A == 0 || d.A == 0 {
+				continue
+			}
+
+			n++
+			sumD[0], sumD[1], sumD[2] = sumD[0]+float64(d.R), sumD[1]+float64(d.G), sumD[2]+float64(d.B)
+			sumS[0], sumS[1], sumS[2] = sumS[0]+float64(s.R), sumS[1]+float64(s.G), sumS[2]+float64(s.B)
+		}
+	}
+	if n < minExposureOverlap {
+		return src
+	}
+
+	var gain [3]float64
+	for i := range gain {
+		gain[i] = 1
+		if sumS[i] > 0 {
+			gain[i] = math.Max(1/maxExposureGain, math.Min(maxExposureGain, sumD[i]/sumS[i]))
+		}
+	}
+
+	scale := func(v uint8, g float64) uint8 {
+		return uint8(math.Min(255, math.Round(float64(v)*g)))
+	}
+
+	b := src.Bounds()
+	compensated := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			s := src.NRGBAAt(x, y)
+			compensated.SetNRGBA(x, y, color.NRGBA{
+				R: scale(s.R, gain[0]),
+				G: scale(s.G, gain[1]),
+				B: scale(s.B, gain[2]),
+				A: s.A,
+			})
+		}
+	}
+
+	return compensated
+}
+
+func mixPixel(d, s color.NRGBA, weight float64) color.NRGBA {
+	mix := func(a, b uint8) uint8 {
+		return uint8(math.Round(float64(a)*(1-weight) + float64(b)*weight))
+	}
+
+	return color.NRGBA{R: mix(d.R, s.R), G: mix(d.G, s.G), B: mix(d.B, s.B), A: mix(d.A, s.A)}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// chartaStore keeps the pixels of chartas. Images passed to and returned by a
+// store are positioned in charta coordinates, and transparent pixels are the
+// ones that haven't been restored yet.
+type chartaStore interface {
+	// Create stores a new transparent charta.
+	Create(charta *Charta) error
+	// Read returns the part of the charta inside r.
+	Read(charta *Charta, r image.Rectangle) (*image.NRGBA, error)
+	// Write replaces the pixels of the charta inside the bounds of img.
+	Write(charta *Charta, img *image.NRGBA) error
+	// Rows opens the charta for reading row by row.
+	Rows(charta *Charta) (chartaRows, error)
+	// Import stores the PNG image in filename as the charta. The file is
+	// not modified and may be shared with the charta.
+	Import(charta *Charta, filename string) error
+	// Copy stores the pixels of src as dst.
+	Copy(src, dst *Charta) error
+	// Resize changes the size of the charta to width x height and moves the
+	// old pixels so that the old top left corner ends up at offset.
+	Resize(charta *Charta, width, height int, offset image.Point) error
+	Delete(charta *Charta) error
+}
+
+// chartaRows reads a snapshot of a charta row by row.
+type chartaRows interface {
+	rowReader
+	// SeekRow makes the next ReadRow return row y.
+	SeekRow(y int) error
+	ModTime() time.Time
+	io.Closer
+}
+
+// releasingStore is implemented by the stores that resize a charta next to
+// its old version. Release deletes the old version once the resized charta is
+// committed.
+type releasingStore interface {
+	Release(old *Charta) error
+}
+
+// sizedStore is implemented by the stores that can tell how much disk space a
+// charta takes.
+type sizedStore interface {
+	Size(charta *Charta) (int64, error)
+}
+
+// checkedStore is implemented by the stores that fsck can verify.
+type checkedStore interface {
+	// List returns the ids of all stored chartas.
+	List() ([]string, error)
+	// Check verifies the stored pixels of the charta. It returns an error
+	// wrapping errSizeMismatch if the size differs from the charta's.
+	Check(charta *Charta) error
+	// Quarantine moves the stored pixels of the charta into dir.
+	Quarantine(id, dir string) error
+}
+
+var errSizeMismatch = errors.New("size mismatch")
+
+// listFiles returns the names of the files in dir with the extension, without
+// the extension. Temporary files are skipped.
+func listFiles(dir, ext string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ext) {
+			names = append(names, strings.TrimSuffix(entry.Name(), ext))
+		}
+	}
+	return names, nil
+}
+
+func quarantineFile(filename, dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(filename, filepath.Join(dir, filepath.Base(filename)))
+}
+
+func (cs *ChartographerService) openStore() (chartaStore, error) {
+	switch cs.Storage {
+	case "", "png":
+		return &pngStore{path: cs.pathName}, nil
+	case "mmap":
+		return newMmapStore(cs.pathName)
+	case "tiles":
+		return newTileStore(cs.pathName, cs.TileSize)
+	case "s3":
+		return newS3Store(cs.S3)
+	}
+	return nil, fmt.Errorf("unknown storage %q", cs.Storage)
+}
+
+// pngStore keeps every charta as a single uncompressed PNG file. Files are
+// always replaced as a whole, so readers never see a partial write.
+type pngStore struct {
+	path string
+}
+
+func (s *pngStore) filename(id string) string {
+	return fmt.Sprintf("%s/chartas/%s.png", s.path, id)
+}
+
+// Open returns the PNG file of the charta.
+func (s *pngStore) Open(charta *Charta) (*os.File, error) {
+	return os.Open(s.filename(charta.Id))
+}
+
+func (s *pngStore) readAll(charta *Charta) (*image.NRGBA, error) {
+	file, err := s.Open(charta)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	chartaImgRaw, err := png.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if chartaImg, ok := chartaImgRaw.(*image.NRGBA); ok {
+		return chartaImg, nil
+	}
+
+	chartaImg := image.NewNRGBA(image.Rect(0, 0, charta.Width, charta.Height))
+	draw.Draw(chartaImg, chartaImg.Bounds(), chartaImgRaw, image.Point{}, draw.Src)
+	return chartaImg, nil
+}
+
+func (s *pngStore) writeAll(charta *Charta, chartaImg *image.NRGBA) error {
+	return replaceFile(s.filename(charta.Id), func(w io.Writer) error {
+		enc := &png.Encoder{
+			CompressionLevel: png.NoCompression,
+		}
+		return enc.Encode(w, chartaImg)
+	})
+}
+
+func (s *pngStore) Create(charta *Charta) error {
+	return s.writeAll(charta, image.NewNRGBA(image.Rect(0, 0, charta.Width, charta.Height)))
+}
+
+func (s *pngStore) Read(charta *Charta, r image.Rectangle) (*image.NRGBA, error) {
+	chartaImg, err := s.readAll(charta)
+	if err != nil {
+		return nil, err
+	}
+	return chartaImg.SubImage(r).(*image.NRGBA), nil
+}
+
+func (s *pngStore) Write(charta *Charta, img *image.NRGBA) error {
+	chartaImg := img
+	if img.Bounds() != image.Rect(0, 0, charta.Width, charta.Height) {
+		var err error
+		chartaImg, err = s.readAll(charta)
+		if err != nil {
+			return err
+		}
+		draw.Draw(chartaImg, img.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+	return s.writeAll(charta, chartaImg)
+}
+
+func (s *pngStore) Rows(charta *Charta) (chartaRows, error) {
+	return s.openRows(s.filename(charta.Id))
+}
+
+func (s *pngStore) openRows(filename string) (chartaRows, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	rows := &pngChartaRows{file: file, modTime: info.ModTime()}
+	if err = rows.SeekRow(0); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (s *pngStore) Import(charta *Charta, filename string) error {
+	return linkFile(filename, s.filename(charta.Id))
+}
+
+// Copy links the files. They are never modified in place, so the chartas
+// stay independent.
+func (s *pngStore) Copy(src, dst *Charta) error {
+	return linkFile(s.filename(src.Id), s.filename(dst.Id))
+}
+
+func (s *pngStore) Resize(charta *Charta, width, height int, offset image.Point) error {
+	chartaImg, err := s.readAll(charta)
+	if err != nil {
+		return err
+	}
+
+	resized := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(resized, chartaImg.Bounds().Add(offset), chartaImg, image.Point{}, draw.Src)
+	return s.writeAll(&Charta{Id: charta.Id, Width: width, Height: height}, resized)
+}
+
+func (s *pngStore) Delete(charta *Charta) error {
+	return os.Remove(s.filename(charta.Id))
+}
+
+func (s *pngStore) List() ([]string, error) {
+	return listFiles(filepath.Join(s.path, "chartas"), ".png")
+}
+
+// Check decodes the whole file.
+func (s *pngStore) Check(charta *Charta) error {
+	rows, err := s.Rows(charta)
+	if os.IsNotExist(err) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCorruptImage, err)
+	}
+	defer rows.Close()
+
+	width, height := rows.Size()
+	if width != charta.Width || height != charta.Height {
+		return fmt.Errorf("%w: %dx%d", errSizeMismatch, width, height)
+	}
+	pix := make([]byte, 4*width)
+	for y := 0; y < height; y++ {
+		if err = rows.ReadRow(pix); err != nil {
+			return fmt.Errorf("%w: %v", errCorruptImage, err)
+		}
+	}
+	return nil
+}
+
+// Size counts a file shared with clones or with the imported fragment only in
+// part, see sharedSize.
+func (s *pngStore) Size(charta *Charta) (int64, error) {
+	info, err := os.Stat(s.filename(charta.Id))
+	if err != nil {
+		return 0, err
+	}
+	return sharedSize(info), nil
+}
+
+func (s *pngStore) Quarantine(id, dir string) error {
+	return quarantineFile(s.filename(id), dir)
+}
+
+// pngChartaRows decodes an opened PNG file. The file keeps its contents when
+// the charta is replaced, so the rows stay consistent.
+type pngChartaRows struct {
+	file    *os.File
+	rr      *pngRowReader
+	next    int
+	modTime time.Time
+}
+
+func (r *pngChartaRows) Size() (int, int) {
+	return r.rr.Size()
+}
+
+func (r *pngChartaRows) ReadRow(pix []byte) error {
+	err := r.rr.ReadRow(pix)
+	if err == nil {
+		r.next++
+	}
+	return err
+}
+
+// SeekRow skips rows forward and restarts the decoding to go back.
+func (r *pngChartaRows) SeekRow(y int) error {
+	if r.rr == nil || y < r.next {
+		if r.rr != nil {
+			_ = r.rr.Close()
+		}
+		if _, err := r.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		rr, err := newPNGRowReader(r.file)
+		if err != nil {
+			return err
+		}
+		r.rr, r.next = rr, 0
+	}
+
+	if _, height := r.rr.Size(); y > height {
+		return errors.New("png: row out of range")
+	}
+	if r.next == y {
+		return nil
+	}
+	width, _ := r.rr.Size()
+	pix := make([]byte, 4*width)
+	for r.next < y {
+		if err := r.ReadRow(pix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *pngChartaRows) ModTime() time.Time {
+	return r.modTime
+}
+
+func (r *pngChartaRows) Close() error {
+	if r.rr != nil {
+		_ = r.rr.Close()
+	}
+	return r.file.Close()
+}
+
+// tileGrid splits chartas into square tiles of the given size.
+type tileGrid struct {
+	size int
+}
+
+// tileRect returns the part of the charta covered by a tile.
+func (g tileGrid) tileRect(charta *Charta, tile image.Point) image.Rectangle {
+	r := image.Rect(tile.X, tile.Y, tile.X+1, tile.Y+1)
+	r.Min = r.Min.Mul(g.size)
+	r.Max = r.Max.Mul(g.size)
+	return r.Intersect(image.Rect(0, 0, charta.Width, charta.Height))
+}
+
+// tiles returns the tiles overlapping r.
+func (g tileGrid) tiles(r image.Rectangle) []image.Point {
+	var tiles []image.Point
+	for ty := floorDiv(r.Min.Y, g.size); ty <= floorDiv(r.Max.Y-1, g.size); ty++ {
+		for tx := floorDiv(r.Min.X, g.size); tx <= floorDiv(r.Max.X-1, g.size); tx++ {
+			tiles = append(tiles, image.Point{X: tx, Y: ty})
+		}
+	}
+	return tiles
+}
+
+func isTransparent(img *image.NRGBA) bool {
+	r := img.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for _, b := range img.Pix[img.PixOffset(r.Min.X, y) : img.PixOffset(r.Min.X, y)+4*r.Dx()] {
+			if b != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func encodeTile(img *image.NRGBA) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := png.Encode(buf, img)
+	return buf.Bytes(), err
+}
+
+// decodeTile decodes a tile and positions it at r.
+func decodeTile(data []byte, r image.Rectangle) (*image.NRGBA, error) {
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewNRGBA(r)
+	draw.Draw(img, r, decoded, decoded.Bounds().Min, draw.Src)
+	return img, nil
+}
+
+// bandRows reads a tiled charta one band of tiles at a time. No modification
+// time is reported, since tiles are read separately.
+type bandRows struct {
+	read       func(r image.Rectangle) (*image.NRGBA, error)
+	width      int
+	height     int
+	bandHeight int
+	band       int
+	img        *image.NRGBA
+	next       int
+}
+
+func newBandRows(width, height, bandHeight int, read func(r image.Rectangle) (*image.NRGBA, error)) *bandRows {
+	return &bandRows{read: read, width: width, height: height, bandHeight: bandHeight, band: -1}
+}
+
+func (r *bandRows) Size() (int, int) {
+	return r.width, r.height
+}
+
+func (r *bandRows) ReadRow(pix []byte) error {
+	if r.next >= r.height {
+		return io.EOF
+	}
+
+	band := r.next / r.bandHeight
+	if band != r.band {
+		img, err := r.read(image.Rect(0, band*r.bandHeight, r.width, (band+1)*r.bandHeight))
+		if err != nil {
+			return err
+		}
+		r.img, r.band = img, band
+	}
+
+	copy(pix, r.img.Pix[r.img.PixOffset(0, r.next):r.img.PixOffset(0, r.next)+4*r.width])
+	r.next++
+	return nil
+}
+
+func (r *bandRows) SeekRow(y int) error {
+	if y < 0 || y > r.height {
+		return fmt.Errorf("row %d out of range", y)
+	}
+	r.next = y
+	return nil
+}
+
+func (r *bandRows) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (r *bandRows) Close() error {
+	return nil
+}
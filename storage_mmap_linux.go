@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// mmapStore keeps every charta as a raw NRGBA file and accesses it through a
+// memory mapping, so reading or writing a region touches only its rows and
+// nothing is decoded or encoded. The alpha channel is kept along with the
+// color because it tells restored pixels apart. New files are sparse, so the
+// parts of a charta that were never written take no disk space.
+//
+// Pixels are written in place: unlike with pngStore, a reader running
+// concurrently with a write may see it partially applied.
+type mmapStore struct {
+	path string
+}
+
+func newMmapStore(path string) (chartaStore, error) {
+	return &mmapStore{path: path}, nil
+}
+
+func (s *mmapStore) filename(id string) string {
+	return fmt.Sprintf("%s/chartas/%s.raw", s.path, id)
+}
+
+func rawSize(width, height int) int64 {
+	return 4 * int64(width) * int64(height)
+}
+
+// mapFile maps the whole file and calls f with the mapping. The file has to
+// have the given size, so f can't run past its end; otherwise the error wraps
+// errSizeMismatch, which fsck reports.
+func mapFile(filename string, size int64, writable bool, f func(data []byte) error) error {
+	flag, prot := os.O_RDONLY, syscall.PROT_READ
+	if writable {
+		flag, prot = os.O_RDWR, syscall.PROT_READ|syscall.PROT_WRITE
+	}
+
+	file, err := os.OpenFile(filename, flag, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		return fmt.Errorf("%w: %d bytes", errSizeMismatch, info.Size())
+	}
+	if size == 0 {
+		return f(nil)
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()), prot, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	err = f(data)
+	if unmapErr := syscall.Munmap(data); err == nil {
+		err = unmapErr
+	}
+	return err
+}
+
+// createRaw creates a sparse file of the given size next to filename and
+// renames it over filename after fill has written it.
+func createRaw(filename string, size int64, fill func(data []byte) error) error {
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	err = file.Truncate(size)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = mapFile(tmp, size, true, fill)
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// copySparse copies src into the mapping of a new file unless it is all zero,
+// so that fully transparent parts stay holes.
+func copySparse(dst, src []byte) {
+	for _, b := range src {
+		if b != 0 {
+			copy(dst, src)
+			return
+		}
+	}
+}
+
+func (s *mmapStore) Create(charta *Charta) error {
+	return createRaw(s.filename(charta.Id), rawSize(charta.Width, charta.Height), func([]byte) error {
+		return nil
+	})
+}
+
+func (s *mmapStore) Read(charta *Charta, r image.Rectangle) (*image.NRGBA, error) {
+	r = r.Intersect(image.Rect(0, 0, charta.Width, charta.Height))
+	img := image.NewNRGBA(r)
+	if r.Empty() {
+		return img, nil
+	}
+
+	stride := 4 * charta.Width
+	err := mapFile(s.filename(charta.Id), rawSize(charta.Width, charta.Height), false, func(data []byte) error {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			start := y*stride + 4*r.Min.X
+			copy(img.Pix[(y-r.Min.Y)*img.Stride:], data[start:start+4*r.Dx()])
+		}
+		return nil
+	})
+	return img, err
+}
+
+func (s *mmapStore) Write(charta *Charta, img *image.NRGBA) error {
+	r := img.Bounds().Intersect(image.Rect(0, 0, charta.Width, charta.Height))
+	if r.Empty() {
+		return nil
+	}
+
+	stride := 4 * charta.Width
+	return mapFile(s.filename(charta.Id), rawSize(charta.Width, charta.Height), true, func(data []byte) error {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			start := y*stride + 4*r.Min.X
+			copy(data[start:start+4*r.Dx()], img.Pix[img.PixOffset(r.Min.X, y):])
+		}
+		return nil
+	})
+}
+
+func (s *mmapStore) Rows(charta *Charta) (chartaRows, error) {
+	file, err := os.Open(s.filename(charta.Id))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if size := rawSize(charta.Width, charta.Height); info.Size() != size {
+		return nil, fmt.Errorf("%w: %d bytes", errSizeMismatch, info.Size())
+	}
+
+	rows := &mmapChartaRows{width: charta.Width, height: charta.Height, modTime: info.ModTime()}
+	if info.Size() > 0 {
+		rows.data, err = syscall.Mmap(int(file.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+func (s *mmapStore) Import(charta *Charta, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	rr, err := newPNGRowReader(file)
+	if err != nil {
+		return err
+	}
+	defer rr.Close()
+
+	stride := 4 * charta.Width
+	return createRaw(s.filename(charta.Id), rawSize(charta.Width, charta.Height), func(data []byte) error {
+		row := make([]byte, stride)
+		for y := 0; y < charta.Height; y++ {
+			if err := rr.ReadRow(row); err != nil {
+				return err
+			}
+			copySparse(data[y*stride:(y+1)*stride], row)
+		}
+		return nil
+	})
+}
+
+// Copy copies the file block by block and leaves holes for empty blocks.
+func (s *mmapStore) Copy(src, dst *Charta) error {
+	return mapFile(s.filename(src.Id), rawSize(src.Width, src.Height), false, func(srcData []byte) error {
+		return createRaw(s.filename(dst.Id), int64(len(srcData)), func(data []byte) error {
+			const block = 1 << 16
+			for i := 0; i < len(srcData); i += block {
+				end := i + block
+				if end > len(srcData) {
+					end = len(srcData)
+				}
+				copySparse(data[i:end], srcData[i:end])
+			}
+			return nil
+		})
+	})
+}
+
+func (s *mmapStore) Resize(charta *Charta, width, height int, offset image.Point) error {
+	old := image.Rect(0, 0, charta.Width, charta.Height)
+	moved := old.Add(offset).Intersect(image.Rect(0, 0, width, height))
+
+	return mapFile(s.filename(charta.Id), rawSize(charta.Width, charta.Height), false, func(srcData []byte) error {
+		return createRaw(s.filename(charta.Id), rawSize(width, height), func(data []byte) error {
+			for y := moved.Min.Y; y < moved.Max.Y; y++ {
+				srcStart := (y-offset.Y)*4*charta.Width + 4*(moved.Min.X-offset.X)
+				dstStart := y*4*width + 4*moved.Min.X
+				copySparse(data[dstStart:dstStart+4*moved.Dx()], srcData[srcStart:srcStart+4*moved.Dx()])
+			}
+			return nil
+		})
+	})
+}
+
+func (s *mmapStore) Delete(charta *Charta) error {
+	return os.Remove(s.filename(charta.Id))
+}
+
+func (s *mmapStore) List() ([]string, error) {
+	return listFiles(filepath.Join(s.path, "chartas"), ".raw")
+}
+
+// Check can only verify the size of the file, raw pixels can't be corrupt.
+func (s *mmapStore) Check(charta *Charta) error {
+	info, err := os.Stat(s.filename(charta.Id))
+	if err != nil {
+		return err
+	}
+	if info.Size() != rawSize(charta.Width, charta.Height) {
+		return fmt.Errorf("%w: %d bytes", errSizeMismatch, info.Size())
+	}
+	return nil
+}
+
+// Size counts the allocated blocks, since untouched areas of a charta take
+// no disk space.
+func (s *mmapStore) Size(charta *Charta) (int64, error) {
+	info, err := os.Stat(s.filename(charta.Id))
+	if err != nil {
+		return 0, err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512, nil
+	}
+	return info.Size(), nil
+}
+
+func (s *mmapStore) Quarantine(id, dir string) error {
+	return quarantineFile(s.filename(id), dir)
+}
+
+// mmapChartaRows reads rows straight from the mapping. The mapping follows
+// the file it was made from, so a later resize or copy, which replace the
+// file, doesn't affect it, but in-place writes do.
+type mmapChartaRows struct {
+	data    []byte
+	width   int
+	height  int
+	next    int
+	modTime time.Time
+}
+
+func (r *mmapChartaRows) Size() (int, int) {
+	return r.width, r.height
+}
+
+func (r *mmapChartaRows) ReadRow(pix []byte) error {
+	if r.next >= r.height {
+		return io.EOF
+	}
+	stride := 4 * r.width
+	copy(pix, r.data[r.next*stride:(r.next+1)*stride])
+	r.next++
+	return nil
+}
+
+func (r *mmapChartaRows) SeekRow(y int) error {
+	if y < 0 || y > r.height {
+		return fmt.Errorf("row %d out of range", y)
+	}
+	r.next = y
+	return nil
+}
+
+func (r *mmapChartaRows) ModTime() time.Time {
+	return r.modTime
+}
+
+func (r *mmapChartaRows) Close() error {
+	if r.data == nil {
+		return nil
+	}
+	return syscall.Munmap(r.data)
+}
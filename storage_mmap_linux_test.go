@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/bmp"
+	"image"
+	"image/png"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestMmapStorage(t *testing.T) {
+	ms := &ChartographerService{Storage: "mmap", CompactInterval: -1}
+	ms.Initialize(t.TempDir(), "test.db")
+	defer ms.DB.Close()
+
+	services := []*ChartographerService{&cs, ms}
+
+	create := func(query string, body []byte) []string {
+		var ids []string
+		for _, s := range services {
+			response := serveTestRequest(s.Router, "POST", "/chartas/"+query, body)
+			assert.Equal(t, http.StatusCreated, response.Code)
+			ids = append(ids, response.Body.String())
+		}
+		return ids
+	}
+
+	ids := create("?width=400&height=300", nil)
+	both := func(method, path string, body []byte) [][]byte {
+		var results [][]byte
+		for i, s := range services {
+			response := serveTestRequest(s.Router, method, fmt.Sprintf(path, ids[i]), body)
+			assert.Less(t, response.Code, 300, path)
+			results = append(results, response.Body.Bytes())
+		}
+		return results
+	}
+	sameBody := func(method, path string, body []byte) {
+		results := both(method, path, body)
+		assert.Equal(t, results[0], results[1], path)
+	}
+
+	encode := func(w, h int) []byte {
+		buf := new(bytes.Buffer)
+		assert.NoError(t, bmp.Encode(buf, createNoiseImage(w, h)))
+		return buf.Bytes()
+	}
+
+	fragments := []struct {
+		query string
+		body  []byte
+	}{
+		{"x=-50&y=-20&width=200&height=150", encode(200, 150)},
+		{"x=100&y=100&width=200&height=150&mode=average", encode(200, 150)},
+		{"x=250&y=50&width=100&height=100&angle=30", encode(100, 100)},
+		{"x=300&y=200&width=150&height=150&feather=10", encode(150, 150)},
+	}
+	for _, f := range fragments {
+		sameBody("POST", "/chartas/%s/?"+f.query, f.body)
+	}
+
+	for _, r := range []string{"x=0&y=0&width=400&height=300", "x=-10&y=-10&width=100&height=50", "x=350&y=250&width=100&height=100"} {
+		sameBody("GET", "/chartas/%s/?"+r, nil)
+	}
+	sameBody("GET", "/chartas/%s/export?format=bmp", nil)
+	sameBody("GET", "/chartas/%s/export?format=tiff", nil)
+
+	response := serveTestRequest(ms.Router, "GET", fmt.Sprintf("/chartas/%s/export?format=png", ids[1]), nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	_, err := png.Decode(response.Body)
+	assert.NoError(t, err)
+
+	sameBody("DELETE", "/chartas/%s/fragments/2", nil)
+	sameBody("GET", "/chartas/%s/?x=0&y=0&width=400&height=300", nil)
+
+	both("PATCH", "/chartas/%s/?width=500&height=400&anchor=center", nil)
+	sameBody("GET", "/chartas/%s/?x=0&y=0&width=500&height=400", nil)
+
+	clones := make([]string, 2)
+	for i, s := range services {
+		response := serveTestRequest(s.Router, "POST", fmt.Sprintf("/chartas/%s/clone", ids[i]), nil)
+		assert.Equal(t, http.StatusCreated, response.Code)
+		clones[i] = response.Body.String()
+	}
+	sameBody("POST", "/chartas/%s/?x=0&y=0&width=100&height=100", encode(100, 100))
+	for i, s := range services {
+		a := serveTestRequest(s.Router, "GET", fmt.Sprintf("/chartas/%s/?x=0&y=0&width=500&height=400", clones[i]), nil)
+		b := serveTestRequest(services[0].Router, "GET", fmt.Sprintf("/chartas/%s/?x=0&y=0&width=500&height=400", clones[0]), nil)
+		assert.Equal(t, b.Body.Bytes(), a.Body.Bytes())
+	}
+
+	buf := new(bytes.Buffer)
+	assert.NoError(t, png.Encode(buf, createNoiseImage(64, 48)))
+	imported := create("?import=true", buf.Bytes())
+	for i, s := range services {
+		a := serveTestRequest(s.Router, "GET", fmt.Sprintf("/chartas/%s/?x=0&y=0&width=64&height=48", imported[i]), nil)
+		b := serveTestRequest(services[0].Router, "GET", fmt.Sprintf("/chartas/%s/?x=0&y=0&width=64&height=48", imported[0]), nil)
+		assert.Equal(t, b.Body.Bytes(), a.Body.Bytes())
+	}
+
+	// Untouched areas of a charta take no disk space.
+	large := serveTestRequest(ms.Router, "POST", "/chartas/?width=5000&height=5000", nil)
+	assert.Equal(t, http.StatusCreated, large.Code)
+	info, err := os.Stat(ms.store.(*mmapStore).filename(large.Body.String()))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4*5000*5000), info.Size())
+	assert.Less(t, info.Sys().(*syscall.Stat_t).Blocks*512, int64(1<<20))
+
+	// A truncated file is reported instead of crashing the service.
+	truncated := serveTestRequest(ms.Router, "POST", "/chartas/?width=100&height=100", nil).Body.String()
+	assert.NoError(t, os.Truncate(ms.store.(*mmapStore).filename(truncated), 4*100*50))
+	charta := &Charta{Id: truncated, Width: 100, Height: 100}
+	_, err = ms.store.Read(charta, image.Rect(0, 90, 10, 100))
+	assert.ErrorIs(t, err, errSizeMismatch)
+	assert.ErrorIs(t, ms.store.Write(charta, createNoiseImage(100, 100)), errSizeMismatch)
+	_, err = ms.store.Rows(charta)
+	assert.ErrorIs(t, err, errSizeMismatch)
+	assert.Equal(t, http.StatusInternalServerError, serveTestRequest(ms.Router, "GET", fmt.Sprintf("/chartas/%s/?x=0&y=90&width=10&height=10", truncated), nil).Code)
+	result, err := ms.fsck(context.Background(), FsckReport, func(float64) {})
+	assert.NoError(t, err)
+	if assert.Len(t, result.Problems, 1) {
+		assert.Equal(t, FsckSizeMismatch, result.Problems[0].Problem)
+	}
+
+	for _, id := range [][]string{ids, clones, imported} {
+		for i, s := range services {
+			assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "DELETE", fmt.Sprintf("/chartas/%s/?hard=true", id[i]), nil).Code)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func newMmapStore(path string) (chartaStore, error) {
+	return nil, errors.New("mmap storage is only supported on Linux")
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"strings"
+)
+
+const defaultS3TileSize = 512
+
+// s3Store keeps chartas in S3-compatible object storage, split into square
+// PNG tiles stored as separate objects. Tiles that were never written or are
+// fully transparent have no object, so the charta metadata in bbolt is the
+// only index that is needed. Fragment history stays on the local disk.
+//
+// Objects can't be replaced together, so a resized charta is written as a new
+// generation of tiles next to the old one. The generation in the metadata
+// decides which tiles are current; the old ones are released after the
+// metadata is committed.
+type s3Store struct {
+	tileGrid
+	client *s3Client
+	prefix string
+}
+
+func newS3Store(config S3Config) (chartaStore, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, errors.New("s3 storage needs an endpoint and a bucket")
+	}
+	tileSize := config.TileSize
+	if tileSize <= 0 {
+		tileSize = defaultS3TileSize
+	}
+	return &s3Store{tileGrid: tileGrid{size: tileSize}, client: newS3Client(config), prefix: config.Prefix}, nil
+}
+
+func (s *s3Store) chartaPrefix(id string) string {
+	return fmt.Sprintf("%schartas/%s/", s.prefix, id)
+}
+
+// tilePrefix returns the prefix of the tiles of the charta's generation. The
+// first generation has no prefix of its own.
+func (s *s3Store) tilePrefix(charta *Charta) string {
+	if charta.Generation == 0 {
+		return s.chartaPrefix(charta.Id)
+	}
+	return fmt.Sprintf("%s%d/", s.chartaPrefix(charta.Id), charta.Generation)
+}
+
+func (s *s3Store) tileKey(charta *Charta, tile image.Point) string {
+	return fmt.Sprintf("%s%d_%d.png", s.tilePrefix(charta), tile.X, tile.Y)
+}
+
+// tileKeys lists the tiles of the charta's generation.
+func (s *s3Store) tileKeys(charta *Charta) ([]string, error) {
+	prefix := s.tilePrefix(charta)
+	keys, err := s.client.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	tiles := keys[:0]
+	for _, key := range keys {
+		if !strings.Contains(strings.TrimPrefix(key, prefix), "/") {
+			tiles = append(tiles, key)
+		}
+	}
+	return tiles, nil
+}
+
+func (s *s3Store) deleteKeys(keys []string) error {
+	for _, key := range keys {
+		if err := s.client.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readTile returns the tile positioned in charta coordinates, or nil if it has
+// no object.
+func (s *s3Store) readTile(charta *Charta, tile image.Point) (*image.NRGBA, error) {
+	data, err := s.client.Get(s.tileKey(charta, tile))
+	if errors.Is(err, errNoSuchKey) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeTile(data, s.tileRect(charta, tile))
+}
+
+// writeTile stores the tile, or removes its object if it is fully transparent.
+func (s *s3Store) writeTile(charta *Charta, tile image.Point, img *image.NRGBA) error {
+	if isTransparent(img) {
+		return s.client.Delete(s.tileKey(charta, tile))
+	}
+
+	data, err := encodeTile(img)
+	if err != nil {
+		return err
+	}
+	return s.client.Put(s.tileKey(charta, tile), data)
+}
+
+func (s *s3Store) Create(charta *Charta) error {
+	// A charta without objects is fully transparent, but a previous charta
+	// with the same id might have left some behind.
+	return s.Delete(charta)
+}
+
+func (s *s3Store) Read(charta *Charta, r image.Rectangle) (*image.NRGBA, error) {
+	r = r.Intersect(image.Rect(0, 0, charta.Width, charta.Height))
+	img := image.NewNRGBA(r)
+	if r.Empty() {
+		return img, nil
+	}
+
+	for _, tile := range s.tiles(r) {
+		tileImg, err := s.readTile(charta, tile)
+		if err != nil {
+			return nil, err
+		}
+		if tileImg != nil {
+			area := tileImg.Bounds().Intersect(r)
+			draw.Draw(img, area, tileImg, area.Min, draw.Src)
+		}
+	}
+	return img, nil
+}
+
+func (s *s3Store) Write(charta *Charta, img *image.NRGBA) error {
+	r := img.Bounds().Intersect(image.Rect(0, 0, charta.Width, charta.Height))
+	if r.Empty() {
+		return nil
+	}
+
+	for _, tile := range s.tiles(r) {
+		tileRect := s.tileRect(charta, tile)
+		area := tileRect.Intersect(r)
+
+		tileImg := image.NewNRGBA(tileRect)
+		if area != tileRect {
+			existing, err := s.readTile(charta, tile)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				tileImg = existing
+			}
+		}
+		draw.Draw(tileImg, area, img, area.Min, draw.Src)
+
+		if err := s.writeTile(charta, tile, tileImg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3Store) Rows(charta *Charta) (chartaRows, error) {
+	// Tiles are read when they are needed, so the rows are not a consistent
+	// snapshot if the charta is written meanwhile.
+	c := *charta
+	return newBandRows(charta.Width, charta.Height, s.size, func(r image.Rectangle) (*image.NRGBA, error) {
+		return s.Read(&c, r)
+	}), nil
+}
+
+func (s *s3Store) Import(charta *Charta, filename string) error {
+	rows, err := (&pngStore{}).openRows(filename)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	width, height := rows.Size()
+	for y := 0; y < height; y += s.size {
+		band := image.NewNRGBA(image.Rect(0, y, width, y+s.size).Intersect(image.Rect(0, 0, width, height)))
+		for row := band.Rect.Min.Y; row < band.Rect.Max.Y; row++ {
+			if err = rows.ReadRow(band.Pix[band.PixOffset(0, row):]); err != nil {
+				return err
+			}
+		}
+		for _, tile := range s.tiles(band.Rect) {
+			if err = s.writeTile(charta, tile, band.SubImage(s.tileRect(charta, tile)).(*image.NRGBA)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *s3Store) Copy(src, dst *Charta) error {
+	keys, err := s.tileKeys(src)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, s.tilePrefix(src))
+		if err = s.client.Copy(key, s.tilePrefix(dst)+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resize writes the resized charta as the next generation, since a new tile
+// may need pixels of old tiles that would be replaced before it. Until the
+// charta is committed with the new generation the old tiles stay current.
+func (s *s3Store) Resize(charta *Charta, width, height int, offset image.Point) error {
+	resized := &Charta{Id: charta.Id, Width: width, Height: height, Generation: charta.Generation + 1}
+	// A failed resize may have left tiles of the generation behind.
+	keys, err := s.tileKeys(resized)
+	if err != nil {
+		return err
+	}
+	if err = s.deleteKeys(keys); err != nil {
+		return err
+	}
+
+	moved := image.Rect(0, 0, charta.Width, charta.Height).Add(offset).Intersect(image.Rect(0, 0, width, height))
+	for _, tile := range s.tiles(image.Rect(0, 0, width, height)) {
+		tileRect := s.tileRect(resized, tile)
+		area := tileRect.Intersect(moved)
+		if area.Empty() {
+			continue
+		}
+
+		old, err := s.Read(charta, area.Sub(offset))
+		if err != nil {
+			return err
+		}
+		tileImg := image.NewNRGBA(tileRect)
+		draw.Draw(tileImg, area, old, old.Bounds().Min, draw.Src)
+		if err = s.writeTile(resized, tile, tileImg); err != nil {
+			return err
+		}
+	}
+
+	charta.Generation = resized.Generation
+	return nil
+}
+
+// Release deletes the tiles of a generation that is no longer current.
+func (s *s3Store) Release(old *Charta) error {
+	keys, err := s.tileKeys(old)
+	if err != nil {
+		return err
+	}
+	return s.deleteKeys(keys)
+}
+
+// Delete removes the tiles of all generations.
+func (s *s3Store) Delete(charta *Charta) error {
+	keys, err := s.client.List(s.chartaPrefix(charta.Id))
+	if err != nil {
+		return err
+	}
+	return s.deleteKeys(keys)
+}
@@ -0,0 +1,746 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"image"
+	"image/draw"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTileSize = 256
+	// defaultTileGCGrace keeps unreferenced tiles for a while, since a reader
+	// may have looked a tile up just before its last reference was dropped.
+	defaultTileGCGrace = time.Minute
+	// tileStageBatch is the number of tiles built and written between read
+	// transactions on the tile database.
+	tileStageBatch = 64
+	// tileStageAttempts limits how often the tiles are written again when the
+	// garbage collector removes them before they are referenced.
+	tileStageAttempts = 3
+	// tileGCBatch is the number of tiles the garbage collector removes in a
+	// transaction.
+	tileGCBatch = 256
+)
+
+var errTileCollected = errors.New("tile was collected before it was referenced")
+
+// tileStore splits chartas into tiles and stores every distinct tile once,
+// named by the hash of its pixels. Clones, resized versions and repeated
+// areas such as fully black regions share their tiles, and fully transparent
+// tiles are not stored at all.
+//
+// The tile map of every charta and the reference counts of the tiles are kept
+// in a database of their own: the store is called while transactions on the
+// main database are open, and bbolt doesn't allow nesting them. Tile files are
+// written before the transactions that reference them and only removed inside
+// transactions on the tile database, so a tile file exists for every
+// reference. Tiles that lose their last reference are left for the garbage
+// collector.
+type tileStore struct {
+	tileGrid
+	db   *bolt.DB
+	path string
+}
+
+type tileHash [sha256.Size]byte
+
+type TileGCStats struct {
+	Tiles      int   `json:"tiles"`
+	References int   `json:"references"`
+	Collected  int   `json:"collected"`
+	BytesFreed int64 `json:"bytesFreed"`
+}
+
+func newTileStore(path string, tileSize int) (chartaStore, error) {
+	if tileSize <= 0 {
+		tileSize = defaultTileSize
+	}
+	err := os.MkdirAll(filepath.Join(path, "tiles"), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(filepath.Join(path, "tiles.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"tile-maps", "tile-refs"} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return fmt.Errorf("create bucket: %s", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &tileStore{tileGrid: tileGrid{size: tileSize}, db: db, path: path}, nil
+}
+
+func hashTile(img *image.NRGBA) tileHash {
+	h := sha256.New()
+	r := img.Bounds()
+	_ = binary.Write(h, binary.BigEndian, [2]uint32{uint32(r.Dx()), uint32(r.Dy())})
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		_, _ = h.Write(img.Pix[img.PixOffset(r.Min.X, y) : img.PixOffset(r.Min.X, y)+4*r.Dx()])
+	}
+
+	var hash tileHash
+	copy(hash[:], h.Sum(nil))
+	return hash
+}
+
+func (s *tileStore) tileFilename(hash tileHash) string {
+	name := hex.EncodeToString(hash[:])
+	return filepath.Join(s.path, "tiles", name[:2], name+".png")
+}
+
+func tileKey(tile image.Point) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint32(key, uint32(tile.X))
+	binary.BigEndian.PutUint32(key[4:], uint32(tile.Y))
+	return key
+}
+
+// tileRef is the reference count of a tile along with the time it dropped to
+// zero.
+type tileRef struct {
+	Count uint64
+	Zero  int64
+}
+
+func getTileRef(tx *bolt.Tx, hash tileHash) (tileRef, bool) {
+	v := tx.Bucket([]byte("tile-refs")).Get(hash[:])
+	if v == nil {
+		return tileRef{}, false
+	}
+	return tileRef{Count: binary.BigEndian.Uint64(v), Zero: int64(binary.BigEndian.Uint64(v[8:]))}, true
+}
+
+func putTileRef(tx *bolt.Tx, hash tileHash, ref tileRef) error {
+	v := make([]byte, 16)
+	binary.BigEndian.PutUint64(v, ref.Count)
+	binary.BigEndian.PutUint64(v[8:], uint64(ref.Zero))
+	return tx.Bucket([]byte("tile-refs")).Put(hash[:], v)
+}
+
+// writeTile stores the pixels of a tile under its hash. Tiles are written
+// before the transaction that references them, so the tile database isn't
+// locked while the files are written.
+func (s *tileStore) writeTile(hash tileHash, img *image.NRGBA) error {
+	data, err := encodeTile(img)
+	if err != nil {
+		return err
+	}
+	filename := s.tileFilename(hash)
+	if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return replaceFile(filename, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// ref adds a reference to a tile. A tile without references may have been
+// removed by the garbage collector since it was written. The collector only
+// removes tiles inside transactions on the tile database, so checking the
+// file here is enough to keep it.
+func (s *tileStore) ref(tx *bolt.Tx, hash tileHash) error {
+	ref, _ := getTileRef(tx, hash)
+	if ref.Count == 0 {
+		if _, err := os.Stat(s.tileFilename(hash)); os.IsNotExist(err) {
+			return fmt.Errorf("tile %x: %w", hash, errTileCollected)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	ref.Count++
+	ref.Zero = 0
+	return putTileRef(tx, hash, ref)
+}
+
+func (s *tileStore) unref(tx *bolt.Tx, hash tileHash) error {
+	ref, ok := getTileRef(tx, hash)
+	if !ok || ref.Count == 0 {
+		return fmt.Errorf("tile %x is not referenced", hash)
+	}
+	ref.Count--
+	if ref.Count == 0 {
+		ref.Zero = time.Now().UnixNano()
+	}
+	return putTileRef(tx, hash, ref)
+}
+
+// tileMapName returns the key of the tile map of the charta. Every resize
+// makes a new generation of the map, the first one is keyed by the id alone.
+func tileMapName(charta *Charta) []byte {
+	if charta.Generation == 0 {
+		return []byte(charta.Id)
+	}
+	return []byte(fmt.Sprintf("%s@%d", charta.Id, charta.Generation))
+}
+
+func tileMap(tx *bolt.Tx, charta *Charta) (*bolt.Bucket, error) {
+	m := tx.Bucket([]byte("tile-maps")).Bucket(tileMapName(charta))
+	if m == nil {
+		return nil, fmt.Errorf("tile map of charta %s: %w", charta.Id, fs.ErrNotExist)
+	}
+	return m, nil
+}
+
+// setTile points a tile of the charta to the tile with the given hash, or
+// drops it if hash is nil.
+func (s *tileStore) setTile(tx *bolt.Tx, m *bolt.Bucket, tile image.Point, hash *tileHash) error {
+	var old *tileHash
+	if v := m.Get(tileKey(tile)); v != nil {
+		old = new(tileHash)
+		copy(old[:], v)
+	}
+
+	if hash == nil {
+		if old == nil {
+			return nil
+		}
+		if err := m.Delete(tileKey(tile)); err != nil {
+			return err
+		}
+		return s.unref(tx, *old)
+	}
+
+	if old != nil && *old == *hash {
+		return nil
+	}
+	if err := s.ref(tx, *hash); err != nil {
+		return err
+	}
+	if err := m.Put(tileKey(tile), hash[:]); err != nil {
+		return err
+	}
+	if old != nil {
+		return s.unref(tx, *old)
+	}
+	return nil
+}
+
+// readTile returns the tile positioned in charta coordinates, or nil if it is
+// fully transparent.
+func (s *tileStore) readTile(m *bolt.Bucket, charta *Charta, tile image.Point) (*image.NRGBA, error) {
+	v := m.Get(tileKey(tile))
+	if v == nil {
+		return nil, nil
+	}
+
+	var hash tileHash
+	copy(hash[:], v)
+	data, err := os.ReadFile(s.tileFilename(hash))
+	if err != nil {
+		return nil, err
+	}
+	return decodeTile(data, s.tileRect(charta, tile))
+}
+
+// dropMap unreferences the tiles of a tile map and deletes it.
+func (s *tileStore) dropMap(tx *bolt.Tx, name []byte) error {
+	maps := tx.Bucket([]byte("tile-maps"))
+	m := maps.Bucket(name)
+	if m == nil {
+		return nil
+	}
+	err := m.ForEach(func(_, v []byte) error {
+		var hash tileHash
+		copy(hash[:], v)
+		return s.unref(tx, hash)
+	})
+	if err != nil {
+		return err
+	}
+	return maps.DeleteBucket(name)
+}
+
+// resetMap drops all tiles of the charta and returns its empty tile map.
+func (s *tileStore) resetMap(tx *bolt.Tx, charta *Charta) (*bolt.Bucket, error) {
+	if err := s.dropMap(tx, tileMapName(charta)); err != nil {
+		return nil, err
+	}
+	return tx.Bucket([]byte("tile-maps")).CreateBucket(tileMapName(charta))
+}
+
+// stagedTile is a tile of a charta along with the hash of its new pixels, or
+// nil if they are fully transparent.
+type stagedTile struct {
+	tile image.Point
+	hash *tileHash
+}
+
+// update sets the given tiles of the charta to the pixels returned by build,
+// starting from an empty tile map if reset is set. The tiles are built and
+// written before the transaction that points the tile map to them, a batch at
+// a time. This is safe since the changes of a charta are serialized by the
+// transactions on the main database. If the garbage collector removes a tile
+// meanwhile, the tiles are built again.
+func (s *tileStore) update(charta *Charta, reset bool, tiles []image.Point, build func(tx *bolt.Tx, tile image.Point) (*image.NRGBA, error)) error {
+	for attempt := 1; ; attempt++ {
+		staged := make([]stagedTile, 0, len(tiles))
+		for start := 0; start < len(tiles); start += tileStageBatch {
+			end := start + tileStageBatch
+			if end > len(tiles) {
+				end = len(tiles)
+			}
+
+			written := make(map[tileHash]*image.NRGBA)
+			err := s.db.View(func(tx *bolt.Tx) error {
+				for _, tile := range tiles[start:end] {
+					img, err := build(tx, tile)
+					if err != nil {
+						return err
+					}
+					if isTransparent(img) {
+						staged = append(staged, stagedTile{tile: tile})
+						continue
+					}
+
+					hash := hashTile(img)
+					staged = append(staged, stagedTile{tile: tile, hash: &hash})
+					if ref, _ := getTileRef(tx, hash); ref.Count == 0 {
+						written[hash] = img
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for hash, img := range written {
+				if err = s.writeTile(hash, img); err != nil {
+					return err
+				}
+			}
+		}
+
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			var m *bolt.Bucket
+			var err error
+			if reset {
+				m, err = s.resetMap(tx, charta)
+			} else {
+				m, err = tileMap(tx, charta)
+			}
+			if err != nil {
+				return err
+			}
+			for _, t := range staged {
+				if err = s.setTile(tx, m, t.tile, t.hash); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if !errors.Is(err, errTileCollected) || attempt == tileStageAttempts {
+			return err
+		}
+	}
+}
+
+func (s *tileStore) Create(charta *Charta) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		_, err := s.resetMap(tx, charta)
+		return err
+	})
+}
+
+func (s *tileStore) Read(charta *Charta, r image.Rectangle) (*image.NRGBA, error) {
+	r = r.Intersect(image.Rect(0, 0, charta.Width, charta.Height))
+	img := image.NewNRGBA(r)
+	if r.Empty() {
+		return img, nil
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		m, err := tileMap(tx, charta)
+		if err != nil {
+			return err
+		}
+		for _, tile := range s.tiles(r) {
+			tileImg, err := s.readTile(m, charta, tile)
+			if err != nil {
+				return err
+			}
+			if tileImg != nil {
+				area := tileImg.Bounds().Intersect(r)
+				draw.Draw(img, area, tileImg, area.Min, draw.Src)
+			}
+		}
+		return nil
+	})
+	return img, err
+}
+
+func (s *tileStore) Write(charta *Charta, img *image.NRGBA) error {
+	r := img.Bounds().Intersect(image.Rect(0, 0, charta.Width, charta.Height))
+	if r.Empty() {
+		return nil
+	}
+
+	return s.update(charta, false, s.tiles(r), func(tx *bolt.Tx, tile image.Point) (*image.NRGBA, error) {
+		tileRect := s.tileRect(charta, tile)
+		area := tileRect.Intersect(r)
+
+		tileImg := image.NewNRGBA(tileRect)
+		if area != tileRect {
+			m, err := tileMap(tx, charta)
+			if err != nil {
+				return nil, err
+			}
+			existing, err := s.readTile(m, charta, tile)
+			if err != nil {
+				return nil, err
+			}
+			if existing != nil {
+				tileImg = existing
+			}
+		}
+		draw.Draw(tileImg, area, img, area.Min, draw.Src)
+		return tileImg, nil
+	})
+}
+
+// Rows reads the tiles when they are needed, so the rows are not a consistent
+// snapshot if the charta is written meanwhile.
+func (s *tileStore) Rows(charta *Charta) (chartaRows, error) {
+	c := *charta
+	return newBandRows(charta.Width, charta.Height, s.size, func(r image.Rectangle) (*image.NRGBA, error) {
+		return s.Read(&c, r)
+	}), nil
+}
+
+func (s *tileStore) Import(charta *Charta, filename string) error {
+	rows, err := (&pngStore{}).openRows(filename)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	err = s.Create(charta)
+	if err != nil {
+		return err
+	}
+
+	width, height := rows.Size()
+	for y := 0; y < height; y += s.size {
+		band := image.NewNRGBA(image.Rect(0, y, width, y+s.size).Intersect(image.Rect(0, 0, width, height)))
+		for row := band.Rect.Min.Y; row < band.Rect.Max.Y; row++ {
+			if err = rows.ReadRow(band.Pix[band.PixOffset(0, row):]); err != nil {
+				return err
+			}
+		}
+		if err = s.Write(charta, band); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy only copies the tile map, the tiles are shared.
+func (s *tileStore) Copy(src, dst *Charta) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		srcMap, err := tileMap(tx, src)
+		if err != nil {
+			return err
+		}
+		dstMap, err := s.resetMap(tx, dst)
+		if err != nil {
+			return err
+		}
+		return srcMap.ForEach(func(k, v []byte) error {
+			var hash tileHash
+			copy(hash[:], v)
+			if err := s.ref(tx, hash); err != nil {
+				return err
+			}
+			return dstMap.Put(k, v)
+		})
+	})
+}
+
+// Resize builds the tile map of the next generation next to the old one, which
+// is kept until Release is called once the resized charta is saved.
+func (s *tileStore) Resize(charta *Charta, width, height int, offset image.Point) error {
+	resized := &Charta{Id: charta.Id, Width: width, Height: height, Generation: charta.Generation + 1}
+	moved := image.Rect(0, 0, charta.Width, charta.Height).Add(offset).Intersect(image.Rect(0, 0, width, height))
+
+	// A failed resize may have left a map of the generation behind, so it is
+	// reset.
+	err := s.update(resized, true, s.tiles(moved), func(tx *bolt.Tx, tile image.Point) (*image.NRGBA, error) {
+		m, err := tileMap(tx, charta)
+		if err != nil {
+			return nil, err
+		}
+		tileRect := s.tileRect(resized, tile)
+		area := tileRect.Intersect(moved)
+
+		tileImg := image.NewNRGBA(tileRect)
+		for _, oldTile := range s.tiles(area.Sub(offset)) {
+			old, err := s.readTile(m, charta, oldTile)
+			if err != nil {
+				return nil, err
+			}
+			if old != nil {
+				oldArea := old.Bounds().Add(offset).Intersect(area)
+				draw.Draw(tileImg, oldArea, old, oldArea.Min.Sub(offset), draw.Src)
+			}
+		}
+		return tileImg, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	charta.Generation = resized.Generation
+	return nil
+}
+
+// Release drops the tile map of a generation that is no longer current.
+func (s *tileStore) Release(old *Charta) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.dropMap(tx, tileMapName(old))
+	})
+}
+
+// Delete drops the tile maps of all generations, so the generation of the
+// charta doesn't need to be known.
+func (s *tileStore) Delete(charta *Charta) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var names [][]byte
+		prefix := []byte(charta.Id + "@")
+		c := tx.Bucket([]byte("tile-maps")).Cursor()
+		if k, _ := c.Seek([]byte(charta.Id)); bytes.Equal(k, []byte(charta.Id)) {
+			names = append(names, []byte(charta.Id))
+		}
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			names = append(names, append([]byte(nil), k...))
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("tile map of charta %s: %w", charta.Id, fs.ErrNotExist)
+		}
+		for _, name := range names {
+			if err := s.dropMap(tx, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// tileFile is a tile file that may be left without a reference.
+type tileFile struct {
+	path string
+	key  []byte
+	size int64
+}
+
+// gc removes the tiles that have been unreferenced for longer than grace, as
+// well as tile files without a reference count, which are left behind when a
+// transaction fails after writing a tile. The candidates are found in a read
+// transaction and removed in small batches, each checking them again, so
+// writes are only held up briefly.
+func (s *tileStore) gc(ctx context.Context, grace time.Duration, progress func(float64)) (*TileGCStats, error) {
+	stats := &TileGCStats{}
+	var collect [][]byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		refs := tx.Bucket([]byte("tile-refs"))
+		n := refs.Stats().KeyN
+		i := 0
+		return refs.ForEach(func(k, _ []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			progress(float64(i) / float64(n+1) / 2)
+			i++
+
+			var hash tileHash
+			copy(hash[:], k)
+			ref, _ := getTileRef(tx, hash)
+			if ref.Count > 0 {
+				stats.Tiles++
+				stats.References += int(ref.Count)
+			} else if time.Since(time.Unix(0, ref.Zero)) >= grace {
+				collect = append(collect, append([]byte(nil), k...))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for start := 0; start < len(collect); start += tileGCBatch {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		progress(0.5 + float64(start)/float64(len(collect))/4)
+
+		end := start + tileGCBatch
+		if end > len(collect) {
+			end = len(collect)
+		}
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			for _, k := range collect[start:end] {
+				var hash tileHash
+				copy(hash[:], k)
+				ref, ok := getTileRef(tx, hash)
+				if !ok || ref.Count > 0 || time.Since(time.Unix(0, ref.Zero)) < grace {
+					continue
+				}
+
+				info, err := os.Stat(s.tileFilename(hash))
+				if err == nil {
+					stats.BytesFreed += info.Size()
+				}
+				if err = os.Remove(s.tileFilename(hash)); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				if err = tx.Bucket([]byte("tile-refs")).Delete(k); err != nil {
+					return err
+				}
+				stats.Collected++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	progress(0.75)
+	var files []tileFile
+	err = filepath.WalkDir(filepath.Join(s.path, "tiles"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if time.Since(info.ModTime()) < grace {
+			// Might be a tile that is still being written or referenced.
+			return nil
+		}
+		file := tileFile{path: path, size: info.Size()}
+		k, decodeErr := hex.DecodeString(strings.TrimSuffix(d.Name(), ".png"))
+		if decodeErr == nil && len(k) == sha256.Size {
+			file.key = k
+		}
+
+		files = append(files, file)
+		if len(files) < tileGCBatch {
+			return nil
+		}
+		err = s.removeOrphans(files, stats)
+		files = files[:0]
+		return err
+	})
+	if err == nil {
+		err = s.removeOrphans(files, stats)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// removeOrphans removes the files without a reference count. The files are
+// checked in a read transaction first, so that the tile database is only
+// locked when there is something to remove.
+func (s *tileStore) removeOrphans(files []tileFile, stats *TileGCStats) error {
+	orphan := func(tx *bolt.Tx, file tileFile) bool {
+		return file.key == nil || tx.Bucket([]byte("tile-refs")).Get(file.key) == nil
+	}
+
+	var orphans []tileFile
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		for _, file := range files {
+			if orphan(tx, file) {
+				orphans = append(orphans, file)
+			}
+		}
+		return nil
+	})
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, file := range orphans {
+			if !orphan(tx, file) {
+				continue
+			}
+			if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			stats.Collected++
+			stats.BytesFreed += file.size
+		}
+		return nil
+	})
+}
+
+type GCQuery struct {
+	Grace time.Duration `form:"grace" binding:"omitempty,gte=0"`
+}
+
+// collectTiles runs the garbage collector of the tile store. It does nothing
+// for the other stores.
+func (cs *ChartographerService) collectTiles(ctx context.Context, grace time.Duration, progress func(float64)) (*TileGCStats, error) {
+	ts, ok := cs.store.(*tileStore)
+	if !ok {
+		return &TileGCStats{}, nil
+	}
+	return ts.gc(ctx, grace, progress)
+}
+
+// gcEndpoint starts a garbage collection job. Unreferenced tiles are kept for
+// the given grace period, a minute by default.
+func (cs *ChartographerService) gcEndpoint(c *gin.Context) {
+	if _, ok := cs.store.(*tileStore); !ok {
+		c.AbortWithStatus(http.StatusNotImplemented)
+		return
+	}
+
+	var query GCQuery
+	if err := c.BindQuery(&query); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if c.Query("grace") == "" {
+		query.Grace = defaultTileGCGrace
+	}
+
+	job, err := cs.submitJob("gc", "", "", func(ctx context.Context, job *Job, progress func(float64)) (interface{}, error) {
+		return cs.collectTiles(ctx, query.Grace, progress)
+	})
+	cs.respondWithJob(c, job, err)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/image/bmp"
+	"image"
+	"image/color"
+	"image/png"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTileStorage(t *testing.T) {
+	ts := &ChartographerService{Storage: "tiles", TileSize: 100, CompactInterval: -1}
+	ts.Initialize(t.TempDir(), "test.db")
+	defer ts.DB.Close()
+	store := ts.store.(*tileStore)
+
+	tileFiles := func() int {
+		n := 0
+		_ = filepath.WalkDir(filepath.Join(ts.pathName, "tiles"), func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				n++
+			}
+			return err
+		})
+		return n
+	}
+	gc := func(grace time.Duration) *TileGCStats {
+		stats, err := store.gc(context.Background(), grace, func(float64) {})
+		assert.NoError(t, err)
+		return stats
+	}
+
+	services := []*ChartographerService{&cs, ts}
+	var ids []string
+	for _, s := range services {
+		response := serveTestRequest(s.Router, "POST", "/chartas/?width=400&height=300", nil)
+		assert.Equal(t, http.StatusCreated, response.Code)
+		ids = append(ids, response.Body.String())
+	}
+	both := func(method, path string) {
+		for i, s := range services {
+			assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, method, fmt.Sprintf(path, ids[i]), nil).Code, path)
+		}
+	}
+	sameBody := func(method, path string, body []byte) {
+		var results [][]byte
+		for i, s := range services {
+			response := serveTestRequest(s.Router, method, fmt.Sprintf(path, ids[i]), body)
+			assert.Less(t, response.Code, 300, path)
+			results = append(results, response.Body.Bytes())
+		}
+		assert.Equal(t, results[0], results[1], path)
+	}
+	encode := func(img image.Image) []byte {
+		buf := new(bytes.Buffer)
+		assert.NoError(t, bmp.Encode(buf, img))
+		return buf.Bytes()
+	}
+
+	// The black area covers six whole tiles, which share one stored tile.
+	black := createSolidImage(300, 200, color.NRGBA{A: 255})
+	sameBody("POST", "/chartas/%s/?x=0&y=0&width=300&height=200", encode(black))
+	assert.Equal(t, 1, tileFiles())
+
+	sameBody("POST", "/chartas/%s/?x=150&y=50&width=200&height=200", encode(createNoiseImage(200, 200)))
+	sameBody("POST", "/chartas/%s/?x=20&y=220&width=100&height=100&angle=30", encode(createNoiseImage(100, 100)))
+	sameBody("GET", "/chartas/%s/?x=0&y=0&width=400&height=300", nil)
+	sameBody("GET", "/chartas/%s/?x=-30&y=-30&width=150&height=120", nil)
+	sameBody("GET", "/chartas/%s/export?format=bmp", nil)
+
+	// Clones share all tiles.
+	files := tileFiles()
+	response := serveTestRequest(ts.Router, "POST", fmt.Sprintf("/chartas/%s/clone", ids[1]), nil)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	clone := response.Body.String()
+	assert.Equal(t, files, tileFiles())
+
+	// A resize by whole tiles keeps the tiles, the other ones make new ones.
+	both("PATCH", "/chartas/%s/?width=500&height=400&left=100&top=100")
+	sameBody("GET", "/chartas/%s/?x=0&y=0&width=500&height=400", nil)
+	assert.Equal(t, files, tileFiles())
+	both("PATCH", "/chartas/%s/?width=450&height=350&anchor=center")
+	sameBody("GET", "/chartas/%s/?x=0&y=0&width=450&height=350", nil)
+
+	sameBody("DELETE", "/chartas/%s/fragments/2", nil)
+	sameBody("GET", "/chartas/%s/?x=0&y=0&width=450&height=350", nil)
+
+	// Unreferenced tiles are kept for the grace period.
+	files = tileFiles()
+	assert.Equal(t, 0, gc(time.Hour).Collected)
+	stats := gc(0)
+	assert.Greater(t, stats.Collected, 0)
+	assert.Equal(t, files-stats.Collected, tileFiles())
+	assert.Equal(t, stats.Tiles, tileFiles())
+	assert.Greater(t, stats.References, stats.Tiles)
+
+	// The clone is unaffected by the changes of the original.
+	response = serveTestRequest(ts.Router, "GET", fmt.Sprintf("/chartas/%s/?x=0&y=0&width=400&height=300", clone), nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	img, err := bmp.Decode(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, color.RGBA{A: 255}, img.At(10, 10))
+
+	// Imported images are split into tiles as well.
+	buf := new(bytes.Buffer)
+	assert.NoError(t, png.Encode(buf, createNoiseImage(250, 150)))
+	var imported []string
+	for _, s := range services {
+		response = serveTestRequest(s.Router, "POST", "/chartas/?import=true", buf.Bytes())
+		assert.Equal(t, http.StatusCreated, response.Code)
+		imported = append(imported, response.Body.String())
+	}
+	a := serveTestRequest(cs.Router, "GET", fmt.Sprintf("/chartas/%s/?x=0&y=0&width=250&height=150", imported[0]), nil)
+	b := serveTestRequest(ts.Router, "GET", fmt.Sprintf("/chartas/%s/?x=0&y=0&width=250&height=150", imported[1]), nil)
+	assert.Equal(t, a.Body.Bytes(), b.Body.Bytes())
+	assert.Equal(t, http.StatusOK, serveTestRequest(cs.Router, "DELETE", fmt.Sprintf("/chartas/%s/?hard=true", imported[0]), nil).Code)
+	assert.Equal(t, http.StatusOK, serveTestRequest(ts.Router, "DELETE", fmt.Sprintf("/chartas/%s/?hard=true", imported[1]), nil).Code)
+
+	for i, s := range services {
+		assert.Equal(t, http.StatusOK, serveTestRequest(s.Router, "DELETE", fmt.Sprintf("/chartas/%s/?hard=true", ids[i]), nil).Code)
+	}
+	assert.Equal(t, http.StatusOK, serveTestRequest(ts.Router, "DELETE", fmt.Sprintf("/chartas/%s/?hard=true", clone), nil).Code)
+
+	// Files left behind by failed writes are collected too.
+	orphan := filepath.Join(ts.pathName, "tiles", "00", "orphan.png")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(orphan), 0755))
+	assert.NoError(t, os.WriteFile(orphan, []byte("orphan"), 0644))
+	job := waitServiceJob(t, ts, serveTestRequest(ts.Router, "POST", "/admin/gc?grace=0s", nil))
+	assert.Equal(t, JobDone, job.Status)
+	assert.Equal(t, 0, tileFiles())
+
+	assert.Equal(t, http.StatusNotImplemented, serveTestRequest(cs.Router, "POST", "/admin/gc", nil).Code)
+}
+
+func TestTileStoreGenerations(t *testing.T) {
+	ts := &ChartographerService{Storage: "tiles", TileSize: 100, CompactInterval: -1}
+	ts.Initialize(t.TempDir(), "test.db")
+	defer ts.DB.Close()
+	store := ts.store.(*tileStore)
+
+	charta := &Charta{Id: "1", Width: 300, Height: 200}
+	assert.NoError(t, store.Create(charta))
+	noise := createNoiseImage(300, 200)
+	assert.NoError(t, store.Write(charta, noise))
+
+	// The old generation stays readable until it is released.
+	old := *charta
+	assert.NoError(t, store.Resize(charta, 250, 250, image.Point{X: 50}))
+	assert.Equal(t, 1, charta.Generation)
+	charta.Width, charta.Height = 250, 250
+	img, err := store.Read(&old, image.Rect(0, 0, old.Width, old.Height))
+	assert.NoError(t, err)
+	assert.Equal(t, noise.Pix, img.Pix)
+	img, err = store.Read(charta, image.Rect(50, 0, 250, 200))
+	assert.NoError(t, err)
+	assert.Equal(t, noise.SubImage(image.Rect(0, 0, 200, 200)).(*image.NRGBA).Pix[:4*200], img.Pix[:4*200])
+
+	assert.NoError(t, store.Release(&old))
+	_, err = store.Read(&old, image.Rect(0, 0, old.Width, old.Height))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// A resize whose transaction failed leaves a map that the next one resets.
+	failed := *charta
+	assert.NoError(t, store.Resize(&failed, 100, 100, image.Point{}))
+	assert.NoError(t, store.Resize(charta, 100, 100, image.Point{}))
+	assert.Equal(t, failed.Generation, charta.Generation)
+	charta.Width, charta.Height = 100, 100
+
+	// Tiles collected while unreferenced are written again.
+	black := createSolidImage(100, 100, color.NRGBA{A: 255})
+	assert.NoError(t, store.Write(charta, black))
+	assert.NoError(t, store.Write(charta, createNoiseImage(100, 100)))
+	stats, err := store.gc(context.Background(), 0, func(float64) {})
+	assert.NoError(t, err)
+	assert.Greater(t, stats.Collected, 0)
+	assert.NoError(t, store.Write(charta, black))
+	img, err = store.Read(charta, image.Rect(0, 0, charta.Width, charta.Height))
+	assert.NoError(t, err)
+	assert.Equal(t, black.Pix, img.Pix)
+
+	// Deleting the charta drops all of its generations.
+	assert.NoError(t, store.Resize(&failed, 50, 50, image.Point{}))
+	assert.NoError(t, store.Delete(charta))
+	assert.NoError(t, store.db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket([]byte("tile-maps")).Cursor().First()
+		assert.Nil(t, k)
+		return nil
+	}))
+	stats, err = store.gc(context.Background(), 0, func(float64) {})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.Tiles)
+}
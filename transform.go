@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"github.com/disintegration/imaging"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const maxTransformedSize = 10000
+
+var errBadTransform = errors.New("bad fragment transform")
+
+func (f *Fragment) isTransformed() bool {
+	return f.Matrix != "" || (f.Angle != 0 && math.Mod(f.Angle, 360) != 0) || (f.Scale != 0 && f.Scale != 1)
+}
+
+// transformFragment resamples the uploaded fragment according to its angle,
+// scale or affine matrix. It returns the resampled image together with the
+// rectangle it occupies in charta coordinates; pixels outside the original
+// fragment are transparent.
+func transformFragment(img image.Image, f *Fragment) (*image.NRGBA, image.Rectangle, error) {
+	if f.Matrix != "" {
+		if f.Angle != 0 || f.Scale != 0 {
+			return nil, image.Rectangle{}, errBadTransform
+		}
+
+		m, err := parseMatrix(f.Matrix)
+		if err != nil {
+			return nil, image.Rectangle{}, err
+		}
+
+		return warpAffine(imaging.Clone(img), m, *f.X, *f.Y, f.Filter)
+	}
+
+	if math.IsNaN(f.Angle) || math.IsInf(f.Angle, 0) || math.IsNaN(f.Scale) || math.IsInf(f.Scale, 0) {
+		return nil, image.Rectangle{}, errBadTransform
+	}
+
+	filter := imaging.Linear
+	if f.Filter == "bicubic" {
+		filter = imaging.CatmullRom
+	}
+
+	scale := f.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	width := int(math.Round(float64(f.Width) * scale))
+	height := int(math.Round(float64(f.Height) * scale))
+	if width < 1 || height < 1 || width > maxTransformedSize || height > maxTransformedSize {
+		return nil, image.Rectangle{}, errBadTransform
+	}
+
+	// The rotation grows the image to the bounding box of the rotated one.
+	sin, cos := math.Sincos(f.Angle * math.Pi / 180)
+	rotatedWidth := math.Abs(float64(width)*cos) + math.Abs(float64(height)*sin)
+	rotatedHeight := math.Abs(float64(width)*sin) + math.Abs(float64(height)*cos)
+	if math.Ceil(rotatedWidth) > maxTransformedSize || math.Ceil(rotatedHeight) > maxTransformedSize {
+		return nil, image.Rectangle{}, errBadTransform
+	}
+
+	transformed := imaging.Clone(img)
+	if width != f.Width || height != f.Height {
+		transformed = imaging.Resize(transformed, width, height, filter)
+	}
+	transformed = imaging.Rotate(transformed, f.Angle, color.Transparent)
+
+	// The fragment is scaled around its top left corner and rotated around its center.
+	b := transformed.Bounds()
+	min := image.Point{
+		X: *f.X + (width-b.Dx())/2,
+		Y: *f.Y + (height-b.Dy())/2,
+	}
+	return transformed, b.Add(min), nil
+}
+
+type affineMatrix [6]float64
+
+func parseMatrix(s string) (affineMatrix, error) {
+	var m affineMatrix
+	parts := strings.Split(s, ",")
+	if len(parts) != len(m) {
+		return m, errBadTransform
+	}
+
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return m, errBadTransform
+		}
+		m[i] = v
+	}
+
+	return m, nil
+}
+
+// warpAffine maps the fragment pixel (u, v) to the charta point
+// (x + a*u + b*v + c, y + d*u + e*v + f) where m is (a, b, c, d, e, f).
+func warpAffine(src *image.NRGBA, m affineMatrix, x, y int, filter string) (*image.NRGBA, image.Rectangle, error) {
+	a, b, c, d, e, f := m[0], m[1], m[2], m[3], m[4], m[5]
+	det := a*e - b*d
+	if math.Abs(det) < 1e-9 {
+		return nil, image.Rectangle{}, errBadTransform
+	}
+
+	w, h := float64(src.Bounds().Dx()), float64(src.Bounds().Dy())
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, corner := range [][2]float64{{0, 0}, {w, 0}, {0, h}, {w, h}} {
+		cx := a*corner[0] + b*corner[1] + c
+		cy := d*corner[0] + e*corner[1] + f
+		minX, maxX = math.Min(minX, cx), math.Max(maxX, cx)
+		minY, maxY = math.Min(minY, cy), math.Max(maxY, cy)
+	}
+
+	bounds := image.Rect(int(math.Floor(minX)), int(math.Floor(minY)), int(math.Ceil(maxX)), int(math.Ceil(maxY)))
+	if bounds.Dx() < 1 || bounds.Dy() < 1 || bounds.Dx() > maxTransformedSize || bounds.Dy() > maxTransformedSize {
+		return nil, image.Rectangle{}, errBadTransform
+	}
+
+	sample := sampleBilinear
+	if filter == "bicubic" {
+		sample = sampleBicubic
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for dy := 0; dy < bounds.Dy(); dy++ {
+		for dx := 0; dx < bounds.Dx(); dx++ {
+			px := float64(bounds.Min.X+dx) + 0.5 - c
+			py := float64(bounds.Min.Y+dy) + 0.5 - f
+			u := (e*px - b*py) / det
+			v := (a*py - d*px) / det
+			if u < 0 || v < 0 || u >= w || v >= h {
+				continue
+			}
+			dst.SetNRGBA(dx, dy, sample(src, u-0.5, v-0.5))
+		}
+	}
+
+	return dst, bounds.Add(image.Point{X: x, Y: y}), nil
+}
+
+func sampleBilinear(src *image.NRGBA, u, v float64) color.NRGBA {
+	x0, y0 := math.Floor(u), math.Floor(v)
+	fx, fy := u-x0, v-y0
+
+	var acc [4]float64
+	for j := 0; j < 2; j++ {
+		for i := 0; i < 2; i++ {
+			weight := math.Abs(1-float64(i)-fx) * math.Abs(1-float64(j)-fy)
+			accumulatePixel(&acc, src, int(x0)+i, int(y0)+j, weight)
+		}
+	}
+
+	return pixelFromAccumulator(acc)
+}
+
+func sampleBicubic(src *image.NRGBA, u, v float64) color.NRGBA {
+	x0, y0 := math.Floor(u), math.Floor(v)
+	fx, fy := u-x0, v-y0
+
+	var acc [4]float64
+	for j := -1; j <= 2; j++ {
+		for i := -1; i <= 2; i++ {
+			weight := catmullRom(float64(i)-fx) * catmullRom(float64(j)-fy)
+			accumulatePixel(&acc, src, int(x0)+i, int(y0)+j, weight)
+		}
+	}
+
+	return pixelFromAccumulator(acc)
+}
+
+func catmullRom(t float64) float64 {
+	t = math.Abs(t)
+	switch {
+	case t < 1:
+		return 1.5*t*t*t - 2.5*t*t + 1
+	case t < 2:
+		return -0.5*t*t*t + 2.5*t*t - 4*t + 2
+	default:
+		return 0
+	}
+}
+
+// accumulatePixel adds the premultiplied color of the pixel nearest to (x, y)
+// inside src, so the borders of the fragment are not darkened by resampling.
+func accumulatePixel(acc *[4]float64, src *image.NRGBA, x, y int, weight float64) {
+	b := src.Bounds()
+	x = int(math.Max(float64(b.Min.X), math.Min(float64(b.Max.X-1), float64(x))))
+	y = int(math.Max(float64(b.Min.Y), math.Min(float64(b.Max.Y-1), float64(y))))
+
+	p := src.NRGBAAt(x, y)
+	alpha := float64(p.A) * weight
+	acc[0] += float64(p.R) * alpha
+	acc[1] += float64(p.G) * alpha
+	acc[2] += float64(p.B) * alpha
+	acc[3] += alpha
+}
+
+func pixelFromAccumulator(acc [4]float64) color.NRGBA {
+	if acc[3] <= 0 {
+		return color.NRGBA{}
+	}
+
+	clamp := func(v float64) uint8 {
+		return uint8(math.Max(0, math.Min(255, math.Round(v))))
+	}
+
+	return color.NRGBA{
+		R: clamp(acc[0] / acc[3]),
+		G: clamp(acc[1] / acc[3]),
+		B: clamp(acc[2] / acc[3]),
+		A: clamp(acc[3]),
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// Deleted chartas are moved to the "trash" bucket and keep their images and
+// fragment history until the retention period ends, so they can be restored.
+// Ids are never given out again, so a restored charta keeps its id. A
+// negative TrashRetention disables the trash.
+
+const defaultTrashRetention = 7 * 24 * time.Hour
+
+// TrashEntry keeps the deleted charta as it was stored, so that restoring it
+// brings back its expiry, project and creator too.
+type TrashEntry struct {
+	Id        string    `json:"id"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Project   string    `json:"project,omitempty"`
+	DeletedAt time.Time `json:"deletedAt"`
+	Expires   time.Time `json:"expires"`
+	Charta    Charta    `json:"charta"`
+}
+
+type DeleteQuery struct {
+	Hard bool `form:"hard"`
+}
+
+type PurgeQuery struct {
+	All bool `form:"all"`
+}
+
+type PurgeStats struct {
+	Purged int `json:"purged"`
+	Trash  int `json:"trash"`
+}
+
+func (cs *ChartographerService) trashRetention() time.Duration {
+	if cs.TrashRetention == 0 {
+		return defaultTrashRetention
+	}
+	return cs.TrashRetention
+}
+
+func getTrashEntry(tx *bolt.Tx, id string) (*TrashEntry, error) {
+	v := tx.Bucket([]byte("trash")).Get([]byte(id))
+	if v == nil {
+		return nil, nil
+	}
+
+	var entry TrashEntry
+	err := json.Unmarshal(v, &entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// trashCharta moves the charta to the trash.
+func (cs *ChartographerService) trashCharta(tx *bolt.Tx, charta *Charta) error {
+	now := time.Now().UTC()
+	buf, err := json.Marshal(TrashEntry{
+		Id:        charta.Id,
+		Width:     charta.Width,
+		Height:    charta.Height,
+		Project:   charta.Project,
+		DeletedAt: now,
+		Expires:   now.Add(cs.trashRetention()),
+		Charta:    *charta,
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket([]byte("trash")).Put([]byte(charta.Id), buf)
+	if err != nil {
+		return err
+	}
+	err = trashUsage(tx, charta.Id, true)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("chartas")).Delete([]byte(charta.Id))
+}
+
+// purgeCharta deletes the charta with its images and fragment history, whether
+// it is in the trash or not.
+func (cs *ChartographerService) purgeCharta(tx *bolt.Tx, id string) error {
+	err := cs.store.Delete(&Charta{Id: id})
+	if err != nil {
+		return err
+	}
+	err = deleteFragmentRecords(tx, id)
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(fmt.Sprintf("%s/fragments/%s", cs.pathName, id))
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket([]byte("trash")).Delete([]byte(id))
+	if err != nil {
+		return err
+	}
+	err = cs.dropUsage(tx, id)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("chartas")).Delete([]byte(id))
+}
+
+// purgeTrash deletes the chartas whose retention period has ended, or all of
+// the trash. Every charta is purged in its own transaction, so requests are
+// not held up by a large trash.
+func (cs *ChartographerService) purgeTrash(ctx context.Context, all bool, progress func(float64)) (*PurgeStats, error) {
+	now := time.Now()
+	var expired []string
+	stats := &PurgeStats{}
+	err := cs.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("trash")).ForEach(func(k, v []byte) error {
+			var entry TrashEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if all || !entry.Expires.After(now) {
+				expired = append(expired, entry.Id)
+			} else {
+				stats.Trash++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, id := range expired {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		progress(float64(i) / float64(len(expired)))
+
+		err = cs.DB.Update(func(tx *bolt.Tx) error {
+			// The charta may have been restored in the meantime.
+			entry, err := getTrashEntry(tx, id)
+			if err != nil || entry == nil {
+				return err
+			}
+			if !all && entry.Expires.After(now) {
+				stats.Trash++
+				return nil
+			}
+			stats.Purged++
+			return cs.purgeCharta(tx, id)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+func (cs *ChartographerService) getTrashEndpoint(c *gin.Context) {
+	entries := []TrashEntry{}
+	err := cs.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("trash")).ForEach(func(_, v []byte) error {
+			var entry TrashEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if inScope(c, chartaProject(&entry.Charta)) {
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// The most recently deleted chartas come first.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.After(entries[j].DeletedAt)
+	})
+	c.JSON(http.StatusOK, entries)
+}
+
+func (cs *ChartographerService) restoreChartaEndpoint(c *gin.Context) {
+	found := true
+	err := cs.DB.Update(func(tx *bolt.Tx) error {
+		entry, err := getTrashEntry(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			found = false
+			return nil
+		}
+
+		charta := entry.Charta
+		// The sweeper would delete a charta whose lifetime ran out while it
+		// was in the trash right away, so it comes back without one.
+		if charta.Expires != nil && !charta.Expires.After(time.Now()) {
+			charta.Expires = nil
+		}
+		err = cs.checkQuota(tx, chartaProject(&charta), 1, int64(charta.Width)*int64(charta.Height))
+		if err != nil {
+			return err
+		}
+
+		buf, err := json.Marshal(charta)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte("chartas")).Put([]byte(entry.Id), buf)
+		if err != nil {
+			return err
+		}
+		err = trashUsage(tx, entry.Id, false)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("trash")).Delete([]byte(entry.Id))
+	})
+	if err != nil {
+		c.AbortWithStatus(quotaStatus(err))
+		return
+	}
+	if !found {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// purgeEndpoint starts a job that purges the expired chartas from the trash,
+// or all of them with all=true.
+func (cs *ChartographerService) purgeEndpoint(c *gin.Context) {
+	var query PurgeQuery
+	if err := c.BindQuery(&query); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	job, err := cs.submitJob("purge", "", "", func(ctx context.Context, job *Job, progress func(float64)) (interface{}, error) {
+		return cs.purgeTrash(ctx, query.All, progress)
+	})
+	cs.respondWithJob(c, job, err)
+}
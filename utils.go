@@ -5,7 +5,13 @@ import (
 	"github.com/gin-gonic/gin"
 	"golang.org/x/image/bmp"
 	"image"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 func createBlackImage(width, height int) image.NRGBA {
@@ -32,3 +38,118 @@ func writeBmpIntoTheBody(fragmentImgBg *image.NRGBA, c *gin.Context) error {
 	c.Data(200, "image/bmp", buf.Bytes())
 	return nil
 }
+
+// recoverRequest answers a request that panicked with 500. Aborted responses
+// are passed on to net/http, which closes the connection.
+func recoverRequest(c *gin.Context, err interface{}) {
+	if err == http.ErrAbortHandler {
+		panic(err)
+	}
+	c.AbortWithStatus(http.StatusInternalServerError)
+}
+
+// abortResponse logs the failure of a response that has already started and
+// aborts it. The status is sent by then, so closing the connection is the
+// only way to tell the client that the body is incomplete.
+func abortResponse(what string, err error) {
+	log.Printf("%s: %s", what, err)
+	panic(http.ErrAbortHandler)
+}
+
+// spoolBody copies a request body of at most limit bytes into the file. On
+// failure it returns the status to answer with: 413 for a larger body, 400
+// for a body that couldn't be read and 500 when the file couldn't be written.
+func spoolBody(c *gin.Context, body io.Reader, file *os.File, limit int64) (int64, int) {
+	r := &readFailure{r: http.MaxBytesReader(c.Writer, io.NopCloser(body), limit)}
+	n, err := io.Copy(file, r)
+	switch {
+	case err == nil:
+		return n, 0
+	case r.err == nil:
+		return n, http.StatusInternalServerError
+	// Go 1.18 has no http.MaxBytesError yet, so the error is told by its
+	// message.
+	case strings.Contains(r.err.Error(), "request body too large"):
+		return n, http.StatusRequestEntityTooLarge
+	default:
+		return n, http.StatusBadRequest
+	}
+}
+
+// readFailure remembers the error of a failed read.
+type readFailure struct {
+	r   io.Reader
+	err error
+}
+
+func (rf *readFailure) Read(p []byte) (int, error) {
+	n, err := rf.r.Read(p)
+	if err != nil && err != io.EOF {
+		rf.err = err
+	}
+	return n, err
+}
+
+// replaceFile writes a new version of the file next to it and renames it over
+// the old one. The old version is never modified in place, so it stays intact
+// for hard links made by clones.
+func replaceFile(filename string, write func(w io.Writer) error) error {
+	staged, err := stageFile(filename, write)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(staged, filename); err != nil {
+		_ = os.Remove(staged)
+	}
+	return err
+}
+
+// stageFile writes a new version of the file next to it and returns its name
+// without replacing the file yet.
+func stageFile(filename string, write func(w io.Writer) error) (string, error) {
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+
+	err = write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// sharedSize returns the part of the size of the file that each of its hard
+// links accounts for, rounded down.
+func sharedSize(info os.FileInfo) int64 {
+	return info.Size() / int64(linkCount(info))
+}
+
+// linkFile makes dst share the contents of src with a hard link and falls back
+// to copying where links aren't supported.
+func linkFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return replaceFile(dst, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// linkCount returns the number of hard links to the file.
+func linkCount(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Nlink)
+	}
+	return 1
+}
+
+// fileKey identifies the file, whatever link it is reached through.
+func fileKey(info os.FileInfo) string {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+	}
+	return ""
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// linkCount returns the number of hard links to the file. It is only known
+// on Linux.
+func linkCount(info os.FileInfo) uint64 {
+	return 1
+}
+
+// fileKey identifies the file, whatever link it is reached through. It is
+// only known on Linux.
+func fileKey(info os.FileInfo) string {
+	return ""
+}